@@ -0,0 +1,96 @@
+// Package catalog reads users of the userlist from postgres catalogs, Source
+// implements userlist.Source on top of a database handle.
+package catalog
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// UsersQuery selects users which are not members of excluded roles ($1).
+const UsersQuery = `
+select distinct
+    id.rolname,
+    id.rolpassword
+from pg_authid as id
+    left join pg_catalog.pg_auth_members m on id.oid = m.member
+    left join pg_catalog.pg_roles r on m.roleid = r.oid
+where (r.rolname is null or not(r.rolname::TEXT=any($1))) and id.rolpassword is not null
+`
+
+// snapshotQuery is the first statement of the repeatable read transaction, so the snapshot
+// of the users query is taken at its wal position.
+const snapshotQuery = `
+select
+    case when pg_is_in_recovery() then pg_last_wal_replay_lsn() else pg_current_wal_lsn() end::text,
+    now()
+`
+
+// Source reads users with Query, which selects name and password taking
+// excluded roles as text[] parameter, in a read only transaction.
+// Empty Query defaults to UsersQuery. Non-nil Snapshot makes the transaction
+// repeatable read and receives the database state users were read at.
+type Source struct {
+	DB       *sql.DB
+	Query    string
+	Exclude  []string
+	Timings  userlist.Timings
+	Snapshot *Snapshot
+}
+
+// Snapshot is the wal position and the transaction time of a users read.
+type Snapshot struct {
+	LSN  string
+	Time time.Time
+}
+
+// Users returns username to password map selected by the query.
+func (s *Source) Users(ctx context.Context) (map[string]string, error) {
+	query := s.Query
+	if query == "" {
+		query = UsersQuery
+	}
+	connectStart := time.Now()
+	opts := &sql.TxOptions{ReadOnly: true}
+	if s.Snapshot != nil {
+		opts.Isolation = sql.LevelRepeatableRead
+	}
+	tx, errTx := s.DB.BeginTx(ctx, opts)
+	s.Timings.Add(userlist.PhaseConnect, connectStart)
+	if errTx != nil {
+		return nil, errTx
+	}
+	// nolint:errcheck
+	defer tx.Commit()
+	queryStart := time.Now()
+	if s.Snapshot != nil {
+		if err := tx.QueryRowContext(ctx, snapshotQuery).Scan(&s.Snapshot.LSN, &s.Snapshot.Time); err != nil {
+			return nil, err
+		}
+	}
+	rows, errRows := tx.QueryContext(ctx, query, pq.Array(s.Exclude))
+	s.Timings.Add(userlist.PhaseQuery, queryStart)
+	if errRows != nil {
+		return nil, errRows
+	}
+	// nolint:errcheck
+	defer rows.Close()
+	scanStart := time.Now()
+	users := make(map[string]string)
+	for rows.Next() {
+		var username, password string
+		if errScan := rows.Scan(&username, &password); errScan != nil {
+			return nil, errScan
+		}
+		users[username] = password
+	}
+	if errRowsClose := rows.Err(); errRowsClose != nil {
+		return nil, errRowsClose
+	}
+	s.Timings.Add(userlist.PhaseScan, scanStart)
+	return users, nil
+}
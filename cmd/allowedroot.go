@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errOutsideRoot = errors.New("path is outside -allowed-root")
+
+// checkAllowedRoot fails if the path resolves outside -allowed-root, following symlinks
+// of the path and of its existing parent directories.
+func checkAllowedRoot(path string) error {
+	if *allowedRoot == "" {
+		return nil
+	}
+	root, err := resolvePath(*allowedRoot)
+	if err != nil {
+		return err
+	}
+	resolved, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s resolves to %s: %w %s", path, resolved, errOutsideRoot, root)
+	}
+	return nil
+}
+
+// resolvePath returns the absolute path with symlinks of its existing part resolved.
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	existing, rest := abs, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		// dangling symlinks are followed too, the file may be created at their target.
+		if target, errLink := os.Readlink(existing); errLink == nil {
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(existing), target)
+			}
+			return resolvePath(filepath.Join(target, rest))
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return abs, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
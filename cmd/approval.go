@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// pendingPath is where the userlist waiting for approval is staged.
+func pendingPath() string {
+	return *filePath + ".pending"
+}
+
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// approvalGate reports whether the content may replace the userlist with -require-approval.
+// Unapproved changes are staged for the approve command, approved ones clear the staging.
+// The content and the current userlist are compared without the -snapshot comment.
+func approvalGate(content []byte, report *runReport) (bool, error) {
+	if !*requireApproval {
+		return true, nil
+	}
+	current, err := os.ReadFile(*filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	sum := checksum(content)
+	if err == nil && bytes.Equal(withoutSnapshot(current), content) || sum == state.ApprovedChecksum {
+		if state.PendingChecksum != "" || state.ApprovedChecksum != "" {
+			state.PendingChecksum, state.PendingSince, state.ApprovedChecksum = "", time.Time{}, ""
+			if err := os.Remove(pendingPath()); err != nil && !os.IsNotExist(err) {
+				return false, err
+			}
+		}
+		return true, nil
+	}
+	if sum != state.PendingChecksum {
+		if err := os.WriteFile(pendingPath(), content, 0600); err != nil {
+			return false, err
+		}
+		state.PendingChecksum, state.PendingSince = sum, time.Now()
+	}
+	report.PendingApproval = true
+	log.Printf("[WARN] change of %s is staged in %s since %s, waiting for approve command\n",
+		*filePath, pendingPath(), state.PendingSince.Format(time.RFC3339))
+	return false, nil
+}
+
+// runPending prints changes of the userlist staged for approval.
+func runPending(w io.Writer) error {
+	if err := loadState(); err != nil {
+		return err
+	}
+	if state.PendingChecksum == "" {
+		_, err := fmt.Fprintln(w, "no pending changes")
+		return err
+	}
+	current, err := readUserList(*filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	pending, err := readUserList(pendingPath())
+	if err != nil {
+		return err
+	}
+	added, removed, updated := userlist.Diff(current, pending)
+	fmt.Fprintf(w, "pending since %s, checksum %s\n", state.PendingSince.Format(time.RFC3339), state.PendingChecksum)
+	for _, change := range []struct {
+		sign  string
+		names []string
+	}{{"+", added}, {"-", removed}, {"~", updated}} {
+		for _, name := range change.names {
+			if _, err := fmt.Fprintf(w, "%s %s\n", change.sign, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// approve approves the staged change, which is applied by the next run if the generated
+// userlist is still the same, otherwise the new change is staged again.
+func approve() error {
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := loadState(); err != nil {
+		return err
+	}
+	if state.PendingChecksum == "" {
+		return errors.New("no pending changes")
+	}
+	staged, err := os.ReadFile(pendingPath())
+	if err != nil {
+		return err
+	}
+	if checksum(staged) != state.PendingChecksum {
+		return fmt.Errorf("%s doesn't match the staged checksum", pendingPath())
+	}
+	state.ApprovedChecksum = state.PendingChecksum
+	log.Printf("[INFO] change %s is approved\n", state.ApprovedChecksum)
+	return saveState()
+}
+
+// approveAndRun approves the staged change and applies it with a run.
+func approveAndRun(db *sql.DB, exclude []string) error {
+	cycleMu.Lock()
+	err := approve()
+	cycleMu.Unlock()
+	if err != nil {
+		return err
+	}
+	report := runCycle(db, exclude)
+	if report.PendingApproval {
+		return errors.New("userlist has changed since staging, the new change is staged")
+	}
+	return report.Err
+}
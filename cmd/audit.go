@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+const (
+	auditManifest = "manifest"
+	auditFull     = "full"
+)
+
+// commitAudit commits the changed userlist, or its names only manifest, to
+// the audit git repository if it is configured.
+func commitAudit(report *runReport, users map[string]string) error {
+	if *auditGitRepo == "" {
+		return nil
+	}
+	if err := injectedError(faultAudit); err != nil {
+		return err
+	}
+	var name string
+	var content []byte
+	switch *auditGitMode {
+	case auditManifest:
+		name = filepath.Base(*filePath) + ".manifest"
+		names := make([]string, 0, len(users))
+		for username := range users {
+			names = append(names, username)
+		}
+		sort.Strings(names)
+		content = []byte(strings.Join(names, "\n") + "\n")
+	case auditFull:
+		name = filepath.Base(*filePath)
+		content = userlist.Render(users)
+	default:
+		return fmt.Errorf("unknown audit git mode: %q", *auditGitMode)
+	}
+	if err := os.WriteFile(filepath.Join(*auditGitRepo, name), content, 0600); err != nil {
+		return err
+	}
+	if err := runGit("add", "--", name); err != nil {
+		return err
+	}
+	// password changes leave the manifest untouched, but are still recorded.
+	return runGit("commit", "--allow-empty", "-m", auditMessage(report), "--", name)
+}
+
+// auditMessage describes the change in a structured commit message.
+func auditMessage(report *runReport) string {
+	hostname, _ := os.Hostname()
+	var b strings.Builder
+	fmt.Fprintf(&b, "Update %s: +%d -%d ~%d\n\n",
+		filepath.Base(*filePath), len(report.Added), len(report.Removed), len(report.Updated))
+	fmt.Fprintf(&b, "Host: %s\n", hostname)
+	fmt.Fprintf(&b, "Path: %s\n", *filePath)
+	fmt.Fprintf(&b, "Time: %s\n", report.Start.UTC().Format("2006-01-02T15:04:05Z"))
+	fmt.Fprintf(&b, "Users: %d\n", report.Users)
+	fmt.Fprintf(&b, "Added: %s\n", strings.Join(report.Added, ","))
+	fmt.Fprintf(&b, "Removed: %s\n", strings.Join(report.Removed, ","))
+	fmt.Fprintf(&b, "Password-Changed: %s\n", strings.Join(report.Updated, ","))
+	return b.String()
+}
+
+// runGit runs git in the audit repository, committing as the generator itself.
+func runGit(args ...string) error {
+	hostname, _ := os.Hostname()
+	identity := "pgbouncer-userlist-generator"
+	email := identity + "@" + hostname
+	// nolint:gosec
+	cmd := exec.Command("git", append([]string{"-C", *auditGitRepo}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME="+identity, "GIT_AUTHOR_EMAIL="+email,
+		"GIT_COMMITTER_NAME="+identity, "GIT_COMMITTER_EMAIL="+email,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lib/pq"
+)
+
+// defaultAuthQuery is auth_query of pgbouncer when it isn't set.
+const defaultAuthQuery = "SELECT rolname, CASE WHEN rolvaliduntil < now() THEN NULL ELSE rolpassword END FROM pg_authid WHERE rolname=$1 AND rolcanlogin"
+
+// authLookupFunction is the security definer function auth_user calls in auth_query,
+// so auth_user needs no access to pg_authid.
+const authLookupFunction = "pgbouncer.user_lookup"
+
+// authLookupQuery is auth_query of pgbouncer calling authLookupFunction.
+const authLookupQuery = "SELECT uname, phash FROM " + authLookupFunction + "($1)"
+
+// staticUsers leaves in the userlist only -auth-user, or with -hybrid-auth auth_user, admin_users
+// and stats_users of -pgbouncer-ini, pgbouncer looks up the rest with auth_query.
+func (f *fetcher) staticUsers(users map[string]string) (map[string]string, error) {
+	auth, others, err := f.staticNames()
+	if err != nil {
+		return nil, err
+	}
+	password, ok := users[auth]
+	if !ok {
+		return nil, fmt.Errorf("auth user %q is not among generated users, it may have no password or be excluded", auth)
+	}
+	static := map[string]string{auth: password}
+	for _, username := range others {
+		if password, ok := users[username]; ok {
+			static[username] = password
+		} else if _, added := static[username]; !added {
+			f.warnings.warnSkipped("pgbouncer user %q is not among generated users", username)
+		}
+	}
+	return static, nil
+}
+
+// staticNames returns the auth user and other users kept in the userlist with auth_query.
+func (o *fetchOptions) staticNames() (string, []string, error) {
+	if !o.hybridAuth {
+		return o.authUser, nil, nil
+	}
+	ini, err := readPgbouncerIni(*pgbouncerIniPath)
+	if err != nil {
+		return "", nil, err
+	}
+	auth := o.authUser
+	if auth == "" {
+		auth = ini.get("pgbouncer", "auth_user")
+	}
+	if auth == "" {
+		return "", nil, fmt.Errorf("auth_user is set neither with -auth-user nor in %s", *pgbouncerIniPath)
+	}
+	others := append(splitNames(ini.get("pgbouncer", "admin_users")), splitNames(ini.get("pgbouncer", "stats_users"))...)
+	return auth, others, nil
+}
+
+// authQuerySQL returns sql creating authLookupFunction executable only by the auth user.
+func authQuerySQL(authUser string) string {
+	return `create schema if not exists pgbouncer;
+create or replace function ` + authLookupFunction + `(in i_username text, out uname text, out phash text)
+    returns record
+    language plpgsql
+    security definer
+    set search_path = pg_catalog
+as $$
+begin
+    select rolname, case when rolvaliduntil is null or rolvaliduntil > now() then rolpassword end
+    from pg_catalog.pg_authid
+    where rolname = i_username and rolcanlogin
+    into uname, phash;
+    return;
+end;
+$$;
+revoke all on function ` + authLookupFunction + `(text) from public;
+grant usage on schema pgbouncer to ` + pq.QuoteIdentifier(authUser) + `;
+grant execute on function ` + authLookupFunction + `(text) to ` + pq.QuoteIdentifier(authUser) + `;
+`
+}
+
+// runAuthQuerySQL prints sql of the lookup function with pgbouncer settings using it.
+func runAuthQuerySQL(w io.Writer) error {
+	if *authUser == "" {
+		return errors.New("-auth-user is required")
+	}
+	_, err := fmt.Fprintf(w, "-- run as a superuser in every database of pgbouncer, pgbouncer.ini:\n"+
+		"--   auth_user = %s\n--   auth_query = %s\n%s", *authUser, authLookupQuery, authQuerySQL(*authUser))
+	return err
+}
+
+// runInstallAuthQuery creates the lookup function in every database accepting connections,
+// each database within commandTimeout. Failed databases don't stop the others, the result
+// of every database is printed.
+func runInstallAuthQuery(ctx context.Context, db *sql.DB, w io.Writer) error {
+	if *authUser == "" {
+		return errors.New("-auth-user is required")
+	}
+	listCtx, cancel := context.WithTimeout(ctx, commandTimeout)
+	databases, err := listDatabases(listCtx, db)
+	cancel()
+	if err != nil {
+		return err
+	}
+	hosts, err := splitMultiHost(*connectionString)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, datname := range databases {
+		installCtx, cancel := context.WithTimeout(ctx, commandTimeout)
+		err := installAuthQuery(installCtx, hosts, datname)
+		cancel()
+		if err != nil {
+			failed = append(failed, datname)
+			fmt.Fprintf(w, "%s: failed: %s\n", datname, err)
+			continue
+		}
+		fmt.Fprintf(w, "%s: installed %s\n", datname, authLookupFunction)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d databases failed, run again to install into %s", len(failed), len(databases), strings.Join(failed, ", "))
+	}
+	fmt.Fprintf(w, "set in pgbouncer.ini:\nauth_user = %s\nauth_query = %s\n", *authUser, authLookupQuery)
+	return nil
+}
+
+// listDatabases returns names of databases accepting connections.
+func listDatabases(ctx context.Context, db *sql.DB) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `select datname from pg_catalog.pg_database where datallowconn and not datistemplate order by datname`)
+	if err != nil {
+		return nil, err
+	}
+	// nolint:errcheck
+	defer rows.Close()
+	var databases []string
+	for rows.Next() {
+		var datname string
+		if err := rows.Scan(&datname); err != nil {
+			return nil, err
+		}
+		databases = append(databases, datname)
+	}
+	return databases, rows.Err()
+}
+
+// installAuthQuery creates the lookup function in the database on the primary of the hosts.
+func installAuthQuery(ctx context.Context, hosts hostList, datname string) error {
+	dsns := make([]string, 0, len(hosts.dsns))
+	for _, dsn := range hosts.dsns {
+		if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+			var err error
+			if dsn, err = pq.ParseURL(dsn); err != nil {
+				return err
+			}
+		}
+		// the last dbname of the connection string wins.
+		dsns = append(dsns, dsn+" dbname="+quoteKV(datname))
+	}
+	db, err := openHosts(hostList{dsns: dsns, hostaddrs: hosts.hostaddrs, attrs: "primary"})
+	if err != nil {
+		return err
+	}
+	// nolint:errcheck
+	defer db.Close()
+	_, err = db.ExecContext(ctx, authQuerySQL(*authUser))
+	return err
+}
+
+// runCheckHybrid looks up a sample of database users with auth_query of -pgbouncer-ini as its
+// auth_user and reports users it doesn't resolve outside of the userlist, and users which are
+// in the userlist with other hashes than auth_query returns, so logins depend on the path taken.
+func runCheckHybrid(ctx context.Context, db *sql.DB, w io.Writer, exclude []string) error {
+	ini, err := readPgbouncerIni(*pgbouncerIniPath)
+	if err != nil {
+		return err
+	}
+	auth, _, err := runFetcher.staticNames()
+	if err != nil {
+		return err
+	}
+	if auth == "" {
+		auth = ini.get("pgbouncer", "auth_user")
+	}
+	if auth == "" {
+		return fmt.Errorf("auth_user is not set in %s", *pgbouncerIniPath)
+	}
+	authQuery := ini.get("pgbouncer", "auth_query")
+	if authQuery == "" {
+		authQuery = defaultAuthQuery
+	}
+	static, err := readUserList(*filePath)
+	if err != nil {
+		return err
+	}
+	users, err := runFetcher.fetchAll(ctx, db, exclude, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "auth_user %s, auth_query %s, %d users in %s\n", auth, authQuery, len(static), *filePath)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROLE\tPATH\tSTATUS\tDETAIL")
+	// users of the userlist are always checked for conflicts.
+	sample := sampleNames(users, *authQuerySample)
+	sampled := make(map[string]bool, len(sample))
+	for _, username := range sample {
+		sampled[username] = true
+	}
+	for _, username := range sampleNames(static, 0) {
+		if _, ok := users[username]; ok && !sampled[username] {
+			sample = append(sample, username)
+		}
+	}
+	failed := 0
+	for _, username := range sample {
+		path := "auth_query"
+		if _, ok := static[username]; ok {
+			path = "userlist"
+		}
+		status, detail := "ok", ""
+		password, err := lookupAuthQuery(ctx, db, auth, authQuery, username)
+		switch {
+		case path == "userlist" && err == nil && password.Valid && password.String != static[username]:
+			status, detail = "conflict", "auth_query returns a different hash than the userlist"
+		case path == "userlist":
+		case errors.Is(err, sql.ErrNoRows):
+			status, detail = "unresolved", "auth_query returns no rows"
+		case err != nil:
+			status, detail = "unresolved", err.Error()
+		case !password.Valid:
+			status, detail = "unresolved", "auth_query returns null password, the password may be expired"
+		case password.String != users[username]:
+			status, detail = "mismatch", "auth_query returns a different password than the database"
+		}
+		if status != "ok" {
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", username, path, status, detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d user(s) would fail or depend on the path of the lookup", failed)
+	}
+	return nil
+}
+
+// sampleNames returns up to n names spread evenly over the sorted names.
+func sampleNames(users map[string]string, n int) []string {
+	names := make([]string, 0, len(users))
+	for username := range users {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+	if n <= 0 || n >= len(names) {
+		return names
+	}
+	sample := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		sample = append(sample, names[i*len(names)/n])
+	}
+	return sample
+}
+
+// lookupAuthQuery runs auth_query for the user the way pgbouncer does, with privileges of auth_user.
+func lookupAuthQuery(ctx context.Context, db *sql.DB, authUser, authQuery, username string) (sql.NullString, error) {
+	var password sql.NullString
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return password, err
+	}
+	// nolint:errcheck
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "set local role "+pq.QuoteIdentifier(authUser)); err != nil {
+		return password, fmt.Errorf("set role %s: %w", authUser, err)
+	}
+	var name sql.NullString
+	err = tx.QueryRowContext(ctx, authQuery, username).Scan(&name, &password)
+	return password, err
+}
+
+// runCheckAuthQuery executes auth_query of -pgbouncer-ini as its auth_user for a sample
+// of generated users and reports lookups which would fail logins through pgbouncer.
+func runCheckAuthQuery(ctx context.Context, db *sql.DB, w io.Writer, exclude []string) error {
+	ini, err := readPgbouncerIni(*pgbouncerIniPath)
+	if err != nil {
+		return err
+	}
+	authUser := ini.get("pgbouncer", "auth_user")
+	if authUser == "" {
+		return fmt.Errorf("auth_user is not set in %s", *pgbouncerIniPath)
+	}
+	authQuery := ini.get("pgbouncer", "auth_query")
+	if authQuery == "" {
+		authQuery = defaultAuthQuery
+	}
+	users, err := fetchUserList(ctx, db, exclude, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "auth_user %s, auth_query %s\n", authUser, authQuery)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROLE\tSTATUS\tDETAIL")
+	failed := 0
+	sample := sampleNames(users, *authQuerySample)
+	for _, username := range sample {
+		status, detail := "ok", ""
+		password, err := lookupAuthQuery(ctx, db, authUser, authQuery, username)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			status, detail = "missing", "auth_query returns no rows"
+		case err != nil:
+			status, detail = "failed", err.Error()
+		case !password.Valid:
+			status, detail = "no-password", "auth_query returns null password, the password may be expired"
+		case password.String != users[username]:
+			status, detail = "mismatch", "auth_query returns a different password than the userlist"
+		}
+		if status != "ok" {
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", username, status, detail)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d lookup(s) would fail", failed, len(sample))
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// backupNote is the sidecar json of a backup telling what replaced it, without password hashes.
+type backupNote struct {
+	Timestamp   time.Time         `json:"timestamp"`
+	RunID       string            `json:"run_id"`
+	Path        string            `json:"path"`
+	Cluster     string            `json:"cluster,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	UsersBefore int               `json:"users_before"`
+	UsersAfter  int               `json:"users_after"`
+	Added       []string          `json:"added,omitempty"`
+	Removed     []string          `json:"removed,omitempty"`
+	Updated     []string          `json:"updated,omitempty"`
+}
+
+// newRunID returns random id of the run.
+func newRunID() string {
+	id := make([]byte, 8)
+	// nolint:errcheck,gosec
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// annotateBackup renders the sidecar of the backup made when users replace previous.
+func annotateBackup(report *runReport, previous, users map[string]string) []byte {
+	note := backupNote{
+		Timestamp: time.Now().UTC(), RunID: report.RunID, Path: *filePath, Cluster: *cluster, Labels: runLabels,
+		UsersBefore: len(previous), UsersAfter: len(users),
+	}
+	note.Added, note.Removed, note.Updated = userlist.Diff(previous, users)
+	data, err := json.MarshalIndent(note, "", "  ")
+	if err != nil {
+		return nil
+	}
+	return append(data, '\n')
+}
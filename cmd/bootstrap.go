@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+const (
+	bootstrapAlways    = "always"
+	bootstrapNever     = "never"
+	bootstrapIfRunning = "if-running"
+)
+
+func validateBootstrapReload() error {
+	switch *bootstrapReload {
+	case bootstrapAlways, bootstrapNever, bootstrapIfRunning:
+		return nil
+	}
+	return fmt.Errorf("unknown -bootstrap-reload %q, expected %s, %s or %s", *bootstrapReload, bootstrapAlways, bootstrapNever, bootstrapIfRunning)
+}
+
+// prepareBootstrap creates directories of the userlist, the trigger file and the state file
+// before the first run on the host writes them.
+func prepareBootstrap() error {
+	dirs := []string{filepath.Dir(*filePath), filepath.Dir(*reloadTriggerFile)}
+	if *stateFile != "" {
+		dirs = append(dirs, filepath.Dir(*stateFile))
+	}
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipBootstrapReload cancels the reload triggered by the first write of the userlist
+// by -bootstrap-reload, pgbouncer started after it reads the userlist anyway.
+func skipBootstrapReload() error {
+	switch *bootstrapReload {
+	case bootstrapNever:
+		log.Printf("[INFO] %s is created, skipping reload by -bootstrap-reload=%s\n", *filePath, *bootstrapReload)
+	case bootstrapIfRunning:
+		if pgbouncerRunning() {
+			return nil
+		}
+		log.Printf("[INFO] %s is created and pgbouncer is not running, skipping reload\n", *filePath)
+	default:
+		return nil
+	}
+	if err := os.Remove(*reloadTriggerFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// pgbouncerRunning tells whether admin consoles of -reload-admin answer, the process of -reload-pidfile
+// or -reload-process exists, or whether -pgbouncer-unit is active. Without systemctl pgbouncer is assumed to be running.
+func pgbouncerRunning() bool {
+	if *reloadAdmin != "" {
+		return peerAdminRunner{dsn: *reloadAdmin, ports: splitNames(*reloadAdminPorts)}.Run("SHOW VERSION", *reloadTimeout, nil) == nil
+	}
+	if *reloadPidfile != "" || *reloadProcess != "" {
+		_, err := signalRunner{pidfile: *reloadPidfile, process: *reloadProcess}.pids()
+		return err == nil
+	}
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return true
+	}
+	// nolint:gosec
+	return exec.Command("systemctl", "is-active", "--quiet", *pgbouncerUnit).Run() == nil
+}
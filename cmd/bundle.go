@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// bundleLogLines is the number of recent journal lines collected per unit.
+const bundleLogLines = "500"
+
+// generatorUnit is the systemd unit the generator usually runs as.
+const generatorUnit = "pgbouncer-userlist-generator"
+
+// bundleEntry is a file of the support bundle, collection errors are written into it.
+type bundleEntry struct {
+	name    string
+	collect func() ([]byte, error)
+}
+
+// runSupportBundle writes tar.gz with redacted diagnostics to path, or to a timestamped
+// file in the current directory, and prints its path.
+func runSupportBundle(w io.Writer, args []string) error {
+	path := fmt.Sprintf("pgbouncer-userlist-generator-support-%s.tar.gz", time.Now().UTC().Format("20060102T150405Z"))
+	if len(args) > 0 {
+		path = args[0]
+	}
+	entries := []bundleEntry{
+		{"config.txt", func() ([]byte, error) {
+			var b bytes.Buffer
+			err := runConfig(&b, []string{"show-effective"})
+			return b.Bytes(), err
+		}},
+		{"state.json", func() ([]byte, error) {
+			if *stateFile == "" {
+				return []byte("-state-file is not set\n"), nil
+			}
+			return os.ReadFile(filepath.Clean(*stateFile))
+		}},
+		{"status.txt", func() ([]byte, error) {
+			if *controlSocket == "" {
+				return []byte("-control-socket is not set\n"), nil
+			}
+			var b bytes.Buffer
+			err := runCtl(&b, []string{"status"})
+			return b.Bytes(), err
+		}},
+		{"files.txt", bundleFiles},
+		{"pgbouncer-unit.txt", func() ([]byte, error) {
+			return bundleCommand("systemctl", "status", "--no-pager", *pgbouncerUnit)
+		}},
+		{"logs/" + *pgbouncerUnit + ".log", func() ([]byte, error) {
+			return bundleCommand("journalctl", "--no-pager", "-n", bundleLogLines, "-u", *pgbouncerUnit)
+		}},
+		{"logs/" + generatorUnit + ".log", func() ([]byte, error) {
+			return bundleCommand("journalctl", "--no-pager", "-n", bundleLogLines, "-u", generatorUnit)
+		}},
+	}
+	fd, err := os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	// nolint:errcheck,gosec
+	defer fd.Close()
+	gz := gzip.NewWriter(fd)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	for _, entry := range entries {
+		data, errCollect := entry.collect()
+		if errCollect != nil {
+			data = append(data, []byte(fmt.Sprintf("\nerror: %s\n", errCollect))...)
+		}
+		data = []byte(redactDSN(string(data)))
+		hdr := &tar.Header{Name: entry.name, Mode: 0600, Size: int64(len(data)), ModTime: now}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, path)
+	return err
+}
+
+// bundleFiles lists permissions, ownership and age of managed files and their directories,
+// never their content.
+func bundleFiles() ([]byte, error) {
+	paths := []string{filepath.Dir(*filePath), *filePath, pendingPath(), *reloadTriggerFile, *pgbouncerIniPath}
+	backups, _ := filepath.Glob(*filePath + ".backup-*")
+	paths = append(paths, backups...)
+	targets, _ := extraTargets(nil, nil)
+	for _, t := range targets {
+		paths = append(paths, t.path)
+	}
+	var b bytes.Buffer
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			fmt.Fprintf(&b, "%s: %s\n", path, err)
+			continue
+		}
+		owner := "unknown owner"
+		if uid, ok := fileOwner(info); ok {
+			owner = fmt.Sprintf("uid %d", uid)
+		}
+		fmt.Fprintf(&b, "%s: %s %s size %d modified %s\n", path, info.Mode(), owner, info.Size(), info.ModTime().Format(time.RFC3339))
+	}
+	return b.Bytes(), nil
+}
+
+func bundleCommand(name string, args ...string) ([]byte, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return nil, err
+	}
+	// nolint:gosec
+	return exec.Command(name, args...).CombinedOutput()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// cacheCipher returns AES-256-GCM keyed with sha256 of -cache-key-file content.
+func cacheCipher() (cipher.AEAD, error) {
+	if *cacheKeyFile == "" {
+		return nil, errors.New("-cache-key-file is required with -cache-file")
+	}
+	secret, err := os.ReadFile(*cacheKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(strings.TrimSpace(string(secret))) == 0 {
+		return nil, fmt.Errorf("%s is empty", *cacheKeyFile)
+	}
+	key := sha256.Sum256([]byte(strings.TrimSpace(string(secret))))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// saveCache encrypts the applied users to -cache-file.
+func saveCache(users map[string]string) error {
+	aead, err := cacheCipher()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(users)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	tmp := *cacheFile + ".tmp"
+	if err := os.WriteFile(tmp, aead.Seal(nonce, nonce, data, nil), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *cacheFile)
+}
+
+// loadCache decrypts users of -cache-file.
+func loadCache() (map[string]string, error) {
+	aead, err := cacheCipher()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := os.ReadFile(*cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("%s is truncated", *cacheFile)
+	}
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt %s: %w", *cacheFile, err)
+	}
+	var users map[string]string
+	return users, json.Unmarshal(data, &users)
+}
+
+// restoreFromCache writes the userlist of the last successful run from -cache-file
+// when users can't be fetched, so pgbouncer doesn't keep whatever file survived.
+// The userlist is left as is when it already has the users of the cache.
+func restoreFromCache(report *runReport) {
+	users, err := loadCache()
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] load cache: %s\n", err)
+		return
+	}
+	content := userlist.Render(users)
+	// the snapshot header of the last run doesn't make the userlist differ from the cache.
+	if current, err := os.ReadFile(*filePath); err == nil && bytes.Equal(withoutSnapshot(current), content) {
+		return
+	}
+	changed, err := writeUserList(*filePath, *reloadTriggerFile, content, report.Phases)
+	if err != nil {
+		log.Printf("[ERROR] restore userlist from cache: %s\n", err)
+		return
+	}
+	if changed {
+		log.Printf("[WARN] userlist restored from %s with %d users\n", *cacheFile, len(users))
+	}
+	command, reloader := pgbouncerReload(*reloadCommand)
+	if err := processTriggerFile(*reloadTriggerFile, *filePath, command, reloader, report); err != nil {
+		log.Printf("[ERROR] process trigger file: %s\n", err)
+	}
+}
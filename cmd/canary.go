@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	errClassCanary = "canary"
+
+	// exitCodeCanary is the exit code of a run whose userlist broke the canary login.
+	exitCodeCanary = 3
+
+	// canaryRetryDelay is the delay between login attempts while pgbouncer applies the reload.
+	canaryRetryDelay = time.Second
+)
+
+// checkCanary logs in through pgbouncer with -canary-connection until it succeeds
+// or -canary-timeout passes, pgbouncer applies the reload asynchronously.
+func checkCanary(ctx context.Context) error {
+	connector, err := pq.NewConnector(*canaryConnection)
+	if err != nil {
+		return err
+	}
+	db := sql.OpenDB(connector)
+	// nolint:errcheck
+	defer db.Close()
+	db.SetMaxIdleConns(0)
+	ctx, cancel := context.WithTimeout(ctx, *canaryTimeout)
+	defer cancel()
+	for {
+		var one int
+		errLogin := db.QueryRowContext(ctx, `select 1`).Scan(&one)
+		if errLogin == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("canary login: %w", errLogin)
+		case <-time.After(canaryRetryDelay):
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const errClassCircuit = "circuit"
+
+var errCircuitOpen = errors.New("circuit is open")
+
+// circuitOpen reports whether runs are suspended after -circuit-failures consecutive failures.
+func (s *runState) circuitOpen(now time.Time) bool {
+	return now.Before(s.CircuitOpenUntil)
+}
+
+// record updates the state with the outcome of the run and reports whether the circuit has opened.
+// Every failure after the backoff (half-open circuit) doubles the backoff up to -circuit-max-backoff.
+func (s *runState) record(report *runReport, now time.Time) bool {
+	if report.Err == nil {
+		if s.CircuitBackoff > 0 {
+			log.Printf("[INFO] circuit closed after %d consecutive failures\n", s.ConsecutiveFailures)
+		}
+		s.ConsecutiveFailures, s.LastSuccess = 0, now
+		s.CircuitOpenUntil, s.CircuitBackoff = time.Time{}, 0
+		return false
+	}
+	s.ConsecutiveFailures++
+	s.LastFailure = now
+	if *circuitFailures <= 0 || s.ConsecutiveFailures < *circuitFailures {
+		return false
+	}
+	switch {
+	case s.CircuitBackoff == 0:
+		s.CircuitBackoff = *circuitBackoff
+	case s.CircuitBackoff*2 > *circuitMaxBackoff:
+		s.CircuitBackoff = *circuitMaxBackoff
+	default:
+		s.CircuitBackoff *= 2
+	}
+	s.CircuitOpenUntil = now.Add(s.CircuitBackoff)
+	log.Printf("[ERROR] circuit opened after %d consecutive failures, next attempt at %s\n",
+		s.ConsecutiveFailures, s.CircuitOpenUntil.Format(time.RFC3339))
+	return true
+}
+
+// cycleMu serializes cycles and changes of the state by the control socket.
+var cycleMu sync.Mutex
+
+// runCycle runs the generator unless the circuit is open, records the outcome in the state
+// and publishes it. The failure command is invoked once -alert-after consecutive runs have failed,
+// and while the circuit is open only when it opens.
+func runCycle(db *sql.DB, exclude []string) *runReport {
+	cycleWaiting()
+	cycleMu.Lock()
+	defer cycleMu.Unlock()
+	defer cycleStarted()()
+	refreshResolved()
+	report := runCycleLocked(db, exclude)
+	rememberStatus(report)
+	return report
+}
+
+func runCycleLocked(db *sql.DB, exclude []string) *runReport {
+	// the state file may be changed by pause and resume commands, which wait for the cycle.
+	unlock, err := lockState()
+	if err != nil {
+		log.Printf("[WARN] lock state: %s\n", err)
+	} else {
+		defer unlock()
+	}
+	if err := loadState(); err != nil {
+		log.Printf("[WARN] load state: %s\n", err)
+	}
+	if state.Paused {
+		log.Printf("[INFO] %s, skipping run\n", pauseStatus())
+		report := &runReport{Start: time.Now(), Paused: true, ConsecutiveFailures: state.ConsecutiveFailures, LastSuccess: state.LastSuccess}
+		if err := markPaused(true); err != nil {
+			log.Printf("[ERROR] mark paused: %s\n", err)
+		}
+		publishReport(report, false)
+		return report
+	}
+	if err := markPaused(false); err != nil {
+		log.Printf("[ERROR] mark paused: %s\n", err)
+	}
+	if now := time.Now(); state.circuitOpen(now) {
+		report := &runReport{Start: now, CircuitOpen: true, ConsecutiveFailures: state.ConsecutiveFailures, LastSuccess: state.LastSuccess}
+		report.fail(errClassCircuit, fmt.Errorf("%w after %d consecutive failures, skipping run until %s",
+			errCircuitOpen, state.ConsecutiveFailures, state.CircuitOpenUntil.Format(time.RFC3339)))
+		publishReport(report, false)
+		return report
+	}
+	runDB, errRecovery := recoveryHandle(db)
+	if errRecovery == nil && runDB == nil {
+		report := &runReport{Start: time.Now(), Paused: true, ConsecutiveFailures: state.ConsecutiveFailures, LastSuccess: state.LastSuccess}
+		publishReport(report, false)
+		return report
+	}
+	report := &runReport{Start: time.Now()}
+	if errRecovery != nil {
+		report.fail(errClassGenerate, fmt.Errorf("find primary: %w", errRecovery))
+	} else {
+		report = runWithRetries(runDB, exclude)
+	}
+	opened := state.record(report, time.Now())
+	report.CircuitOpen = state.circuitOpen(time.Now())
+	report.ConsecutiveFailures, report.LastSuccess = state.ConsecutiveFailures, state.LastSuccess
+	if err := saveState(); err != nil {
+		log.Printf("[ERROR] save state: %s\n", err)
+	}
+	if report.CircuitOpen {
+		if err := markDegraded(); err != nil {
+			log.Printf("[ERROR] mark degraded: %s\n", err)
+		}
+	}
+	streak := report.ConsecutiveFailures >= *alertAfter
+	publishReport(report, report.Err != nil && streak && (!report.CircuitOpen || opened))
+	return report
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// citusWorkers returns active primary workers of the citus coordinator as fleet hosts
+// with pgbouncer co-located, using -path and -reload-command on every worker.
+func citusWorkers(ctx context.Context, db *sql.DB) ([]fleetHost, error) {
+	rows, errRows := db.QueryContext(ctx, `
+select nodename, nodeport
+from pg_dist_node
+where isactive and noderole = 'primary' and groupid <> 0
+order by nodename, nodeport
+`)
+	if errRows != nil {
+		return nil, fmt.Errorf("discover citus workers: %w", errRows)
+	}
+	// nolint:errcheck
+	defer rows.Close()
+	var hosts []fleetHost
+	seen := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		var port int
+		if err := rows.Scan(&name, &port); err != nil {
+			return nil, err
+		}
+		// workers sharing the host share its pgbouncer.
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		hosts = append(hosts, fleetHost{
+			Name:          net.JoinHostPort(name, strconv.Itoa(port)),
+			Address:       name,
+			User:          *citusSSHUser,
+			Path:          *filePath,
+			ReloadCommand: *reloadCommand,
+		})
+	}
+	return hosts, rows.Err()
+}
+
+// runCitus generates the userlist from the coordinator and distributes it to pgbouncers of every worker.
+func runCitus(ctx context.Context, db *sql.DB, exclude []string) error {
+	workersCtx, cancel := context.WithTimeout(ctx, commandTimeout)
+	hosts, err := citusWorkers(workersCtx, db)
+	cancel()
+	if err != nil {
+		return err
+	}
+	if len(hosts) == 0 {
+		return fmt.Errorf("no active workers in pg_dist_node, is -connection pointing to the coordinator?")
+	}
+	return distribute(ctx, db, exclude, hosts)
+}
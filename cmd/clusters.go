@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github/vadv/pgbouncer-userlist-generator/catalog"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	mergeFirstWins = "first-wins"
+	mergeFail      = "fail"
+	// mergePrefer is the prefix of prefer:<cluster> policy.
+	mergePrefer = "prefer:"
+)
+
+// sourceCluster is a cluster whose users are merged into the userlist of -connection.
+type sourceCluster struct {
+	Name       string `yaml:"name"`
+	Connection string `yaml:"connection"`
+}
+
+// mainClusterName is the name of the -connection cluster in conflicts, -cluster if it is set.
+func mainClusterName() string {
+	if *cluster != "" {
+		return *cluster
+	}
+	return "main"
+}
+
+// checkMergeConflict checks the policy, the preferred cluster must be the -connection
+// cluster or one of the clusters file.
+func checkMergeConflict(policy, clustersFile string) error {
+	switch {
+	case policy == mergeFirstWins, policy == mergeFail:
+		return nil
+	case strings.HasPrefix(policy, mergePrefer) && len(policy) > len(mergePrefer):
+		preferred := strings.TrimPrefix(policy, mergePrefer)
+		if preferred == mainClusterName() {
+			return nil
+		}
+		if clustersFile == "" {
+			return fmt.Errorf("-merge-conflict %q: cluster %q is not %s and -clusters-file is not set", policy, preferred, mainClusterName())
+		}
+		clusters, err := readClusters(clustersFile)
+		if err != nil {
+			return err
+		}
+		for _, c := range clusters {
+			if c.Name == preferred {
+				return nil
+			}
+		}
+		return fmt.Errorf("-merge-conflict %q: cluster %q is neither %s nor in %s", policy, preferred, mainClusterName(), clustersFile)
+	}
+	return fmt.Errorf("unknown -merge-conflict %q, expected %s, %s or %s<cluster>", policy, mergeFirstWins, mergeFail, mergePrefer)
+}
+
+// readClusters loads YAML list of clusters, e.g. [{name: billing, connection: "host=billing-db dbname=postgres"}].
+func readClusters(file string) ([]sourceCluster, error) {
+	// nolint:gosec
+	data, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	var clusters []sourceCluster
+	if err := yaml.Unmarshal(data, &clusters); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	names := map[string]bool{mainClusterName(): true}
+	for i, c := range clusters {
+		if c.Name == "" || c.Connection == "" {
+			return nil, fmt.Errorf("%s: cluster %d: name and connection are required", file, i+1)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("%s: duplicate cluster %q", file, c.Name)
+		}
+		names[c.Name] = true
+	}
+	return clusters, nil
+}
+
+// clusterUsers reads users of the cluster with the same query and filters as -connection.
+func (f *fetcher) clusterUsers(ctx context.Context, c sourceCluster, exclude []string) (map[string]string, error) {
+	db, ok := f.clusterDBs[c.Name]
+	if !ok {
+		var err error
+		if db, err = openDB(c.Connection); err != nil {
+			return nil, err
+		}
+		f.clusterDBs[c.Name] = db
+	}
+	source := &catalog.Source{DB: db, Query: catalog.UsersQuery + f.roleConditions("id"), Exclude: exclude}
+	return source.Users(ctx)
+}
+
+// mergeClusters merges users of -clusters-file clusters into users of -connection,
+// roles with different secrets in several clusters are resolved by -merge-conflict.
+func (f *fetcher) mergeClusters(ctx context.Context, users map[string]string, exclude []string) (map[string]string, error) {
+	if f.clustersFile == "" || *simulateRoles > 0 {
+		return users, nil
+	}
+	clusters, err := readClusters(f.clustersFile)
+	if err != nil {
+		return nil, err
+	}
+	var preferred string
+	if strings.HasPrefix(f.mergeConflict, mergePrefer) {
+		preferred = strings.TrimPrefix(f.mergeConflict, mergePrefer)
+	}
+	// origin is the cluster where the role is found first.
+	origin := make(map[string]string, len(users))
+	for username := range users {
+		origin[username] = mainClusterName()
+	}
+	conflicts := make(map[string][]string)
+	for _, c := range clusters {
+		found, err := f.clusterUsers(ctx, c, exclude)
+		if err != nil {
+			return nil, fmt.Errorf("cluster %s: %w", c.Name, err)
+		}
+		for username, password := range found {
+			current, ok := users[username]
+			switch {
+			case !ok:
+				users[username], origin[username] = password, c.Name
+			case current == password:
+			default:
+				if conflicts[username] == nil {
+					conflicts[username] = []string{origin[username]}
+				}
+				conflicts[username] = append(conflicts[username], c.Name)
+				if c.Name == preferred {
+					users[username] = password
+				}
+			}
+		}
+	}
+	if len(conflicts) == 0 {
+		return users, nil
+	}
+	names := make([]string, 0, len(conflicts))
+	for username := range conflicts {
+		names = append(names, fmt.Sprintf("%s (%s)", username, strings.Join(conflicts[username], ",")))
+	}
+	sort.Strings(names)
+	if f.mergeConflict == mergeFail {
+		return nil, fmt.Errorf("%d roles have different secrets in several clusters: %s", len(names), strings.Join(names, ", "))
+	}
+	log.Printf("[WARN] %d roles have different secrets in several clusters, resolved by -merge-conflict=%s: %s\n",
+		len(names), f.mergeConflict, strings.Join(names, ", "))
+	return users, nil
+}
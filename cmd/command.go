@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// runner executes reload and hook commands.
+var runner = userlist.ShellRunner
+
+// runFailureCommand runs -on-failure-command with the error of the failed run in env vars.
+func runFailureCommand(report *runReport) error {
+	if *onFailureCommand == "" {
+		return nil
+	}
+	return runner.Run(*onFailureCommand, *onFailureTimeout, []string{
+		"PGBOUNCER_USERLIST_ERROR_CLASS=" + report.ErrClass,
+		"PGBOUNCER_USERLIST_ERROR=" + report.Err.Error(),
+		"PGBOUNCER_USERLIST_PATH=" + *filePath,
+		"PGBOUNCER_USERLIST_START=" + report.Start.UTC().Format(time.RFC3339),
+		"PGBOUNCER_USERLIST_CONSECUTIVE_FAILURES=" + strconv.Itoa(report.ConsecutiveFailures),
+		"PGBOUNCER_USERLIST_CIRCUIT_OPEN=" + strconv.FormatBool(report.CircuitOpen),
+		"PGBOUNCER_USERLIST_CLUSTER=" + *cluster,
+		"PGBOUNCER_USERLIST_LABELS=" + formatLabels(","),
+	})
+}
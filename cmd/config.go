@@ -0,0 +1,180 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	sourceDefault = "default"
+	sourceConfig  = "config"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+
+	envPrefix = "PGBOUNCER_USERLIST_"
+
+	// notificationsKey is the section of the config file with notifiers and routes of events.
+	notificationsKey = "notifications"
+)
+
+// configSources holds the source of the effective value of every flag.
+var configSources = make(map[string]string)
+
+// envName returns environment variable which overrides the flag.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// resolveConfig applies configuration layers to the parsed flags:
+// defaults < config file < environment < command line flags.
+func resolveConfig() error {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	configPath := *configFile
+	if !set["config"] {
+		if value, ok := os.LookupEnv(envName("config")); ok {
+			configPath = value
+		}
+	}
+	values := make(map[string]string)
+	if configPath != "" {
+		var err error
+		if values, err = readConfigFile(configPath); err != nil {
+			return err
+		}
+	}
+	var errSet error
+	flag.VisitAll(func(f *flag.Flag) {
+		if errSet != nil {
+			return
+		}
+		configSources[f.Name] = sourceDefault
+		if set[f.Name] {
+			configSources[f.Name] = sourceFlag
+			return
+		}
+		if value, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := f.Value.Set(value); err != nil {
+				errSet = fmt.Errorf("%s: %w", envName(f.Name), err)
+				return
+			}
+			configSources[f.Name] = sourceEnv
+			return
+		}
+		if value, ok := values[f.Name]; ok {
+			if err := f.Value.Set(value); err != nil {
+				errSet = fmt.Errorf("%s: %s: %w", configPath, f.Name, err)
+				return
+			}
+			configSources[f.Name] = sourceConfig + ":" + configPath
+		}
+	})
+	return errSet
+}
+
+// readConfigFile reads YAML, or TOML if the file has .toml extension,
+// config file with flag names as keys, lists are joined with commas.
+// The notifications section is left to readNotifications.
+func readConfigFile(path string) (map[string]string, error) {
+	// nolint:gosec
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]interface{})
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, &raw)
+	} else {
+		err = yaml.Unmarshal(data, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		if key == notificationsKey {
+			continue
+		}
+		if flag.Lookup(key) == nil || key == "config" {
+			return nil, fmt.Errorf("%s: unknown option %q", path, key)
+		}
+		switch v := value.(type) {
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[key] = strings.Join(items, ",")
+		case map[string]interface{}, []map[string]interface{}:
+			return nil, fmt.Errorf("%s: option %q must be a scalar or a list", path, key)
+		case nil:
+			values[key] = ""
+		default:
+			values[key] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// dsnFlags are connection strings with passwords redacted on output.
+var dsnFlags = map[string]bool{
+	"connection":         true,
+	"standby-connection": true,
+	"verify-connection":  true,
+	"pgcat-admin":        true,
+	"pgbouncer-admin":    true,
+	"canary-connection":  true,
+	"reload-admin":       true,
+}
+
+// runConfig implements config subcommands.
+func runConfig(w io.Writer, args []string) error {
+	if len(args) == 0 || args[0] != "show-effective" {
+		return fmt.Errorf("usage: config show-effective")
+	}
+	names := make([]string, 0, len(configSources))
+	for name := range configSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "OPTION\tVALUE\tSOURCE")
+	for _, name := range names {
+		value := flag.Lookup(name).Value.String()
+		if dsnFlags[name] {
+			value = redactDSN(value)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name, value, configSources[name])
+	}
+	return tw.Flush()
+}
+
+var dsnPasswordRe = regexp.MustCompile(`(?i)(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// redactDSN hides passwords in key=value and URL connection strings.
+func redactDSN(dsn string) string {
+	isURL := strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://")
+	if u, err := url.Parse(dsn); isURL && err == nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxx")
+		}
+		q := u.Query()
+		if q.Get("password") != "" {
+			q.Set("password", "xxxxx")
+			u.RawQuery = q.Encode()
+		}
+		return u.String()
+	}
+	return dsnPasswordRe.ReplaceAllString(dsn, "${1}xxxxx")
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// controlTimeout limits reading of a request and writing of a response, run is not limited.
+const controlTimeout = 10 * time.Second
+
+// lastStatus is the status of the last cycle reported by the status command,
+// so it doesn't wait for the running cycle.
+var lastStatus = struct {
+	sync.Mutex
+	text   string
+	report *runReport
+	// paused and pauseReason are the pause of the state after the cycle.
+	paused      bool
+	pauseReason string
+}{text: "no runs yet\n"}
+
+// rememberStatus renders the status after the cycle, the caller holds cycleMu.
+func rememberStatus(report *runReport) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "state: %s\n", pauseStatus())
+	if state.circuitOpen(time.Now()) {
+		fmt.Fprintf(&b, "circuit: open until %s\n", state.CircuitOpenUntil.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(&b, "circuit: closed\n")
+	}
+	fmt.Fprintf(&b, "consecutive failures: %d\n", state.ConsecutiveFailures)
+	if !state.LastSuccess.IsZero() {
+		fmt.Fprintf(&b, "last success: %s\n", state.LastSuccess.Format(time.RFC3339))
+	}
+	if report != nil {
+		result := "ok"
+		switch {
+		case report.Paused:
+			result = "skipped"
+		case report.PendingApproval:
+			result = "staged, waiting for approval"
+		case report.Frozen:
+			result = fmt.Sprintf("frozen with %d pending change(s)", len(report.Added)+len(report.Removed)+len(report.Updated))
+		case report.Err != nil:
+			result = "error: " + report.Err.Error()
+		}
+		fmt.Fprintf(&b, "last run: %s %s\n", report.Start.Format(time.RFC3339), result)
+		fmt.Fprintf(&b, "users: %d\n", report.Users)
+	}
+	lastStatus.Lock()
+	lastStatus.text, lastStatus.report = b.String(), report
+	lastStatus.paused, lastStatus.pauseReason = state.Paused, state.PauseReason
+	lastStatus.Unlock()
+}
+
+// serveControl listens on -control-socket for status, run, pause and resume commands
+// of the ctl command, the socket is accessible by the owner only.
+func serveControl(db *sql.DB, exclude []string) (io.Closer, error) {
+	if err := os.Remove(*controlSocket); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", *controlSocket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(*controlSocket, 0600); err != nil {
+		// nolint:errcheck,gosec
+		listener.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, errAccept := listener.Accept()
+			if errAccept != nil {
+				return
+			}
+			go handleControl(conn, db, exclude)
+		}
+	}()
+	log.Printf("[INFO] control socket is listening on %s\n", *controlSocket)
+	return listener, nil
+}
+
+func handleControl(conn net.Conn, db *sql.DB, exclude []string) {
+	// nolint:errcheck,gosec
+	defer conn.Close()
+	// nolint:errcheck,gosec
+	conn.SetReadDeadline(time.Now().Add(controlTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(line)
+	response := "error: empty command\n"
+	if len(fields) > 0 {
+		response = controlCommand(fields[0], fields[1:], db, exclude)
+	}
+	// nolint:errcheck,gosec
+	conn.SetWriteDeadline(time.Now().Add(controlTimeout))
+	if _, err := io.WriteString(conn, response); err != nil {
+		log.Printf("[WARN] control socket: %s\n", err)
+	}
+}
+
+func controlCommand(command string, args []string, db *sql.DB, exclude []string) string {
+	switch command {
+	case "status":
+		lastStatus.Lock()
+		defer lastStatus.Unlock()
+		return lastStatus.text
+	case "run":
+		log.Printf("[INFO] run requested by control socket\n")
+		report := runCycle(db, exclude)
+		if report.Err != nil {
+			return "error: " + report.Err.Error() + "\n"
+		}
+		lastStatus.Lock()
+		defer lastStatus.Unlock()
+		return lastStatus.text
+	case "approve":
+		log.Printf("[INFO] approve requested by control socket\n")
+		if err := approveAndRun(db, exclude); err != nil {
+			return "error: " + err.Error() + "\n"
+		}
+		lastStatus.Lock()
+		defer lastStatus.Unlock()
+		return lastStatus.text
+	case "pause", "resume", "freeze", "unfreeze":
+		cycleMu.Lock()
+		defer cycleMu.Unlock()
+		if err := setStateCommand(command, strings.Join(args, " ")); err != nil {
+			return "error: " + err.Error() + "\n"
+		}
+		log.Printf("[INFO] %s requested by control socket, %s\n", command, pauseStatus())
+		lastStatus.Lock()
+		report := lastStatus.report
+		lastStatus.Unlock()
+		rememberStatus(report)
+		return pauseStatus() + "\n"
+	default:
+		return fmt.Sprintf("error: unknown command %q, expected status, run, approve, pause, resume, freeze or unfreeze\n", command)
+	}
+}
+
+// runCtl sends the command to the control socket of the running process and prints the response.
+func runCtl(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: ctl status|run|approve|pause [reason]|resume|freeze [reason]|unfreeze")
+	}
+	if *controlSocket == "" {
+		return errors.New("-control-socket is required")
+	}
+	conn, err := net.Dial("unix", *controlSocket)
+	if err != nil {
+		return err
+	}
+	// nolint:errcheck,gosec
+	defer conn.Close()
+	if _, err := io.WriteString(conn, strings.Join(args, " ")+"\n"); err != nil {
+		return err
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(string(response), "error: ") {
+		return errors.New(strings.TrimSpace(strings.TrimPrefix(string(response), "error: ")))
+	}
+	_, err = w.Write(response)
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runDaemon regenerates the userlist every -interval until ctx is done,
+// sharing the database handle between runs.
+func runDaemon(ctx context.Context, db *sql.DB, exclude []string) {
+	if *maxInterval > *interval {
+		log.Printf("[INFO] running every %s to %s depending on changes\n", *interval, *maxInterval)
+	} else {
+		log.Printf("[INFO] running every %s\n", *interval)
+	}
+	next := *interval
+	timer := time.NewTimer(next)
+	defer timer.Stop()
+	tickScheduled(time.Now(), next)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			report := runCycle(db, exclude)
+			if adapted := adaptInterval(next, report); adapted != next {
+				log.Printf("[DEBUG] interval changed from %s to %s\n", next, adapted)
+				next = adapted
+			}
+			timer.Reset(next)
+			tickScheduled(time.Now(), next)
+		}
+	}
+}
+
+// adaptInterval returns the interval after the run with -max-interval: it is back to -interval
+// after changes and doubles up to -max-interval after runs without them, so quiet clusters are queried less.
+func adaptInterval(current time.Duration, report *runReport) time.Duration {
+	switch {
+	case *maxInterval <= *interval:
+		return *interval
+	case report.Changed:
+		return *interval
+	case report.Err != nil || report.Paused:
+		return current
+	case 2*current > *maxInterval:
+		return *maxInterval
+	default:
+		return 2 * current
+	}
+}
+
+// serve keeps running after the first run with -daemon, -restore-on-tamper or -listen-channel
+// until SIGINT or SIGTERM, the run in progress is finished before exit. SIGQUIT dumps the state.
+func serve(db *sql.DB, exclude []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go watchDumps(ctx)
+	if *controlSocket != "" {
+		control, err := serveControl(db, exclude)
+		if err != nil {
+			return err
+		}
+		// nolint:errcheck
+		defer control.Close()
+	}
+	if *healthListen != "" {
+		health, err := serveHealth(db)
+		if err != nil {
+			return err
+		}
+		// nolint:errcheck
+		defer health.Close()
+	}
+	errs := make(chan error, 3)
+	loops := 0
+	if *restoreOnTamper {
+		loops++
+		go func() { errs <- watchTamper(ctx, db, exclude) }()
+	}
+	if *listenChannel != "" {
+		loops++
+		go func() { errs <- watchNotify(ctx, db, exclude) }()
+	}
+	if *daemon {
+		loops++
+		go func() {
+			runDaemon(ctx, db, exclude)
+			errs <- ctx.Err()
+		}()
+	}
+	for ; loops > 0; loops-- {
+		if err := <-errs; err != context.Canceled {
+			return err
+		}
+	}
+	return nil
+}
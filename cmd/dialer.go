@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resolvingDialer resolves database host names on every connection attempt,
+// caching resolved addresses for at most ttl, so failovers which move a DNS
+// record are picked up without restarting the process. Pooled connections are
+// kept until refreshResolved finds their host resolving to other addresses.
+type resolvingDialer struct {
+	ttl      time.Duration
+	dialer   net.Dialer
+	resolver *net.Resolver
+
+	mu    sync.Mutex
+	cache map[string]resolvedHost
+}
+
+type resolvedHost struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newResolvingDialer(ttl time.Duration, dialer net.Dialer) *resolvingDialer {
+	return &resolvingDialer{
+		ttl:      ttl,
+		dialer:   dialer,
+		resolver: net.DefaultResolver,
+		cache:    make(map[string]resolvedHost),
+	}
+}
+
+// openDB opens database handle which re-resolves the host with the capped cache ttl.
+// Multi-host connection strings connect to the first host matching target_session_attrs.
+func openDB(dsn string) (*sql.DB, error) {
+	hosts, err := splitMultiHost(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return openHosts(hosts)
+}
+
+// openHosts opens database handle to the first of hosts matching target_session_attrs.
+func openHosts(hosts hostList) (*sql.DB, error) {
+	dialer := newResolvingDialer(*dnsTTL, net.Dialer{
+		Timeout:   *connectTimeout,
+		KeepAlive: *tcpKeepaliveInterval,
+		Control:   tcpControl(*tcpKeepaliveCount, *tcpUserTimeout),
+	})
+	connector, err := newMultiHostConnector(hosts, dialer)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	if *dnsTTL > 0 {
+		// pooled connections stick to the address they were opened with until it changes.
+		resolvedDBs.Lock()
+		resolvedDBs.handles = append(resolvedDBs.handles, resolvedDB{db: db, dialer: dialer})
+		resolvedDBs.Unlock()
+	} else {
+		db.SetMaxIdleConns(0)
+	}
+	return db, nil
+}
+
+const (
+	// defaultMaxIdleConns is the database/sql default of idle connections.
+	defaultMaxIdleConns = 2
+	// resolveTimeout limits resolving of hosts by refreshResolved.
+	resolveTimeout = 10 * time.Second
+)
+
+// resolvedDB is a database handle reusing connections of the dialer.
+type resolvedDB struct {
+	db     *sql.DB
+	dialer *resolvingDialer
+}
+
+// resolvedDBs are handles of -dns-ttl connections.
+var resolvedDBs struct {
+	sync.Mutex
+	handles []resolvedDB
+}
+
+// refreshResolved resolves again database host names cached for longer than -dns-ttl
+// and closes idle connections of handles whose hosts have moved to other addresses.
+func refreshResolved() {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	resolvedDBs.Lock()
+	handles := append([]resolvedDB(nil), resolvedDBs.handles...)
+	resolvedDBs.Unlock()
+	for _, h := range handles {
+		if moved := h.dialer.refresh(ctx); len(moved) > 0 {
+			log.Printf("[INFO] %s resolved to other addresses, reconnecting\n", strings.Join(moved, ", "))
+			h.db.SetMaxIdleConns(0)
+			h.db.SetMaxIdleConns(defaultMaxIdleConns)
+		}
+	}
+}
+
+// refresh resolves again expired cached hosts and returns hosts whose addresses have changed.
+func (d *resolvingDialer) refresh(ctx context.Context) []string {
+	now := time.Now()
+	d.mu.Lock()
+	expired := make(map[string][]string)
+	for host, cached := range d.cache {
+		if !now.Before(cached.expires) {
+			expired[host] = cached.addrs
+		}
+	}
+	d.mu.Unlock()
+	var moved []string
+	for host, previous := range expired {
+		addrs, err := d.resolve(ctx, host)
+		if err != nil {
+			log.Printf("[WARN] resolve %s: %s\n", host, err)
+			continue
+		}
+		if !sameAddrs(previous, addrs) {
+			moved = append(moved, host)
+		}
+	}
+	sort.Strings(moved)
+	return moved
+}
+
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]string(nil), a...), append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *resolvingDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *resolvingDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.DialContext(ctx, network, address)
+}
+
+func (d *resolvingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, errSplit := net.SplitHostPort(address)
+	if errSplit != nil || network == "unix" || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, address)
+	}
+	addrs, errResolve := d.resolve(ctx, host)
+	if errResolve != nil {
+		return nil, errResolve
+	}
+	var errDial error
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, errDial = d.dialer.DialContext(ctx, network, net.JoinHostPort(addr, port))
+		if errDial == nil {
+			return conn, nil
+		}
+	}
+	// the record may have moved, resolve again on the next attempt.
+	d.forget(host)
+	if errDial == nil {
+		errDial = errors.New("no addresses resolved for " + host)
+	}
+	return nil, errDial
+}
+
+func (d *resolvingDialer) resolve(ctx context.Context, host string) ([]string, error) {
+	d.mu.Lock()
+	cached, ok := d.cache[host]
+	d.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.addrs, nil
+	}
+	addrs, err := d.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if d.ttl > 0 {
+		d.mu.Lock()
+		d.cache[host] = resolvedHost{addrs: addrs, expires: time.Now().Add(d.ttl)}
+		d.mu.Unlock()
+	}
+	return addrs, nil
+}
+
+func (d *resolvingDialer) forget(host string) {
+	d.mu.Lock()
+	delete(d.cache, host)
+	d.mu.Unlock()
+}
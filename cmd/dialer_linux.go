@@ -0,0 +1,33 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// tcpUserTimeoutOpt is TCP_USER_TIMEOUT, which is missing in the syscall package.
+const tcpUserTimeoutOpt = 0x12
+
+// tcpControl returns dialer control function which tunes keepalive probes count and tcp user timeout.
+func tcpControl(keepaliveCount int, userTimeout time.Duration) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if network == "unix" {
+			return nil
+		}
+		var errOpt error
+		errControl := c.Control(func(fd uintptr) {
+			if keepaliveCount > 0 {
+				if errOpt = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, keepaliveCount); errOpt != nil {
+					return
+				}
+			}
+			if userTimeout > 0 {
+				errOpt = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpUserTimeoutOpt, int(userTimeout.Milliseconds()))
+			}
+		})
+		if errControl != nil {
+			return errControl
+		}
+		return errOpt
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// tcpControl is a no-op outside of linux, only keepalive interval is applied.
+func tcpControl(_ int, _ time.Duration) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
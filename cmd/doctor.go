@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// doctorMaxBackups is the number of backups after which they are reported as piling up.
+	doctorMaxBackups = 10
+	// doctorStaleTrigger is the age after which a left over trigger file means a failed reload.
+	doctorStaleTrigger = 10 * time.Minute
+)
+
+// runDoctor inspects pgbouncer configuration against the generator flags
+// and prints a health report.
+func runDoctor() error {
+	results := make([]preflightResult, 0)
+	ini, errIni := readPgbouncerIni(*pgbouncerIniPath)
+	if errIni != nil {
+		results = append(results, preflightResult{
+			name: "pgbouncer.ini", status: preflightFail, detail: errIni.Error(),
+			remediation: "point -pgbouncer-ini to the configuration used by the pgbouncer instance",
+		})
+	} else {
+		results = append(results,
+			preflightResult{name: "pgbouncer.ini", status: preflightOK, detail: *pgbouncerIniPath},
+			checkAuthFile(ini),
+			checkAuthType(ini),
+		)
+	}
+	results = append(results,
+		checkUnitState(*pgbouncerUnit),
+		checkBackups(*filePath),
+		checkStaleTrigger(*reloadTriggerFile),
+	)
+	return printReport(results)
+}
+
+func checkAuthFile(ini pgbouncerIni) preflightResult {
+	r := preflightResult{name: "auth_file matches -path", status: preflightOK}
+	authFile := ini.authFile(*pgbouncerIniPath)
+	if authFile == "" {
+		r.status, r.detail = preflightFail, "auth_file is not set"
+		r.remediation = fmt.Sprintf("set auth_file = %s in [pgbouncer]", *filePath)
+		return r
+	}
+	expected, errExpected := filepath.Abs(*filePath)
+	if errExpected != nil {
+		expected = *filePath
+	}
+	r.detail = authFile
+	if filepath.Clean(authFile) != filepath.Clean(expected) {
+		r.status = preflightFail
+		r.detail = fmt.Sprintf("pgbouncer reads %s, generator writes %s", authFile, expected)
+		r.remediation = fmt.Sprintf("run the generator with -path %s or change auth_file", authFile)
+	}
+	return r
+}
+
+func checkAuthType(ini pgbouncerIni) preflightResult {
+	authType := strings.ToLower(ini.get("pgbouncer", "auth_type"))
+	if authType == "" {
+		authType = passwordMD5
+	}
+	r := preflightResult{name: "auth_type is compatible with userlist", status: preflightOK, detail: authType}
+	users, err := readUserList(*filePath)
+	if err != nil {
+		r.status, r.detail = preflightWarn, err.Error()
+		r.remediation = "run the generator once to create the userlist"
+		return r
+	}
+	counts := make(map[string]int)
+	for _, password := range users {
+		counts[passwordType(password)]++
+	}
+	r.detail = fmt.Sprintf("auth_type=%s, %d md5, %d scram-sha-256, %d plain",
+		authType, counts[passwordMD5], counts[passwordSCRAM], counts[passwordPlain])
+	switch authType {
+	case passwordSCRAM:
+		if counts[passwordMD5] > 0 {
+			r.status = preflightFail
+			r.remediation = "md5 users can't log in with auth_type=scram-sha-256, re-set their passwords with password_encryption=scram-sha-256 or use auth_type=md5"
+		}
+	case "trust", "any", "cert", "pam":
+		r.status = preflightWarn
+		r.remediation = fmt.Sprintf("auth_type=%s doesn't check passwords from auth_file, the generator is probably not needed", authType)
+	}
+	return r
+}
+
+func checkUnitState(unit string) preflightResult {
+	r := preflightResult{name: "systemd unit " + unit, status: preflightOK}
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		r.detail = "systemctl is not available, skipped"
+		return r
+	}
+	// nolint:gosec
+	out, err := exec.Command("systemctl", "is-active", unit).Output()
+	r.detail = strings.TrimSpace(string(out))
+	if err != nil {
+		r.status = preflightFail
+		r.remediation = fmt.Sprintf("check the unit with: systemctl status %s", unit)
+	}
+	return r
+}
+
+func checkBackups(path string) preflightResult {
+	r := preflightResult{name: "userlist backups", status: preflightOK}
+	all, err := backups(path)
+	if err != nil {
+		r.status, r.detail = preflightWarn, err.Error()
+		return r
+	}
+	r.detail = fmt.Sprintf("%d backup(s)", len(all))
+	if len(all) > doctorMaxBackups {
+		r.status = preflightWarn
+		r.remediation = fmt.Sprintf("backups contain password hashes, remove old ones: ls -1t %s.backup-*[0-9] | tail -n +%d | while read -r f; do rm -f \"$f\" \"$f.json\"; done", path, doctorMaxBackups+1)
+	}
+	return r
+}
+
+func checkStaleTrigger(path string) preflightResult {
+	r := preflightResult{name: "reload trigger file", status: preflightOK}
+	info, err := os.Stat(path)
+	if err != nil {
+		r.detail = "no pending reload"
+		return r
+	}
+	age := time.Since(info.ModTime()).Truncate(time.Second)
+	r.detail = fmt.Sprintf("pending reload since %s", age)
+	if age > doctorStaleTrigger {
+		r.status = preflightFail
+		r.remediation = fmt.Sprintf("previous reloads failed, run %q manually and check its output", *reloadCommand)
+	}
+	return r
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// errReadsDisagree is returned when the verification read differs from the first read.
+var errReadsDisagree = errors.New("reads of users disagree")
+
+// verifyDB is the separate handle of -verify-connection, opened on the first double read.
+var verifyDB *sql.DB
+
+// verifyRead fetches users again over an independent connection and fails if they differ,
+// guarding against torn reads during failovers or broken proxies in between.
+func verifyRead(ctx context.Context, base *fetcher, exclude []string, users map[string]string) error {
+	if verifyDB == nil {
+		dsn := *verifyConnectionString
+		if dsn == "" {
+			dsn = *connectionString
+		}
+		db, err := openDB(dsn)
+		if err != nil {
+			return fmt.Errorf("open verify connection: %w", err)
+		}
+		verifyDB = db
+	}
+	second, err := base.forRun().fetch(ctx, verifyDB, exclude, nil)
+	if err != nil {
+		return fmt.Errorf("verify read: %w", err)
+	}
+	added, removed, updated := userlist.Diff(users, second)
+	if len(added)+len(removed)+len(updated) > 0 {
+		return fmt.Errorf("%w: %d user(s) only in the second read, %d only in the first, %d with different passwords",
+			errReadsDisagree, len(added), len(removed), len(updated))
+	}
+	return nil
+}
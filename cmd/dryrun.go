@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// runDryRun generates the userlist and prints the summary of changes to -path
+// without writing the userlist, its backup, the trigger file or the state.
+func runDryRun(ctx context.Context, db *sql.DB, w io.Writer, exclude []string) error {
+	report := &runReport{Start: time.Now(), Phases: make(userlist.Timings), Attempts: 1, DryRun: true}
+	users, err := fetchUserList(ctx, db, exclude, report.Phases)
+	if err != nil {
+		return err
+	}
+	previous, err := readUserList(*filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	report.Users = len(users)
+	report.Added, report.Removed, report.Updated = userlist.Diff(previous, users)
+	report.Changed = len(report.Added)+len(report.Removed)+len(report.Updated) > 0
+	report.Duration = time.Since(report.Start)
+	if *outputFormat != outputText {
+		return printRunResult(w, report)
+	}
+	if !report.Changed {
+		_, err := fmt.Fprintf(w, "%s is up to date with %d users\n", *filePath, report.Users)
+		return err
+	}
+	fmt.Fprintf(w, "%s would be updated to %d users: %d added, %d removed, %d updated\n",
+		*filePath, report.Users, len(report.Added), len(report.Removed), len(report.Updated))
+	for _, change := range []struct {
+		name  string
+		users []string
+	}{{"added", report.Added}, {"removed", report.Removed}, {"updated", report.Updated}} {
+		if len(change.users) > 0 {
+			fmt.Fprintf(w, "  %s: %s\n", change.name, strings.Join(change.users, ", "))
+		}
+	}
+	return nil
+}
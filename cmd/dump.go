@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// scheduler is the state of runs reported by the SIGQUIT dump.
+var scheduler = struct {
+	sync.Mutex
+	waiting    int
+	cycleSince time.Time
+	lastTick   time.Time
+	nextTick   time.Time
+}{}
+
+// cycleWaiting records the cycle waiting for the running one.
+func cycleWaiting() {
+	scheduler.Lock()
+	scheduler.waiting++
+	scheduler.Unlock()
+}
+
+// cycleStarted records the cycle in progress until the returned function is called.
+func cycleStarted() func() {
+	scheduler.Lock()
+	scheduler.waiting--
+	scheduler.cycleSince = time.Now()
+	scheduler.Unlock()
+	return func() {
+		scheduler.Lock()
+		scheduler.cycleSince = time.Time{}
+		scheduler.Unlock()
+	}
+}
+
+// tickScheduled records the tick of the daemon loop and the time of the next one.
+func tickScheduled(now time.Time, next time.Duration) {
+	scheduler.Lock()
+	scheduler.lastTick, scheduler.nextTick = now, now.Add(next)
+	scheduler.Unlock()
+}
+
+// watchDumps logs the internal state and goroutine stacks on SIGQUIT instead of exiting,
+// to find out why a long-running process doesn't generate the userlist.
+func watchDumps(ctx context.Context) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGQUIT)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.Printf("[INFO] SIGQUIT dump:\n%s", dumpState())
+		}
+	}
+}
+
+func dumpState() string {
+	var b strings.Builder
+	now := time.Now()
+	scheduler.Lock()
+	if scheduler.cycleSince.IsZero() {
+		fmt.Fprintf(&b, "cycle: idle\n")
+	} else {
+		fmt.Fprintf(&b, "cycle: running since %s (%s)\n", scheduler.cycleSince.Format(time.RFC3339), now.Sub(scheduler.cycleSince).Round(time.Millisecond))
+	}
+	fmt.Fprintf(&b, "waiting cycles: %d\n", scheduler.waiting)
+	if *daemon {
+		fmt.Fprintf(&b, "interval: %s, max interval: %s\n", *interval, *maxInterval)
+		if !scheduler.lastTick.IsZero() {
+			fmt.Fprintf(&b, "last tick: %s, next tick: %s\n", scheduler.lastTick.Format(time.RFC3339), scheduler.nextTick.Format(time.RFC3339))
+		}
+	}
+	scheduler.Unlock()
+	lastStatus.Lock()
+	b.WriteString(lastStatus.text)
+	lastStatus.Unlock()
+	fmt.Fprintf(&b, "goroutines: %d\n", runtime.NumGoroutine())
+	stack := make([]byte, 1<<20)
+	stack = stack[:runtime.Stack(stack, true)]
+	b.Write(stack)
+	return b.String()
+}
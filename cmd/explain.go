@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/lib/pq"
+)
+
+const (
+	decisionIncluded        = "included"
+	decisionNoPassword      = "no-password"
+	decisionExcludedByGroup = "excluded-by-group"
+	decisionSystemRole      = "system-role"
+	decisionNotIncluded     = "not-included"
+	decisionExcludedByRegex = "excluded-by-regex"
+	decisionAttribute       = "skipped-by-attribute"
+	decisionNotMember       = "not-member"
+	decisionExpired         = "expired"
+	decisionExcluded        = "excluded"
+)
+
+// roleInfo holds catalog attributes of a role which affect the generated userlist.
+type roleInfo struct {
+	name        string
+	hasPassword bool
+	canLogin    bool
+	expired     bool
+	validUntil  string
+	memberOf    []string
+	system      bool
+	superuser   bool
+	replication bool
+	// expiresIn is the time left until rolvaliduntil, infinite without it.
+	expiresIn float64
+}
+
+// explainRole returns the decision of the generator about the role and
+// details explaining it, following the filtering of the fetch.
+func (f *fetcher) explainRole(role roleInfo, exclude map[string]bool) (string, []string) {
+	var details []string
+	if !role.canLogin {
+		details = append(details, "nologin, postgres rejects its logins")
+	}
+	if role.expired {
+		details = append(details, "password expired at "+role.validUntil)
+	}
+	if !role.hasPassword {
+		return decisionNoPassword, details
+	}
+	if role.system && f.skipSystemRoles {
+		return decisionSystemRole, details
+	}
+	switch {
+	case (f.skipExpired || f.expiringWithin > 0) && role.expiresIn <= f.expiringWithin.Seconds():
+		return decisionExpired, append([]string{"valid until " + role.validUntil + ", -skip-expired"}, details...)
+	case role.superuser && f.skipSuperusers:
+		return decisionAttribute, append([]string{"superuser, -skip-superusers"}, details...)
+	case !role.canLogin && f.onlyLoginRoles:
+		return decisionAttribute, append([]string{"-only-login-roles"}, details...)
+	case role.replication && f.skipReplication:
+		return decisionAttribute, append([]string{"replication, -skip-replication-roles"}, details...)
+	}
+	if len(f.memberOf) > 0 && !memberOfAny(role, f.memberOf) {
+		return decisionNotMember, append([]string{"not granted " + strings.Join(f.memberOf, " or ")}, details...)
+	}
+	switch f.regexDecision(role.name) {
+	case decisionExcludedByRegex:
+		return decisionExcludedByRegex, append([]string{"matches -exclude-regex"}, details...)
+	case decisionNotIncluded:
+		return decisionNotIncluded, append([]string{"doesn't match -include-regex"}, details...)
+	}
+	switch f.managedDecision(role.name) {
+	case decisionExcluded:
+		return decisionExcluded, append([]string{"exclude in " + f.managedRolesTable}, details...)
+	case decisionNotIncluded:
+		return decisionNotIncluded, append([]string{"not include in " + f.managedRolesTable}, details...)
+	}
+	if len(f.include) > 0 {
+		for _, name := range f.include {
+			if name == role.name {
+				return decisionIncluded, details
+			}
+		}
+		return decisionNotIncluded, append([]string{"not in -include"}, details...)
+	}
+	var excludedBy []string
+	for _, group := range role.memberOf {
+		if !exclude[group] {
+			// membership in any other role keeps the user.
+			return decisionIncluded, details
+		}
+		excludedBy = append(excludedBy, group)
+	}
+	if len(excludedBy) > 0 {
+		return decisionExcludedByGroup, append([]string{"member of " + strings.Join(excludedBy, ",")}, details...)
+	}
+	return decisionIncluded, details
+}
+
+// memberOfAny tells whether the role is granted membership in any of the groups directly.
+func memberOfAny(role roleInfo, groups []string) bool {
+	for _, group := range role.memberOf {
+		for _, name := range groups {
+			if group == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fetchRoles returns every role of pg_authid with attributes used by explain.
+func fetchRoles(ctx context.Context, db *sql.DB) ([]roleInfo, error) {
+	rows, errRows := db.QueryContext(ctx, `
+select
+    id.rolname,
+    id.rolpassword is not null,
+    id.rolcanlogin,
+    coalesce(id.rolvaliduntil < now(), false),
+    coalesce(id.rolvaliduntil::text, ''),
+    coalesce(array_agg(r.rolname::text) filter (where r.rolname is not null), '{}'),
+    id.oid < `+strconv.Itoa(firstNormalObjectID)+` or id.rolname ~ '^pg_',
+    id.rolsuper,
+    id.rolreplication,
+    coalesce(extract(epoch from id.rolvaliduntil - now()), 'Infinity')::float8
+from pg_authid as id
+    left join pg_catalog.pg_auth_members m on id.oid = m.member
+    left join pg_catalog.pg_roles r on m.roleid = r.oid
+group by id.oid, id.rolname, id.rolpassword, id.rolcanlogin, id.rolvaliduntil, id.rolsuper, id.rolreplication
+order by id.rolname
+`)
+	if errRows != nil {
+		return nil, errRows
+	}
+	// nolint:errcheck
+	defer rows.Close()
+	var roles []roleInfo
+	for rows.Next() {
+		var role roleInfo
+		var memberOf pq.StringArray
+		if err := rows.Scan(&role.name, &role.hasPassword, &role.canLogin, &role.expired, &role.validUntil, &memberOf, &role.system, &role.superuser, &role.replication, &role.expiresIn); err != nil {
+			return nil, err
+		}
+		role.memberOf = memberOf
+		roles = append(roles, role)
+	}
+	return roles, rows.Err()
+}
+
+// runExplain prints every role with the decision whether it is written to
+// the userlist, optionally limited to the roles given in args.
+func runExplain(ctx context.Context, db *sql.DB, w io.Writer, exclude []string, args []string) error {
+	roles, err := fetchRoles(ctx, db)
+	if err != nil {
+		return err
+	}
+	if exclude, err = runFetcher.applyManagedRoles(ctx, db, exclude); err != nil {
+		return err
+	}
+	var rules mappingRules
+	if runFetcher.mappingFile != "" {
+		if rules, err = readMappingRules(runFetcher.mappingFile); err != nil {
+			return err
+		}
+	}
+	excluded := make(map[string]bool, len(exclude))
+	for _, name := range exclude {
+		excluded[name] = true
+	}
+	only := make(map[string]bool, len(args))
+	for _, name := range args {
+		only[name] = true
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROLE\tDECISION\tDETAIL")
+	for _, role := range roles {
+		if len(only) > 0 && !only[role.name] {
+			continue
+		}
+		delete(only, role.name)
+		decision, details := runFetcher.explainRole(role, excluded)
+		if to := rules.mapName(role.name); to != role.name && decision == decisionIncluded {
+			details = append(details, "written as "+to)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", role.name, decision, strings.Join(details, "; "))
+	}
+	for name := range only {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", name, "not-found", "role doesn't exist")
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const (
+	exportNames = "names"
+	exportTypes = "types"
+	exportFull  = "full"
+)
+
+// exportUser is a user of the snapshot, fields are set depending on the redaction level.
+type exportUser struct {
+	Name         string `json:"name"`
+	PasswordType string `json:"password_type,omitempty"`
+	Password     string `json:"password,omitempty"`
+}
+
+// exportSnapshot is the snapshot of the user set printed by export command.
+type exportSnapshot struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Cluster     string            `json:"cluster,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Level       string            `json:"level"`
+	Users       []exportUser      `json:"users"`
+}
+
+// runExport prints json snapshot of the current user set at the redaction level of args:
+// names only, names with password types, or full with hashes which requires -allow-full.
+func runExport(ctx context.Context, db *sql.DB, w io.Writer, exclude []string, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	level := fs.String("level", exportNames, "redaction level: names, types or full")
+	allowFull := fs.Bool("allow-full", false, "allow full level exposing password hashes")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch *level {
+	case exportNames, exportTypes:
+	case exportFull:
+		if !*allowFull {
+			return errors.New("full level exposes password hashes, confirm it with -allow-full")
+		}
+	default:
+		return fmt.Errorf("unknown level %q, expected names, types or full", *level)
+	}
+	users, err := fetchUserList(ctx, db, exclude, nil)
+	if err != nil {
+		return err
+	}
+	snapshot := exportSnapshot{GeneratedAt: time.Now().UTC(), Cluster: *cluster, Labels: runLabels, Level: *level, Users: make([]exportUser, 0, len(users))}
+	for username, password := range users {
+		u := exportUser{Name: username}
+		if *level != exportNames {
+			u.PasswordType = passwordType(password)
+		}
+		if *level == exportFull {
+			u.Password = password
+		}
+		snapshot.Users = append(snapshot.Users, u)
+	}
+	sort.Slice(snapshot.Users, func(i, j int) bool { return snapshot.Users[i].Name < snapshot.Users[j].Name })
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(snapshot)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// insufficientPrivilege is SQLSTATE of "permission denied" errors.
+const insufficientPrivilege = "42501"
+
+func isInsufficientPrivilege(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == insufficientPrivilege
+}
+
+// quoteRelation quotes the optionally schema qualified relation name.
+func quoteRelation(relation string) (string, error) {
+	parts := strings.Split(relation, ".")
+	if len(parts) > 2 {
+		return "", fmt.Errorf("invalid relation: %q", relation)
+	}
+	for i, part := range parts {
+		if part == "" {
+			return "", fmt.Errorf("invalid relation: %q", relation)
+		}
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// fallbackUsersQuery selects users from the relation with pg_shadow columns,
+// membership in excluded roles ($1) is checked with world readable catalogs.
+func fallbackUsersQuery(relation string) (string, error) {
+	quoted, err := quoteRelation(relation)
+	if err != nil {
+		return "", fmt.Errorf("fallback: %w", err)
+	}
+	return `
+select distinct
+    s.usename,
+    s.passwd
+from ` + quoted + ` as s
+    left join pg_catalog.pg_roles u on u.rolname = s.usename
+    left join pg_catalog.pg_auth_members m on u.oid = m.member
+    left join pg_catalog.pg_roles r on m.roleid = r.oid
+where (r.rolname is null or not(r.rolname::TEXT=any($1))) and s.passwd is not null
+`, nil
+}
+
+// permissionRemediation explains which grant is missing to read pg_authid.
+func permissionRemediation(ctx context.Context, db *sql.DB, err error) error {
+	user := "<role>"
+	var current string
+	if errUser := db.QueryRowContext(ctx, `select current_user`).Scan(&current); errUser == nil {
+		user = pq.QuoteIdentifier(current)
+	}
+	return fmt.Errorf("%w: connect as a superuser, run as a superuser \"GRANT SELECT ON pg_catalog.pg_authid TO %s\", "+
+		"or create a security definer view with usename and passwd columns, grant select on it to %s and set -fallback-relation",
+		err, user, user)
+}
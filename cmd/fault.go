@@ -0,0 +1,22 @@
+package main
+
+import "fmt"
+
+// Phases where faults are injected by binaries built with the faultinject tag.
+const (
+	faultQuery         = "query"
+	faultWrite         = "write"
+	faultReloadTimeout = "reload-timeout"
+	faultAudit         = "audit"
+)
+
+// faultReloadCommand never finishes, so the reload hits -reload-timeout.
+const faultReloadCommand = "while :; do sleep 1; done"
+
+// injectedError returns an error if a fault is injected in the phase.
+func injectedError(phase string) error {
+	if !faultInjected(phase) {
+		return nil
+	}
+	return fmt.Errorf("injected %s fault", phase)
+}
@@ -0,0 +1,45 @@
+//go:build faultinject
+// +build faultinject
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+)
+
+// Flags of binaries built for operational rehearsals with: go build -tags faultinject.
+var (
+	injectFault     = flag.String("inject-fault", "", "comma separated phases to inject faults in: query, write, reload-timeout, audit")
+	injectFaultRate = flag.Float64("inject-fault-rate", 1, "probability of injecting a fault in every listed phase")
+)
+
+// validateFaults checks -inject-fault and warns that faults are injected.
+func validateFaults() error {
+	if *injectFault == "" {
+		return nil
+	}
+	for _, phase := range strings.Split(*injectFault, ",") {
+		switch phase {
+		case faultQuery, faultWrite, faultReloadTimeout, faultAudit:
+		default:
+			return fmt.Errorf("unknown fault phase: %q", phase)
+		}
+	}
+	log.Printf("[WARN] injecting faults in %s with rate %g\n", *injectFault, *injectFaultRate)
+	return nil
+}
+
+func faultInjected(phase string) bool {
+	for _, p := range strings.Split(*injectFault, ",") {
+		// nolint:gosec
+		if p == phase && rand.Float64() < *injectFaultRate {
+			log.Printf("[WARN] injecting %s fault\n", phase)
+			return true
+		}
+	}
+	return false
+}
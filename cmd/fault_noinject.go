@@ -0,0 +1,12 @@
+//go:build !faultinject
+// +build !faultinject
+
+package main
+
+func validateFaults() error {
+	return nil
+}
+
+func faultInjected(_ string) bool {
+	return false
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/catalog"
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// fetchOptions are options deciding which users are fetched and how, parsed from flags
+// or from -shadow-config over them.
+type fetchOptions struct {
+	include, memberOf []string
+
+	skipSystemRoles, skipSuperusers, onlyLoginRoles, skipReplication, skipExpired bool
+	expiringWithin                                                                time.Duration
+
+	// excludeRe and includeRe are compiled -exclude-regex and -include-regex, nil when not set.
+	excludeRe, includeRe *regexp.Regexp
+
+	managedRolesTable, fallbackRelation  string
+	clustersFile, mergeConflict          string
+	plaintextFile, plaintextRelation     string
+	roleSettings                         bool
+	usersTable, scramPolicy, mappingFile string
+	authUser                             string
+	hybridAuth, strict, snapshot         bool
+}
+
+// fetcher fetches users with its options and keeps what the last fetch read besides them.
+type fetcher struct {
+	fetchOptions
+	// clusterDBs are handles of -clusters-file clusters by name, opened on their first read
+	// and shared by fetchers of the runs.
+	clusterDBs map[string]*sql.DB
+
+	// warnings about roles of the last fetch, recorded as errors with strict.
+	warnings strictLog
+	// Roles of -managed-roles-table read by the last fetch: only included
+	// roles are written when there are any, excluded roles are never written.
+	managedIncluded, managedExcluded map[string]bool
+	// settings are [users] section settings of the last fetched users.
+	settings map[string]map[string]string
+	// readSnapshot is the database state of the last users read with -snapshot.
+	readSnapshot *catalog.Snapshot
+}
+
+// runFetcher fetches users with options of the flags for commands, every run
+// of the generator fetches with its own fetcher of them.
+var runFetcher *fetcher
+
+// newFetcher parses fetch options of flags, overridden by the values by flag name.
+func newFetcher(overrides map[string]string) (*fetcher, error) {
+	value := func(name string) string {
+		if v, ok := overrides[name]; ok {
+			return v
+		}
+		return flag.Lookup(name).Value.String()
+	}
+	f := &fetcher{clusterDBs: make(map[string]*sql.DB)}
+	f.warnings.strict = &f.strict
+	bools := map[string]*bool{
+		"skip-system-roles":      &f.skipSystemRoles,
+		"skip-superusers":        &f.skipSuperusers,
+		"only-login-roles":       &f.onlyLoginRoles,
+		"skip-replication-roles": &f.skipReplication,
+		"skip-expired":           &f.skipExpired,
+		"role-settings":          &f.roleSettings,
+		"hybrid-auth":            &f.hybridAuth,
+		"strict":                 &f.strict,
+		"snapshot":               &f.snapshot,
+	}
+	for name, p := range bools {
+		v, err := strconv.ParseBool(value(name))
+		if err != nil {
+			return nil, fmt.Errorf("-%s: %w", name, err)
+		}
+		*p = v
+	}
+	for name, p := range map[string]*string{
+		"managed-roles-table": &f.managedRolesTable,
+		"fallback-relation":   &f.fallbackRelation,
+		"clusters-file":       &f.clustersFile,
+		"merge-conflict":      &f.mergeConflict,
+		"plaintext-file":      &f.plaintextFile,
+		"plaintext-relation":  &f.plaintextRelation,
+		"users-table":         &f.usersTable,
+		"scram":               &f.scramPolicy,
+		"mapping-file":        &f.mappingFile,
+		"auth-user":           &f.authUser,
+	} {
+		*p = value(name)
+	}
+	var err error
+	if f.expiringWithin, err = time.ParseDuration(value("skip-expiring-within")); err != nil {
+		return nil, fmt.Errorf("-skip-expiring-within: %w", err)
+	}
+	f.include, f.memberOf = splitNames(value("include")), splitNames(value("member-of"))
+	if f.excludeRe, err = compileRegex("exclude-regex", value("exclude-regex")); err != nil {
+		return nil, err
+	}
+	if f.includeRe, err = compileRegex("include-regex", value("include-regex")); err != nil {
+		return nil, err
+	}
+	if err := checkMergeConflict(f.mergeConflict, f.clustersFile); err != nil {
+		return nil, err
+	}
+	if err := checkScramPolicy(f.scramPolicy); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// forRun returns fetcher with the same options and cluster handles, keeping what it reads on its own.
+func (f *fetcher) forRun() *fetcher {
+	run := &fetcher{fetchOptions: f.fetchOptions, clusterDBs: f.clusterDBs}
+	run.warnings.strict = &run.strict
+	return run
+}
+
+// compileRegex compiles the expression of the flag, nil when it is empty.
+func compileRegex(name, expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("-%s: %w", name, err)
+	}
+	return re, nil
+}
+
+// fetch returns username to password map of roles which are not members of excluded roles,
+// without roles left out by role settings and with names rewritten by -mapping-file rules.
+func (f *fetcher) fetch(ctx context.Context, db *sql.DB, exclude []string, timings userlist.Timings) (map[string]string, error) {
+	users, err := f.fetchAll(ctx, db, exclude, timings)
+	if err != nil || (f.authUser == "" && !f.hybridAuth) {
+		return users, err
+	}
+	if users, err = f.staticUsers(users); err != nil {
+		return nil, err
+	}
+	return users, f.warnings.strictError()
+}
+
+// fetchAll returns users before -auth-user and -hybrid-auth leave only the static ones.
+func (f *fetcher) fetchAll(ctx context.Context, db *sql.DB, exclude []string, timings userlist.Timings) (map[string]string, error) {
+	f.warnings.violations, f.settings, f.readSnapshot = nil, nil, nil
+	exclude, err := f.applyManagedRoles(ctx, db, exclude)
+	if err != nil {
+		return nil, err
+	}
+	users, err := f.fetchCatalog(ctx, db, exclude, timings)
+	if err != nil {
+		return nil, err
+	}
+	if users, err = f.mergeClusters(ctx, users, exclude); err != nil {
+		return nil, err
+	}
+	if users, err = f.mergePlaintext(ctx, db, users); err != nil {
+		return nil, err
+	}
+	users = f.filterManaged(users)
+	users = f.filterByRegex(users)
+	if f.roleSettings && *simulateRoles == 0 {
+		if users, err = f.applyRoleSettings(ctx, db, users); err != nil {
+			return nil, err
+		}
+	}
+	if f.usersTable != "" && *simulateRoles == 0 {
+		if err := f.applyUsersTable(ctx, db, users); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.applyScramPolicy(users); err != nil {
+		return nil, err
+	}
+	if f.mappingFile != "" {
+		if users, err = f.mapUsers(users); err != nil {
+			return nil, err
+		}
+	}
+	// names are checked as they are written, after the mapping.
+	if err := f.checkUsers(users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// mapUsers rewrites names of users and of their settings by -mapping-file rules.
+func (f *fetcher) mapUsers(users map[string]string) (map[string]string, error) {
+	rules, err := readMappingRules(f.mappingFile)
+	if err != nil {
+		return nil, err
+	}
+	settings := make(map[string]map[string]string, len(f.settings))
+	for username, s := range f.settings {
+		settings[rules.mapName(username)] = s
+	}
+	f.settings = settings
+	return rules.apply(users)
+}
+
+// fetchCatalog reads users from pg_authid or -fallback-relation if pg_authid access is denied.
+func (f *fetcher) fetchCatalog(ctx context.Context, db *sql.DB, exclude []string, timings userlist.Timings) (map[string]string, error) {
+	if *simulateRoles > 0 {
+		return simulateUsers(timings), nil
+	}
+	users, err := f.query(ctx, db, catalog.UsersQuery+f.roleConditions("id"), exclude, timings)
+	if !isInsufficientPrivilege(err) {
+		return users, err
+	}
+	if f.fallbackRelation == "" {
+		return nil, permissionRemediation(ctx, db, err)
+	}
+	log.Printf("[WARN] %s, falling back to %s\n", err, f.fallbackRelation)
+	query, errQuery := fallbackUsersQuery(f.fallbackRelation)
+	if errQuery != nil {
+		return nil, errQuery
+	}
+	users, err = f.query(ctx, db, query+f.roleConditions("u"), exclude, timings)
+	if err != nil {
+		return nil, fmt.Errorf("fallback to %s: %w", f.fallbackRelation, err)
+	}
+	return users, nil
+}
+
+// query runs the query returning username and password pairs.
+func (f *fetcher) query(ctx context.Context, db *sql.DB, query string, exclude []string, timings userlist.Timings) (map[string]string, error) {
+	if err := injectedError(faultQuery); err != nil {
+		return nil, err
+	}
+	source := &catalog.Source{DB: db, Query: query, Exclude: exclude, Timings: timings}
+	if f.snapshot {
+		source.Snapshot = &catalog.Snapshot{}
+	}
+	start := time.Now()
+	users, err := source.Users(ctx)
+	if err == nil {
+		log.Printf("[DEBUG] users query returned rows=%d duration=%s\n", len(users), time.Since(start).Round(time.Microsecond))
+		f.readSnapshot = source.Snapshot
+	}
+	return users, err
+}
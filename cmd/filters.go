@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// firstNormalObjectID is FirstNormalObjectId of postgres, objects with lower oids are created by initdb.
+const firstNormalObjectID = 16384
+
+// roleConditions returns conditions on the role with the alias, which are
+// added to users queries by filter options.
+func (o *fetchOptions) roleConditions(alias string) string {
+	var conditions []string
+	if o.skipSystemRoles {
+		conditions = append(conditions, fmt.Sprintf("%s.oid >= %d and %s.rolname !~ '^pg_'", alias, firstNormalObjectID, alias))
+	}
+	if o.skipSuperusers {
+		conditions = append(conditions, fmt.Sprintf("not %s.rolsuper", alias))
+	}
+	if o.onlyLoginRoles {
+		conditions = append(conditions, fmt.Sprintf("%s.rolcanlogin", alias))
+	}
+	if o.skipReplication {
+		conditions = append(conditions, fmt.Sprintf("not %s.rolreplication", alias))
+	}
+	if o.skipExpired || o.expiringWithin > 0 {
+		conditions = append(conditions, fmt.Sprintf("(%s.rolvaliduntil is null or %s.rolvaliduntil > now() + interval '%d seconds')",
+			alias, alias, int64(o.expiringWithin.Seconds())))
+	}
+	if len(o.memberOf) > 0 {
+		conditions = append(conditions, fmt.Sprintf(`exists (
+        select from pg_catalog.pg_auth_members gm join pg_catalog.pg_roles g on gm.roleid = g.oid
+        where gm.member = %s.oid and g.rolname in (%s))`, alias, quoteLiterals(o.memberOf)))
+	}
+	if len(o.include) > 0 {
+		conditions = append(conditions, fmt.Sprintf("%s.rolname in (%s)", alias, quoteLiterals(o.include)))
+	}
+	if len(conditions) == 0 {
+		return ""
+	}
+	return "    and " + strings.Join(conditions, "\n    and ") + "\n"
+}
+
+// splitNames returns non-empty names of the comma separated list.
+func splitNames(list string) []string {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// quoteLiterals returns comma separated sql literals of the names.
+func quoteLiterals(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, pq.QuoteLiteral(name))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// validateInclude rejects -include together with explicitly set -exclude, which would be ambiguous,
+// and clears the default -exclude, the include list replaces it.
+func validateInclude() error {
+	if len(splitNames(*includeAccounts)) == 0 {
+		return nil
+	}
+	if configSources["exclude"] != sourceDefault && strings.Trim(*excludeAccounts, ", ") != "" {
+		return errors.New("-include and -exclude are mutually exclusive, only users of -include are written to userlist")
+	}
+	*excludeAccounts = ""
+	return nil
+}
+
+// regexDecision returns the decision of -exclude-regex and -include-regex about the role,
+// empty if it is kept.
+func (o *fetchOptions) regexDecision(rolname string) string {
+	switch {
+	case o.excludeRe != nil && o.excludeRe.MatchString(rolname):
+		return decisionExcludedByRegex
+	case o.includeRe != nil && !o.includeRe.MatchString(rolname):
+		return decisionNotIncluded
+	}
+	return ""
+}
+
+// filterByRegex removes users left out by -exclude-regex and -include-regex.
+func (o *fetchOptions) filterByRegex(users map[string]string) map[string]string {
+	if o.excludeRe == nil && o.includeRe == nil {
+		return users
+	}
+	for rolname := range users {
+		if o.regexDecision(rolname) != "" {
+			delete(users, rolname)
+		}
+	}
+	return users
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// fleetResult is the outcome of distributing the userlist to a single host.
+type fleetResult struct {
+	host    fleetHost
+	changed bool
+	err     error
+}
+
+// runFleet generates the userlist and distributes it over ssh to every host
+// of the inventory, reloading pgbouncer on hosts where the file has changed.
+func runFleet(ctx context.Context, db *sql.DB, exclude []string) error {
+	if *inventoryPath == "" {
+		return fmt.Errorf("-inventory is required")
+	}
+	hosts, errInventory := readInventory(*inventoryPath)
+	if errInventory != nil {
+		return errInventory
+	}
+	return distribute(ctx, db, exclude, hosts)
+}
+
+// distribute generates the userlist and pushes it to the hosts, printing the result of every host.
+// Only the fetch is bound by commandTimeout, every host has its own -fleet-timeout.
+func distribute(ctx context.Context, db *sql.DB, exclude []string, hosts []fleetHost) error {
+	fetchCtx, cancel := context.WithTimeout(ctx, commandTimeout)
+	users, errFetch := fetchUserList(fetchCtx, db, exclude, nil)
+	cancel()
+	if errFetch != nil {
+		return errFetch
+	}
+	content := userlist.Render(users)
+
+	results := make([]fleetResult, len(hosts))
+	parallel := *fleetParallel
+	if parallel < 1 {
+		parallel = 1
+	}
+	sem := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func(i int, h fleetHost) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			changed, err := pushToHost(ctx, h, content)
+			results[i] = fleetResult{host: h, changed: changed, err: err}
+		}(i, h)
+	}
+	wg.Wait()
+
+	failed := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tPATH\tSTATUS\tDETAIL")
+	for _, r := range results {
+		status, detail := "unchanged", ""
+		switch {
+		case r.err != nil:
+			status, detail = "failed", r.err.Error()
+			failed++
+		case r.changed:
+			status, detail = "changed", "reloaded"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.host.Name, r.host.Path, status, detail)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d host(s) failed", failed, len(hosts))
+	}
+	return nil
+}
+
+// pushToHost replaces the userlist on the host over ssh, keeping a backup, and runs
+// the host's reload command if the content has changed. A marker next to the userlist
+// is kept until the reload succeeds, so a failed reload is retried by the next push.
+func pushToHost(ctx context.Context, h fleetHost, content []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, *fleetTimeout)
+	defer cancel()
+	path := shellQuote(h.Path)
+	script := strings.Join([]string{
+		"set -e",
+		"umask 077",
+		"tmp=" + path + ".tmp",
+		"pending=" + path + ".reload-pending",
+		`cat > "$tmp"`,
+		`if cmp -s "$tmp" ` + path + `; then`,
+		`  rm -f "$tmp"`,
+		`  if [ ! -e "$pending" ]; then echo unchanged; exit 0; fi`,
+		"else",
+		"  if [ -f " + path + " ]; then cp -p " + path + " " + path + `.backup-$(date +%s); fi`,
+		`  touch "$pending"`,
+		`  mv "$tmp" ` + path,
+		"fi",
+		h.ReloadCommand,
+		`rm -f "$pending"`,
+		"echo changed",
+	}, "\n")
+	args := strings.Fields(*sshOptions)
+	if h.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(h.Port))
+	}
+	if h.User != "" {
+		args = append(args, "-l", h.User)
+	}
+	args = append(args, h.Address, "/bin/sh -c "+shellQuote(script))
+	// nolint:gosec
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	cmd.Stdin = bytes.NewReader(content)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return false, fmt.Errorf("%w: %s", err, msg)
+		}
+		return false, err
+	}
+	return strings.TrimSpace(stdout.String()) == "changed", nil
+}
+
+// shellQuote quotes s for POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
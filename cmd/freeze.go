@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// freezeWindow starts at every minute matching the cron schedule and lasts duration.
+type freezeWindow struct {
+	spec     string
+	fields   [5]map[int]bool
+	anyDom   bool
+	anyDow   bool
+	duration time.Duration
+}
+
+// freezeSchedule is -freeze-windows parsed by validateFreezeWindows.
+var freezeSchedule []freezeWindow
+
+// cronRanges are bounds of minute, hour, day of month, month and day of week.
+var cronRanges = [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+
+// validateFreezeWindows parses -freeze-windows once, so a malformed window fails the start
+// instead of every run.
+func validateFreezeWindows() error {
+	var err error
+	freezeSchedule, err = parseFreezeWindows(*freezeWindows)
+	return err
+}
+
+// parseFreezeWindows parses ";" separated windows of five cron fields and duration,
+// e.g. "0 0 24 11 * 96h" freezes from November 24 for four days.
+func parseFreezeWindows(value string) ([]freezeWindow, error) {
+	var windows []freezeWindow
+	for _, spec := range strings.Split(value, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		w, err := parseFreezeWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("freeze window %q: %w", spec, err)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseFreezeWindow(spec string) (freezeWindow, error) {
+	w := freezeWindow{spec: spec}
+	fields := strings.Fields(spec)
+	if len(fields) != 6 {
+		return w, fmt.Errorf("expected 5 cron fields and duration")
+	}
+	var err error
+	if w.duration, err = time.ParseDuration(fields[5]); err != nil {
+		return w, err
+	}
+	if w.duration <= 0 {
+		return w, fmt.Errorf("duration must be positive")
+	}
+	for i := 0; i < 5; i++ {
+		if w.fields[i], err = parseCronField(fields[i], cronRanges[i][0], cronRanges[i][1]); err != nil {
+			return w, err
+		}
+	}
+	// sunday is both 0 and 7.
+	if w.fields[4][7] {
+		w.fields[4][0] = true
+	}
+	w.anyDom, w.anyDow = fields[2] == "*", fields[4] == "*"
+	return w, nil
+}
+
+// parseCronField parses lists of *, values and ranges with optional steps.
+func parseCronField(field string, min, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[idx+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:idx]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid range %q", part)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// matches reports whether the schedule fires at the minute, restricted day of month
+// and day of week match if either does, as in cron.
+func (w freezeWindow) matches(t time.Time) bool {
+	if !w.fields[0][t.Minute()] || !w.fields[1][t.Hour()] || !w.fields[3][int(t.Month())] {
+		return false
+	}
+	dom, dow := w.fields[2][t.Day()], w.fields[4][int(t.Weekday())]
+	switch {
+	case w.anyDom && w.anyDow:
+		return true
+	case w.anyDom:
+		return dow
+	case w.anyDow:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// active reports whether a window started within its duration before now.
+func (w freezeWindow) active(now time.Time) bool {
+	now = now.Truncate(time.Minute)
+	for t := now; now.Sub(t) < w.duration; t = t.Add(-time.Minute) {
+		if w.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// freezeActive returns the reason of the freeze if changes are frozen now.
+func freezeActive(now time.Time) (string, bool) {
+	if state.Frozen {
+		return "frozen since " + state.FrozenAt.Format(time.RFC3339) + reasonSuffix(state.FreezeReason), true
+	}
+	for _, w := range freezeSchedule {
+		if w.active(now.In(time.Local)) {
+			return "freeze window " + w.spec, true
+		}
+	}
+	return "", false
+}
+
+func reasonSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return ": " + reason
+}
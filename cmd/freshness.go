@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// evaluateFreshness sets staleness of the userlist to the report and tells whether
+// -freshness-slo is newly breached. The userlist is stale since the last successful run
+// while runs fail or are paused, and an applied change is as stale as its propagation latency.
+// The breach is kept in the state, so the alert is raised once per breach also across runs.
+func evaluateFreshness(report *runReport, now time.Time) bool {
+	if *freshnessSLO <= 0 {
+		return false
+	}
+	if (report.Err != nil || report.Paused) && !report.LastSuccess.IsZero() {
+		report.Staleness = now.Sub(report.LastSuccess)
+	}
+	if report.PropagationLatency > report.Staleness {
+		report.Staleness = report.PropagationLatency
+	}
+	report.FreshnessBreached = report.Staleness > *freshnessSLO
+	breached := report.FreshnessBreached && !state.FreshnessBreached
+	switch {
+	case breached:
+		log.Printf("[ERROR] freshness SLO of %s is breached, userlist is stale for %s\n", *freshnessSLO, report.Staleness.Round(time.Second))
+	case state.FreshnessBreached && !report.FreshnessBreached:
+		log.Printf("[INFO] freshness SLO of %s is met again\n", *freshnessSLO)
+	}
+	if state.FreshnessBreached != report.FreshnessBreached {
+		state.FreshnessBreached = report.FreshnessBreached
+		if err := saveState(); err != nil {
+			log.Printf("[ERROR] save state: %s\n", err)
+		}
+	}
+	return breached
+}
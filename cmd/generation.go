@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// classedError is an error of a step of the run with its class of runReport.
+type classedError struct {
+	class string
+	err   error
+}
+
+func (e *classedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *classedError) Unwrap() error {
+	return e.err
+}
+
+// classed returns the error with the class, nil stays nil.
+func classed(class string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &classedError{class: class, err: err}
+}
+
+// errClassOf returns the class of the error, generate by default.
+func errClassOf(err error) string {
+	var c *classedError
+	if errors.As(err, &c) {
+		return c.class
+	}
+	return errClassGenerate
+}
+
+// fetchSource is the userlist.Source of users fetched by the fetcher.
+type fetchSource struct {
+	f       *fetcher
+	db      *sql.DB
+	exclude []string
+	timings userlist.Timings
+}
+
+func (s fetchSource) Users(ctx context.Context) (map[string]string, error) {
+	return s.f.fetch(ctx, s.db, s.exclude, s.timings)
+}
+
+// generation is a single run of the userlist pipeline, its steps are hooks of userlist.Generator.
+// Everything the run reads and warns about is kept in it, only the state of -state-file is shared
+// by the runs of the process.
+type generation struct {
+	fetchSource
+	report *runReport
+	// warnings are warnings about users left out of outputs other than -path.
+	warnings strictLog
+	// hbaRules are rules of -hba-path read with the users.
+	hbaRules []hbaRule
+	file     *userlist.File
+	previous map[string]string
+	// bootstrap is whether -path doesn't exist yet.
+	bootstrap bool
+	// freeze is the reason of the active freeze, empty if changes are applied.
+	freeze string
+	// content and pendingBefore are the content written to -path and whether
+	// the reload was pending before the write.
+	content       []byte
+	pendingBefore bool
+}
+
+// generator returns the generator running the steps of the generation.
+func (r *generation) generator() *userlist.Generator {
+	g := &userlist.Generator{
+		Source:  r,
+		File:    r.file,
+		Render:  r.render,
+		Gate:    r.gate,
+		Written: r.written,
+		Reload:  r.reload,
+		Outputs: []userlist.Output{userlist.OutputFunc(r.writeTargets), userlist.OutputFunc(r.writeShards)},
+	}
+	if r.freeze == "" {
+		g.Filters = []userlist.Filter{userlist.FilterFunc(r.verifyRead), userlist.FilterFunc(r.compareShadow)}
+	}
+	return g
+}
+
+// Users fetches users and the rules of -hba-path, the userlist of -cache-file
+// is restored if they can't be fetched.
+func (r *generation) Users(ctx context.Context) (map[string]string, error) {
+	users, err := r.fetchSource.Users(ctx)
+	if err == nil && *hbaPath != "" {
+		r.hbaRules, err = loadHBARules(ctx, r.db)
+	}
+	if err != nil {
+		if *cacheFile != "" && r.freeze == "" {
+			restoreFromCache(r.report)
+		}
+		return nil, err
+	}
+	r.report.Snapshot = r.f.readSnapshot
+	return users, nil
+}
+
+func (r *generation) verifyRead(ctx context.Context, users map[string]string) (map[string]string, error) {
+	if *doubleRead {
+		if err := verifyRead(ctx, r.f, r.exclude, users); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+func (r *generation) compareShadow(ctx context.Context, users map[string]string) (map[string]string, error) {
+	if *shadowConfig != "" {
+		compareShadow(ctx, r.db, r.f, users, r.report)
+	}
+	return users, nil
+}
+
+// render renders the userlist with the comment of -snapshot.
+func (r *generation) render(users map[string]string) []byte {
+	content := userlist.Render(users)
+	if r.report.Snapshot != nil {
+		content = snapshotContent(content, r.report.Snapshot, r.previous, users)
+	}
+	return content
+}
+
+// gate holds back changes during freezes and while they wait for -require-approval,
+// otherwise it prepares the write of the userlist.
+func (r *generation) gate(_ context.Context, users map[string]string, content []byte) (bool, error) {
+	report := r.report
+	if r.freeze != "" {
+		report.Users, report.Frozen = len(users), true
+		report.Added, report.Removed, report.Updated = userlist.Diff(r.previous, users)
+		pending := len(report.Added) + len(report.Removed) + len(report.Updated)
+		log.Printf("[WARN] %s, %d pending change(s) are not applied: added %v, removed %v, updated %v\n",
+			r.freeze, pending, report.Added, report.Removed, report.Updated)
+		return false, nil
+	}
+	// the snapshot header differs every run, so changes are approved without it.
+	apply, err := approvalGate(withoutSnapshot(content), report)
+	if err != nil {
+		return false, fmt.Errorf("stage userlist: %w", err)
+	}
+	if !apply {
+		report.Users = len(users)
+		report.Added, report.Removed, report.Updated = userlist.Diff(r.previous, users)
+		return false, nil
+	}
+	if r.bootstrap {
+		if err := prepareBootstrap(); err != nil {
+			return false, fmt.Errorf("bootstrap: %w", err)
+		}
+	}
+	if err := checkWrite(r.file.Path); err != nil {
+		return false, err
+	}
+	r.content, r.pendingBefore = content, reloadPending()
+	r.file.BackupAnnotation = annotateBackup(report, r.previous, users)
+	return true, nil
+}
+
+// written records the written users and cancels reloads skipped by -bootstrap-reload and -skip-format-reload.
+func (r *generation) written(ctx context.Context, result userlist.Result) error {
+	report, users, changed := r.report, result.Users, result.Changed
+	wroteUserList(r.file.Path, r.content, changed)
+	report.Users, report.Changed = len(users), changed
+	recordHistory(users, time.Now())
+	if *cacheFile != "" {
+		if err := saveCache(users); err != nil {
+			log.Printf("[ERROR] save cache: %s\n", err)
+		}
+	}
+	if *pgbouncerAdmin != "" {
+		if err := observeClients(ctx, time.Now()); err != nil {
+			log.Printf("[WARN] sample pgbouncer clients: %s\n", err)
+		}
+	}
+	if changed {
+		report.Added, report.Removed, report.Updated = userlist.Diff(r.previous, users)
+	}
+	if changed && r.bootstrap {
+		if err := skipBootstrapReload(); err != nil {
+			return classed(errClassReload, fmt.Errorf("skip reload: %w", err))
+		}
+	}
+	if changed && *skipFormatReload {
+		if err := skipCosmeticReload(r.pendingBefore, report); err != nil {
+			return classed(errClassReload, fmt.Errorf("skip reload: %w", err))
+		}
+	}
+	return nil
+}
+
+// reload processes the trigger file of the userlist and checks the reloaded pgbouncer
+// with -canary-connection, failures roll the userlist back with -rollback-on-failure.
+func (r *generation) reload(ctx context.Context, result userlist.Result) error {
+	report := r.report
+	command, reloader := pgbouncerReload(*reloadCommand)
+	if err := processTriggerFile(*reloadTriggerFile, *filePath, command, reloader, report); err != nil {
+		err = fmt.Errorf("process trigger file: %w", err)
+		if *rollbackOnFailure && result.Changed {
+			err = rollback(err, report)
+		}
+		return classed(errClassReload, err)
+	}
+	if _, reloaded := report.Phases[userlist.PhaseReload]; reloaded && *canaryConnection != "" {
+		if err := checkCanary(ctx); err != nil {
+			if *rollbackOnFailure && result.Changed {
+				err = rollback(err, report)
+			}
+			return classed(errClassCanary, err)
+		}
+	}
+	if *measureLatency {
+		if err := measurePropagation(ctx, r.db, report); err != nil {
+			log.Printf("[WARN] measure propagation latency: %s\n", err)
+		}
+	}
+	return nil
+}
+
+// writeTargets writes additional outputs and userlists of tenants, processing their trigger files.
+func (r *generation) writeTargets(_ context.Context, users map[string]string) (bool, error) {
+	targets, err := extraTargets(r.f.settings, r.hbaRules)
+	if err != nil {
+		return false, err
+	}
+	tenants, tenantNames, err := tenantTargets(users, state.Tenants, &r.warnings)
+	if err != nil {
+		return false, fmt.Errorf("tenant outputs: %w", err)
+	}
+	targets = append(targets, tenants...)
+	changed := false
+	for _, target := range targets {
+		targetChanged, err := target.write(users, &r.warnings, r.report.Phases)
+		if err != nil {
+			return changed, fmt.Errorf("generate %s: %w", target.path, err)
+		}
+		changed = changed || targetChanged
+		if err := processTriggerFile(target.triggerFile, target.path, target.reloadCommand, target.reloader(), r.report); err != nil {
+			return changed, classed(errClassReload, fmt.Errorf("process trigger file of %s: %w", target.path, err))
+		}
+	}
+	state.Tenants = tenantNames
+	return changed, nil
+}
+
+func (r *generation) writeShards(_ context.Context, users map[string]string) (bool, error) {
+	if *shardDir == "" {
+		return false, nil
+	}
+	changed, err := writeShards(*shardDir, users, *shards)
+	if err != nil {
+		return false, fmt.Errorf("generate shards: %w", err)
+	}
+	return changed, nil
+}
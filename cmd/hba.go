@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+	"gopkg.in/yaml.v3"
+)
+
+// hbaRule is a line of pgbouncer auth_hba_file. User is a role name, all, +group,
+// or a glob pattern expanded to the matching generated users.
+type hbaRule struct {
+	Type     string `yaml:"type"`
+	Database string `yaml:"database"`
+	User     string `yaml:"user"`
+	Address  string `yaml:"address"`
+	Method   string `yaml:"method"`
+}
+
+// hbaTableQuery selects rules of the control table in order of their line numbers.
+const hbaTableQuery = `select type::text, database::text, user_name::text, coalesce(address::text, ''), auth_method::text from %s order by line_number`
+
+func validateHBA() error {
+	if *hbaPath != "" && (*hbaRulesFile == "") == (*hbaTable == "") {
+		return errors.New("-hba-path needs either -hba-rules or -hba-table")
+	}
+	return nil
+}
+
+// loadHBARules reads rules of the hba file from -hba-rules yaml file or -hba-table relation.
+func loadHBARules(ctx context.Context, db *sql.DB) ([]hbaRule, error) {
+	var rules []hbaRule
+	switch {
+	case *hbaRulesFile != "":
+		data, err := os.ReadFile(filepath.Clean(*hbaRulesFile))
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, &rules); err != nil {
+			return nil, fmt.Errorf("%s: %w", *hbaRulesFile, err)
+		}
+	case *hbaTable != "" && *simulateRoles == 0:
+		quoted, err := quoteRelation(*hbaTable)
+		if err != nil {
+			return nil, err
+		}
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(hbaTableQuery, quoted))
+		if err != nil {
+			return nil, fmt.Errorf("read hba table %s: %w", *hbaTable, err)
+		}
+		// nolint:errcheck
+		defer rows.Close()
+		for rows.Next() {
+			var r hbaRule
+			if err := rows.Scan(&r.Type, &r.Database, &r.User, &r.Address, &r.Method); err != nil {
+				return nil, err
+			}
+			rules = append(rules, r)
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	for i, r := range rules {
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("hba rule %d: %w", i+1, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r hbaRule) validate() error {
+	switch r.Type {
+	case "local":
+		if r.Address != "" {
+			return fmt.Errorf("local rule has address %q", r.Address)
+		}
+	case "host", "hostssl", "hostnossl":
+		if r.Address == "" {
+			return fmt.Errorf("%s rule has no address", r.Type)
+		}
+	default:
+		return fmt.Errorf("unknown type %q, expected local, host, hostssl or hostnossl", r.Type)
+	}
+	for _, field := range []string{r.Database, r.User, r.Method} {
+		if field == "" {
+			return fmt.Errorf("database, user and method are required")
+		}
+	}
+	for _, field := range []string{r.Database, r.User, r.Address, r.Method} {
+		if strings.ContainsAny(field, " \t\n\"#") {
+			return fmt.Errorf("field %q can't be written to hba file", field)
+		}
+	}
+	return nil
+}
+
+// users returns the user field of the rule, glob patterns are replaced by comma
+// separated matching users, empty if none of them match.
+func (r hbaRule) users(users map[string]string) string {
+	if r.User == "all" || strings.HasPrefix(r.User, "+") || strings.HasPrefix(r.User, "@") || !strings.ContainsAny(r.User, "*?[") {
+		return r.User
+	}
+	var names []string
+	for username := range users {
+		if matchAny([]string{r.User}, username) && !strings.ContainsAny(username, " \t\n\",#") {
+			names = append(names, username)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// hbaAdapter writes pgbouncer auth_hba_file for auth_type = hba from the rules.
+type hbaAdapter struct {
+	rules []hbaRule
+}
+
+func (a hbaAdapter) Reload(command string) (string, userlist.Runner) {
+	return pgbouncerReload(command)
+}
+
+// Render renders rules in their order, rules whose user patterns match no users are left out.
+func (a hbaAdapter) Render(users map[string]string, _ *strictLog) []byte {
+	var b strings.Builder
+	b.WriteString("# generated by pgbouncer-userlist-generator, do not edit\n")
+	for _, r := range a.rules {
+		user := r.users(users)
+		if user == "" {
+			fmt.Fprintf(&b, "# %s %s %s: no matching users\n", r.Type, r.Database, r.User)
+			continue
+		}
+		fields := []string{r.Type, r.Database, user}
+		if r.Address != "" {
+			fields = append(fields, r.Address)
+		}
+		fields = append(fields, r.Method)
+		b.WriteString(strings.Join(fields, " ") + "\n")
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+// healthPingTimeout limits the database ping of /readyz.
+const healthPingTimeout = 2 * time.Second
+
+// processStart is the reference of success age before the first successful run.
+var processStart = time.Now()
+
+// healthStatus is the body of /healthz and /readyz responses.
+type healthStatus struct {
+	Status              string    `json:"status"`
+	LastRunSuccess      bool      `json:"last_run_success"`
+	LastRun             time.Time `json:"last_run"`
+	LastSuccess         time.Time `json:"last_success,omitempty"`
+	SecondsSinceSuccess float64   `json:"seconds_since_success"`
+	Paused              bool      `json:"paused"`
+	PauseReason         string    `json:"pause_reason,omitempty"`
+	Database            string    `json:"database,omitempty"`
+	Error               string    `json:"error,omitempty"`
+}
+
+// healthMaxAge returns -health-max-age, defaulting to three intervals, or three max intervals.
+func healthMaxAge() time.Duration {
+	if *healthMaxAgeFlag > 0 {
+		return *healthMaxAgeFlag
+	}
+	if *maxInterval > *interval {
+		return 3 * *maxInterval
+	}
+	return 3 * *interval
+}
+
+// currentHealth describes the last run, the caller checks the database for readiness.
+func currentHealth() healthStatus {
+	lastStatus.Lock()
+	report := lastStatus.report
+	status := healthStatus{Status: "ok", Paused: lastStatus.paused, PauseReason: lastStatus.pauseReason}
+	lastStatus.Unlock()
+	if status.Paused {
+		status.Status = "paused"
+	}
+	since := processStart
+	if report != nil {
+		status.LastRun, status.LastSuccess = report.Start, report.LastSuccess
+		status.LastRunSuccess = report.Err == nil
+		if report.Err != nil {
+			status.Error = report.Err.Error()
+		}
+		if !report.LastSuccess.IsZero() {
+			since = report.LastSuccess
+		}
+	}
+	status.SecondsSinceSuccess = time.Since(since).Seconds()
+	return status
+}
+
+// serveHealth serves /healthz, failing when there was no successful run for -health-max-age,
+// and /readyz, failing when the last run has failed or the database is unreachable.
+func serveHealth(db *sql.DB) (*http.Server, error) {
+	listener, err := net.Listen("tcp", *healthListen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		status := currentHealth()
+		code := http.StatusOK
+		if status.SecondsSinceSuccess > healthMaxAge().Seconds() {
+			status.Status, code = "stale", http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, status)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		status := currentHealth()
+		code := http.StatusOK
+		ctx, cancel := context.WithTimeout(r.Context(), healthPingTimeout)
+		defer cancel()
+		status.Database = "ok"
+		if *simulateRoles == 0 {
+			if err := db.PingContext(ctx); err != nil {
+				status.Database = err.Error()
+				status.Status, code = "database unavailable", http.StatusServiceUnavailable
+			}
+		}
+		if !status.LastRunSuccess {
+			status.Status, code = "last run failed", http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, status)
+	})
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: controlTimeout}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Printf("[ERROR] health server: %s\n", err)
+		}
+	}()
+	log.Printf("[INFO] health endpoints are listening on %s\n", listener.Addr())
+	return server, nil
+}
+
+func writeHealth(w http.ResponseWriter, code int, status healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	// nolint:errcheck
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// userHistory tells when the user was in the generated userlist.
+type userHistory struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Disappeared is the time the user was last removed, zero while present.
+	Disappeared time.Time `json:"disappeared,omitempty"`
+	// LastConnected is the last time the user was seen connected to pgbouncer.
+	LastConnected time.Time `json:"last_connected,omitempty"`
+}
+
+// recordHistory updates history of users with the applied userlist.
+func recordHistory(users map[string]string, now time.Time) {
+	if state.Users == nil {
+		state.Users = make(map[string]*userHistory, len(users))
+	}
+	for username := range users {
+		h, ok := state.Users[username]
+		if !ok {
+			h = &userHistory{FirstSeen: now}
+			state.Users[username] = h
+		}
+		h.LastSeen, h.Disappeared = now, time.Time{}
+	}
+	for username, h := range state.Users {
+		if _, ok := users[username]; !ok && h.Disappeared.IsZero() {
+			h.Disappeared = now
+		}
+	}
+}
+
+// runHistory prints when the users, or all known users, first appeared in and last disappeared from the userlist.
+func runHistory(w io.Writer, args []string) error {
+	if *stateFile == "" {
+		return errors.New("-state-file is required")
+	}
+	if err := loadState(); err != nil {
+		return err
+	}
+	names := args
+	if len(names) == 0 {
+		for username := range state.Users {
+			names = append(names, username)
+		}
+		sort.Strings(names)
+	}
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format(time.RFC3339)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tFIRST SEEN\tLAST SEEN\tDISAPPEARED")
+	for _, username := range names {
+		h, ok := state.Users[username]
+		if !ok {
+			fmt.Fprintf(tw, "%s\tnever\t-\t-\n", username)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", username, format(h.FirstSeen), format(h.LastSeen), format(h.Disappeared))
+	}
+	return tw.Flush()
+}
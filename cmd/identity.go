@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// errClusterChanged is returned when the database has another system identifier than on the previous runs.
+var errClusterChanged = errors.New("source cluster changed identity")
+
+// checkClusterIdentity compares system identifier of the database with the one
+// remembered in the state, so a clone or a logical replica with divergent roles
+// doesn't overwrite the userlist unless -accept-new-cluster is set.
+func checkClusterIdentity(ctx context.Context, db *sql.DB) error {
+	if *simulateRoles > 0 {
+		return nil
+	}
+	var identifier string
+	err := db.QueryRowContext(ctx, `select system_identifier::text from pg_catalog.pg_control_system()`).Scan(&identifier)
+	if isInsufficientPrivilege(err) {
+		log.Printf("[WARN] cluster identity isn't checked: %s\n", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read system identifier: %w", err)
+	}
+	switch {
+	case state.SystemIdentifier == "":
+		state.SystemIdentifier = identifier
+	case state.SystemIdentifier != identifier && *acceptNewCluster:
+		log.Printf("[WARN] source cluster changed identity from %s to %s, accepted\n", state.SystemIdentifier, identifier)
+		state.SystemIdentifier = identifier
+	case state.SystemIdentifier != identifier:
+		return fmt.Errorf("%w from %s to %s since the last run, check -connection and run with -accept-new-cluster to overwrite the userlist",
+			errClusterChanged, state.SystemIdentifier, identifier)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+)
+
+// runInitMode generates the userlist once without reloading pgbouncer, which
+// is not started yet, and writes the ready sentinel file on success.
+func runInitMode(ctx context.Context, db *sql.DB, exclude []string) error {
+	if err := retargetFromIni(); err != nil {
+		return err
+	}
+	readyFile := *readyFilePath
+	if readyFile == "" {
+		readyFile = *filePath + ".ready"
+	}
+	if err := os.Remove(readyFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if _, _, err := generateUserList(ctx, db, *filePath, exclude, nil); err != nil {
+		return err
+	}
+	if err := os.Remove(*reloadTriggerFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	users, errRead := readUserList(*filePath)
+	if errRead != nil {
+		return errRead
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("%s doesn't contain any users", *filePath)
+	}
+	if err := os.WriteFile(readyFile, nil, 0600); err != nil {
+		return err
+	}
+	log.Printf("[INFO] %s is ready with %d users\n", *filePath, len(users))
+	return nil
+}
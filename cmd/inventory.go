@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fleetHost is a pgbouncer host which receives the generated userlist.
+type fleetHost struct {
+	Name          string `json:"name" yaml:"name"`
+	Address       string `json:"address" yaml:"address"`
+	User          string `json:"user" yaml:"user"`
+	Port          int    `json:"port" yaml:"port"`
+	Path          string `json:"path" yaml:"path"`
+	ReloadCommand string `json:"reload_command" yaml:"reload_command"`
+}
+
+type inventory struct {
+	Hosts []fleetHost `json:"hosts" yaml:"hosts"`
+}
+
+// readInventory loads hosts from JSON, YAML or ansible INI inventory, chosen by file extension.
+// Path and reload command of hosts default to -path and -reload-command.
+func readInventory(path string) ([]fleetHost, error) {
+	path = filepath.Clean(path)
+	var hosts []fleetHost
+	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".json", ".yml", ".yaml":
+		// nolint:gosec
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var inv inventory
+		if ext == ".json" {
+			err = json.Unmarshal(data, &inv)
+		} else {
+			err = yaml.Unmarshal(data, &inv)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		hosts = inv.Hosts
+	default:
+		var err error
+		if hosts, err = readAnsibleInventory(path); err != nil {
+			return nil, err
+		}
+	}
+	for i := range hosts {
+		h := &hosts[i]
+		if h.Address == "" {
+			h.Address = h.Name
+		}
+		if h.Name == "" {
+			h.Name = h.Address
+		}
+		if h.Path == "" {
+			h.Path = *filePath
+		}
+		if h.ReloadCommand == "" {
+			h.ReloadCommand = *reloadCommand
+		}
+	}
+	return hosts, nil
+}
+
+// readAnsibleInventory parses host lines of ansible INI inventory,
+// group headers are ignored and group variables sections are skipped.
+func readAnsibleInventory(path string) ([]fleetHost, error) {
+	// nolint:gosec
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// nolint:errcheck,gosec
+	defer fd.Close()
+	var hosts []fleetHost
+	seen := make(map[string]bool)
+	skip := false
+	scanner := bufio.NewScanner(fd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			skip = strings.HasSuffix(line, ":vars]") || strings.HasSuffix(line, ":children]")
+			continue
+		}
+		if skip {
+			continue
+		}
+		fields, errSplit := splitShellWords(line)
+		if errSplit != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, errSplit)
+		}
+		h := fleetHost{Name: fields[0]}
+		for _, field := range fields[1:] {
+			idx := strings.Index(field, "=")
+			if idx < 0 {
+				continue
+			}
+			key, value := field[:idx], field[idx+1:]
+			switch key {
+			case "ansible_host":
+				h.Address = value
+			case "ansible_user":
+				h.User = value
+			case "ansible_port":
+				if h.Port, err = strconv.Atoi(value); err != nil {
+					return nil, fmt.Errorf("%s:%d: ansible_port: %w", path, n, err)
+				}
+			case "userlist_path":
+				h.Path = value
+			case "reload_command":
+				h.ReloadCommand = value
+			}
+		}
+		if !seen[h.Name] {
+			seen[h.Name] = true
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+// splitShellWords splits line by spaces keeping single or double quoted parts together.
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var b strings.Builder
+	var quote byte
+	inWord := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			b.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, b.String())
+				b.Reset()
+				inWord = false
+			}
+		default:
+			b.WriteByte(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		words = append(words, b.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// labelNameRe matches prometheus label names.
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// runLabels are -cluster and -labels key-values attached to logs, metrics, reports and notifications.
+var runLabels = make(map[string]string)
+
+// setupLabels parses -labels, log lines are prefixed with them by setupLogging.
+func setupLabels() error {
+	if *cluster != "" {
+		runLabels["cluster"] = *cluster
+	}
+	for _, pair := range strings.Split(*labels, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			return fmt.Errorf("label %q must be key=value", pair)
+		}
+		key, value := strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+		if !labelNameRe.MatchString(key) || strings.HasPrefix(key, "__") {
+			return fmt.Errorf("invalid label name %q", key)
+		}
+		// job and instance are the grouping labels of -pushgateway-url set by -pushgateway-job and -pushgateway-instance.
+		if key == "job" || key == "instance" {
+			return fmt.Errorf("label %q is reserved for the pushgateway grouping", key)
+		}
+		if _, ok := runLabels[key]; ok {
+			return fmt.Errorf("duplicate label %q", key)
+		}
+		runLabels[key] = value
+	}
+	return nil
+}
+
+// labelNames returns sorted names of the labels.
+func labelNames() []string {
+	names := make([]string, 0, len(runLabels))
+	for name := range runLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatLabels joins key=value pairs of the labels with the separator.
+func formatLabels(sep string) string {
+	pairs := make([]string, 0, len(runLabels))
+	for _, name := range labelNames() {
+		pairs = append(pairs, name+"="+runLabels[name])
+	}
+	return strings.Join(pairs, sep)
+}
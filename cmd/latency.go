@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// measurePropagation sets the time from the commit of the oldest change of added and updated
+// roles to now, when the change is applied, from commit timestamps of their pg_authid rows.
+// Changes committed before track_commit_timestamp was enabled have no timestamps.
+func measurePropagation(ctx context.Context, db *sql.DB, report *runReport) error {
+	names := append(append([]string{}, report.Added...), report.Updated...)
+	if len(names) == 0 || *simulateRoles > 0 {
+		return nil
+	}
+	var committed pq.NullTime
+	err := db.QueryRowContext(ctx, `
+select min(pg_xact_commit_timestamp(xmin))
+from pg_authid
+where rolname = any($1)
+`, pq.Array(names)).Scan(&committed)
+	if err != nil || !committed.Valid {
+		return err
+	}
+	if latency := time.Since(committed.Time); latency > 0 {
+		report.PropagationLatency = latency
+	}
+	return nil
+}
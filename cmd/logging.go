@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	logTargetStderr   = "stderr"
+	logTargetSyslog   = "syslog"
+	logTargetJournald = "journald"
+)
+
+// logLevels orders levels of "[LEVEL] message" lines, lines without level come from log.Fatalf.
+var logLevels = map[string]int{"debug": 0, "info": 1, "warn": 2, "error": 3, "fatal": 4}
+
+// logFieldRe matches key=value tokens of log messages extracted as fields of structured logs.
+var logFieldRe = regexp.MustCompile(`^([a-z_][a-z0-9_]*)=(\S+)$`)
+
+// logEntry is a parsed line of the standard logger.
+type logEntry struct {
+	ts     time.Time
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+// logSink writes entries to -log-target.
+type logSink interface {
+	writeEntry(e *logEntry) error
+}
+
+// logWriter parses "[LEVEL] message key=value" lines of the standard logger, drops lines
+// below -log-level and writes the rest to the sink.
+type logWriter struct {
+	mu    sync.Mutex
+	level int
+	sink  logSink
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	e := parseLogLine(string(p))
+	if logLevels[e.level] < w.level {
+		return len(p), nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.sink.writeEntry(e); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func parseLogLine(line string) *logEntry {
+	e := &logEntry{ts: time.Now(), level: "fatal", msg: strings.TrimRight(line, "\n"), fields: make(map[string]interface{})}
+	if strings.HasPrefix(e.msg, "[") {
+		if i := strings.Index(e.msg, "] "); i > 0 {
+			if _, ok := logLevels[strings.ToLower(e.msg[1:i])]; ok {
+				e.level, e.msg = strings.ToLower(e.msg[1:i]), e.msg[i+2:]
+			}
+		}
+	}
+	for name, value := range runLabels {
+		e.fields[name] = value
+	}
+	for _, token := range strings.Fields(e.msg) {
+		m := logFieldRe.FindStringSubmatch(strings.TrimRight(token, ",;"))
+		if m == nil {
+			continue
+		}
+		if n, err := strconv.ParseInt(m[2], 10, 64); err == nil {
+			e.fields[m[1]] = n
+		} else {
+			e.fields[m[1]] = m[2]
+		}
+	}
+	return e
+}
+
+// text renders the entry the way the standard logger does, labels are the prefix of the message.
+func (e *logEntry) text() string {
+	prefix := ""
+	if len(runLabels) > 0 {
+		prefix = formatLabels(" ") + " "
+	}
+	if e.level == "fatal" {
+		return prefix + e.msg
+	}
+	return prefix + "[" + strings.ToUpper(e.level) + "] " + e.msg
+}
+
+// json renders the entry as json object with ts, level, msg, labels and fields.
+func (e *logEntry) json() ([]byte, error) {
+	entry := make(map[string]interface{}, len(e.fields)+3)
+	for name, value := range e.fields {
+		entry[name] = value
+	}
+	entry["ts"], entry["level"], entry["msg"] = e.ts.UTC().Format(time.RFC3339Nano), e.level, e.msg
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(entry); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(b.Bytes(), "\n"), nil
+}
+
+// format renders the entry in -log-format.
+func (e *logEntry) format() (string, error) {
+	if *logFormat != logFormatJSON {
+		return e.text(), nil
+	}
+	data, err := e.json()
+	return string(data), err
+}
+
+// streamSink writes timestamped text or json lines to the stream.
+type streamSink struct {
+	out io.Writer
+}
+
+func (s *streamSink) writeEntry(e *logEntry) error {
+	line, err := e.format()
+	if err != nil {
+		return err
+	}
+	if *logFormat != logFormatJSON {
+		line = e.ts.Format("2006/01/02 15:04:05") + " " + line
+	}
+	_, err = io.WriteString(s.out, line+"\n")
+	return err
+}
+
+// setupLogging routes the standard logger through -log-level, -log-format and -log-target.
+func setupLogging() error {
+	level, ok := logLevels[strings.ToLower(*logLevel)]
+	if !ok || level == logLevels["fatal"] {
+		return fmt.Errorf("unknown -log-level %q, expected debug, info, warn or error", *logLevel)
+	}
+	switch *logFormat {
+	case logFormatText, logFormatJSON:
+	default:
+		return fmt.Errorf("unknown -log-format %q, expected %s or %s", *logFormat, logFormatText, logFormatJSON)
+	}
+	var sink logSink
+	switch *logTarget {
+	case logTargetStderr:
+		sink = &streamSink{out: os.Stderr}
+	case logTargetSyslog, logTargetJournald:
+		var err error
+		if sink, err = openLogSink(*logTarget); err != nil {
+			return fmt.Errorf("-log-target %s: %w", *logTarget, err)
+		}
+	default:
+		return fmt.Errorf("unknown -log-target %q, expected %s, %s or %s", *logTarget, logTargetStderr, logTargetSyslog, logTargetJournald)
+	}
+	log.SetPrefix("")
+	log.SetFlags(0)
+	log.SetOutput(&logWriter{level: level, sink: sink})
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "errors"
+
+func openLogSink(string) (logSink, error) {
+	return nil, errors.New("is not supported on this platform")
+}
@@ -0,0 +1,102 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// journaldSocket is the socket of the native journal protocol.
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldPriorities are syslog priorities of the levels.
+var journaldPriorities = map[string]int{"debug": 7, "info": 6, "warn": 4, "error": 3, "fatal": 2}
+
+// journaldFieldRe matches valid journal field names.
+var journaldFieldRe = regexp.MustCompile(`^[A-Z0-9][A-Z0-9_]*$`)
+
+func openLogSink(target string) (logSink, error) {
+	if target == logTargetSyslog {
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, generatorUnit)
+		if err != nil {
+			return nil, err
+		}
+		return &syslogSink{w: w}, nil
+	}
+	conn, err := net.Dial("unixgram", journaldSocket)
+	if err != nil {
+		return nil, err
+	}
+	return &journaldSink{conn: conn}, nil
+}
+
+// syslogSink writes text or json messages with the priority of the level, syslog adds the timestamp.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func (s *syslogSink) writeEntry(e *logEntry) error {
+	msg, err := e.format()
+	if err != nil {
+		return err
+	}
+	switch e.level {
+	case "debug":
+		return s.w.Debug(msg)
+	case "info":
+		return s.w.Info(msg)
+	case "warn":
+		return s.w.Warning(msg)
+	case "error":
+		return s.w.Err(msg)
+	default:
+		return s.w.Crit(msg)
+	}
+}
+
+// journaldSink sends entries with the native journal protocol, fields and labels become
+// upper case journal fields, so -log-format doesn't apply.
+type journaldSink struct {
+	conn net.Conn
+}
+
+func (s *journaldSink) writeEntry(e *logEntry) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", e.text())
+	writeJournalField(&b, "PRIORITY", fmt.Sprint(journaldPriorities[e.level]))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", generatorUnit)
+	names := make([]string, 0, len(e.fields))
+	for name := range e.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field := strings.ToUpper(name)
+		if !journaldFieldRe.MatchString(field) || field == "MESSAGE" || field == "PRIORITY" || field == "SYSLOG_IDENTIFIER" {
+			continue
+		}
+		writeJournalField(&b, field, fmt.Sprint(e.fields[name]))
+	}
+	_, err := s.conn.Write(b.Bytes())
+	return err
+}
+
+// writeJournalField appends the field, values with new lines are length prefixed.
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		b.WriteString(name + "=" + value + "\n")
+		return
+	}
+	b.WriteString(name + "\n")
+	// nolint:errcheck,gosec
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value + "\n")
+}
@@ -2,157 +2,612 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
 	"database/sql"
-	"encoding/hex"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"sort"
 	"strings"
 	"time"
 
-	"github.com/lib/pq"
+	"github/vadv/pgbouncer-userlist-generator/catalog"
+	"github/vadv/pgbouncer-userlist-generator/userlist"
 )
 
 var (
+	configFile        = flag.String("config", "", "path to yaml or toml config file with flag names as keys, overridden by "+envPrefix+"* env vars and flags, and a notifications section with notifiers (webhook, slack, pagerduty, command, email) and routes of failure, change and freshness events to them")
 	connectionString  = flag.String("connection", "", "connection string to database")
 	filePath          = flag.String("path", "/etc/pgbouncer/userlist.txt", "path to userlist.txt file")
 	excludeAccounts   = flag.String("exclude", "postgres,replicator,monitor", "exclude users from userlist.txt file")
 	reloadTriggerFile = flag.String("reload-trigger-file", "/tmp/pgbouncer-userlist-generator.trigger", "path to trigger file")
-	reloadCommand     = flag.String("reload-command", "systemctl reload pgbouncer", "command to reload")
+	reloadCommand     = flag.String("reload-command", "systemctl reload pgbouncer", "command to reload, supports placeholders {{.Path}}, {{.Users}}, {{.ChangedCount}}, {{.Added}}, {{.Removed}}, {{.Updated}} with shell quoted values")
+	reloadTimeout     = flag.Duration("reload-timeout", 30*time.Second, "timeout of reload command, its whole process group is killed on timeout")
+	pgbouncerIniPath  = flag.String("pgbouncer-ini", "/etc/pgbouncer/pgbouncer.ini", "path to pgbouncer.ini file")
+	pgbouncerUnit     = flag.String("pgbouncer-unit", "pgbouncer", "systemd unit of pgbouncer")
+	pgbouncerVersion  = flag.String("pgbouncer-version", "", "version of pgbouncer reading the userlist, like 1.21, checked for SCRAM-SHA-256 support, defaults to the version of pgbouncer in PATH")
+	reloadPidfile     = flag.String("reload-pidfile", "", "reload pgbouncer with SIGHUP to pids of comma separated pidfiles, one per peer, instead of -reload-command")
+	reloadProcess     = flag.String("reload-process", "", "reload pgbouncer with SIGHUP to processes with the name, like pgbouncer, instead of -reload-command (linux only)")
+	reloadAdmin       = flag.String("reload-admin", "", "connection string to pgbouncer admin console, reload pgbouncer with RELOAD in it instead of -reload-command or SIGHUP")
+	reloadAdminPorts  = flag.String("reload-admin-ports", "", "comma separated ports of pgbouncer peers, RELOAD is sent to -reload-admin on each of them, after SIGHUP reloads each of them is checked to list users of -path with SHOW USERS in -pgbouncer-admin")
+	canaryConnection  = flag.String("canary-connection", "", "connection string of a canary user through pgbouncer, logged in after reloads to verify the userlist, a failed login exits with code 3")
+	canaryTimeout     = flag.Duration("canary-timeout", 10*time.Second, "time the canary login is retried while pgbouncer applies the reload")
+	rollbackOnFailure = flag.Bool("rollback-on-failure", false, "move the backup made by the run back over -path and reload again when the reload or the canary login fails")
+	skipFormatReload  = flag.Bool("skip-formatting-reload", false, "update -path without reloading pgbouncer when users and passwords are the same and only ordering or comments have changed")
+	measureLatency    = flag.Bool("propagation-latency", false, "measure time from the commit of changed roles to the applied userlist, needs track_commit_timestamp = on")
+	strict            = flag.Bool("strict", false, "fail runs on warnings about roles instead of skipping or writing them, like duplicate plain text passwords, names or secrets which can't be written or unknown role settings")
+	allowedRoot       = flag.String("allowed-root", "", "directory, like /etc/pgbouncer, outside of which userlist files and shards are never written, symlinks are followed")
+	bootstrapReload   = flag.String("bootstrap-reload", bootstrapAlways, "whether the run creating -path reloads pgbouncer: always, never, or if-running when the pgbouncer unit or process is running")
+	initMode          = flag.Bool("init-mode", false, "generate userlist once without reload and write ready file, for usage in init containers")
+	auditGitRepo      = flag.String("audit-git-repo", "", "path to git repository where userlist changes are committed")
+	auditGitMode      = flag.String("audit-git-mode", auditManifest, "what is committed to audit git repository: manifest (user names only) or full")
+	retries           = flag.Int("retries", 0, "number of times a failed run is retried")
+	retryDelay        = flag.Duration("retry-delay", 10*time.Second, "delay between retries of a failed run")
+	onFailureCommand  = flag.String("on-failure-command", "", "command executed when a run fails, with PGBOUNCER_USERLIST_ERROR_CLASS and PGBOUNCER_USERLIST_ERROR env vars")
+	onFailureTimeout  = flag.Duration("on-failure-timeout", 30*time.Second, "timeout of on failure command")
+	outputFormat      = flag.String("output", outputText, "format of the run result printed to stdout: text, json or ansible")
+	markerDir         = flag.String("marker-dir", "", "directory for healthy and ready marker files touched after each successful run")
+	authFileFromIni   = flag.Bool("auth-file-from-ini", false, "write userlist to auth_file of -pgbouncer-ini, re-read on every run, instead of -path")
+	listenChannel     = flag.String("listen-channel", "", "keep running and regenerate userlist on notifications of the channel, see listen-sql command")
+	dryRun            = flag.Bool("dry-run", false, "print changes the run would make to -path and exit without writing the userlist, backups or the trigger file")
+	daemon            = flag.Bool("daemon", false, "keep running and regenerate userlist every -interval, connections are reused until database host names resolve to other addresses")
+	interval          = flag.Duration("interval", time.Minute, "interval of runs in daemon mode")
+	clustersFile      = flag.String("clusters-file", "", "path to yaml file with a list of clusters with name and connection, their users are merged into users of -connection")
+	mergeConflict     = flag.String("merge-conflict", mergeFirstWins, "what to do with roles having different secrets in several clusters: first-wins in -connection and -clusters-file order, fail, or prefer:<cluster>")
+	shadowConfig      = flag.String("shadow-config", "", "path to yaml or toml file with options of a new configuration, like exclude or include-regex, users are generated with it on every run and differences are logged, only the current configuration is written")
+	freshnessSLO      = flag.Duration("freshness-slo", 0, "max time the userlist may not reflect the database, like 5m, breaches are logged, exported as metrics and sent as freshness notifications")
+	maxInterval       = flag.Duration("max-interval", 0, "adapt the interval of runs in daemon mode: it doubles after runs without changes up to this value and is back to -interval after a change")
+	recoveryPolicy    = flag.String("recovery-policy", recoveryContinue, "what to do when the connected node is in recovery after a failover: continue with a warning, pause runs, or primary to run on the primary among -connection hosts")
+	healthListen      = flag.String("health-listen", "", "address of http server with /healthz and /readyz endpoints of long-running processes, like :8080")
+	healthMaxAgeFlag  = flag.Duration("health-max-age", 0, "time without successful runs after which /healthz fails, defaults to three -interval or -max-interval")
+	restoreOnTamper   = flag.Bool("restore-on-tamper", false, "keep running after the run and regenerate userlist files as soon as they are modified or deleted externally (linux only)")
+	readyFilePath     = flag.String("ready-file", "", "path to sentinel file written by init mode, defaults to -path with .ready suffix")
+
+	md5Path            = flag.String("md5-path", "", "path to additional userlist file with md5 users only")
+	md5ReloadCommand   = flag.String("md5-reload-command", "", "command to reload pgbouncer using -md5-path")
+	scramPath          = flag.String("scram-path", "", "path to additional userlist file with scram-sha-256 users only")
+	scramReloadCommand = flag.String("scram-reload-command", "", "command to reload pgbouncer using -scram-path")
+	scramPolicy        = flag.String("scram", scramAllow, "what to do with users with SCRAM-SHA-256 secrets: allow, skip them, or fail the run")
+	subsetsFile        = flag.String("subsets-file", "", "path to yaml file with additional pgbouncer, odyssey or pgcat outputs of users selected by name patterns and password type")
+	replicaPaths       = flag.String("replica-paths", "", "comma separated paths of copies of userlist, like in chroots of several pgbouncers, each backed up and reloaded on its own")
+	replicaReload      = flag.String("replica-reload-command", "", "command to reload pgbouncer of a -replica-paths copy, {{.Path}} is the path of the copy, defaults to -reload-command")
+
+	tenantRegex         = flag.String("tenant-regex", "", "regular expression capturing the tenant of roles in the group named tenant or the first group, like ^([a-z0-9]+)_, for -tenant-path")
+	tenantPath          = flag.String("tenant-path", "", "path of userlist files with roles of each tenant, like /etc/pgbouncer/{{.Tenant}}/userlist.txt")
+	tenantReloadCommand = flag.String("tenant-reload-command", "", "command to reload pgbouncer of a tenant, {{.Tenant}} is the tenant and {{.Path}} is the path of its userlist, defaults to -reload-command")
+
+	connectTimeout       = flag.Duration("connect-timeout", 10*time.Second, "timeout of establishing tcp connection to database, 0 waits for the kernel timeout")
+	tcpKeepaliveInterval = flag.Duration("tcp-keepalive-interval", 15*time.Second, "idle time and interval of tcp keepalive probes, negative disables keepalive")
+	tcpKeepaliveCount    = flag.Int("tcp-keepalive-count", 3, "unanswered tcp keepalive probes before the connection is dropped, 0 keeps the kernel default")
+	tcpUserTimeout       = flag.Duration("tcp-user-timeout", 0, "max time transmitted data may remain unacknowledged before the connection is dropped, 0 keeps the kernel default")
+	dnsTTL               = flag.Duration("dns-ttl", 30*time.Second, "max time to cache resolved database addresses, connections are reused until the addresses change, 0 resolves and connects on every run")
+
+	pushgatewayURL      = flag.String("pushgateway-url", "", "url of prometheus pushgateway to push run metrics to")
+	pushgatewayJob      = flag.String("pushgateway-job", "pgbouncer_userlist_generator", "job label of pushed metrics")
+	pushgatewayInstance = flag.String("pushgateway-instance", "", "instance label of pushed metrics, defaults to hostname")
+	cluster             = flag.String("cluster", "", "name of the synced cluster, added as cluster label to metrics and field to logs and reports to tell apart jobs of several clusters")
+	labels              = flag.String("labels", "", "comma separated key=value labels, like env=prod,dc=fra1, added to metrics, logs, reports and notifications, job and instance are reserved")
+	metricsTextfile     = flag.String("metrics-textfile", "", "path to .prom file in node_exporter textfile collector directory the run metrics are written to")
+
+	inventoryPath = flag.String("inventory", "", "path to json, yaml or ansible ini inventory of pgbouncer hosts for fleet command")
+	fleetParallel = flag.Int("fleet-parallel", 4, "number of hosts updated concurrently by fleet command")
+	fleetTimeout  = flag.Duration("fleet-timeout", time.Minute, "timeout of updating a single host by fleet command")
+	citusSSHUser  = flag.String("citus-ssh-user", "", "ssh user for citus workers of citus command, defaults to ssh configuration")
+	sshOptions    = flag.String("ssh-options", "-o BatchMode=yes -o ConnectTimeout=10", "options passed to ssh by fleet command")
+
+	doubleRead             = flag.Bool("double-read", false, "read users again over a separate connection and apply changes only if both reads agree")
+	verifyConnectionString = flag.String("verify-connection", "", "connection string of the second read of -double-read, possibly to another host, defaults to -connection")
+	snapshot               = flag.Bool("snapshot", false, "read users in a repeatable read transaction and record its wal lsn and time in the report and a comment of the userlist")
+
+	standbyConnectionString = flag.String("standby-connection", "", "connection string to standby for check-standby command")
+	maxReplicationLag       = flag.Duration("max-replication-lag", time.Minute, "how long check-standby command waits for the standby to replay wal of the primary before roles differing on it are reported as lag")
+
+	stateFile         = flag.String("state-file", "", "path to json file keeping failure streak and circuit breaker state between runs")
+	circuitFailures   = flag.Int("circuit-failures", 0, "consecutive failed runs after which runs are suspended for -circuit-backoff, 0 disables the circuit breaker")
+	circuitBackoff    = flag.Duration("circuit-backoff", 10*time.Minute, "time runs are suspended for when the circuit opens, doubled on every failure after it")
+	circuitMaxBackoff = flag.Duration("circuit-max-backoff", 4*time.Hour, "max time runs are suspended for by the circuit breaker")
+	controlSocket     = flag.String("control-socket", "", "path to unix socket of long-running processes accepting status, run, pause and resume commands of ctl command")
+	freezeWindows     = flag.String("freeze-windows", "", "\";\" separated windows of 5 cron fields and duration, like \"0 0 24 11 * 96h\", when changes are reported but not applied")
+	requireApproval   = flag.Bool("require-approval", false, "stage changes of the userlist in <path>.pending until approve command, requires -state-file for one-shot runs")
+	alertAfter        = flag.Int("alert-after", 1, "consecutive failed runs after which -on-failure-command is invoked")
+	acceptNewCluster  = flag.Bool("accept-new-cluster", false, "overwrite the userlist when system identifier of the database differs from the one remembered in the state")
+
+	odysseyPath          = flag.String("odyssey-path", "", "path to odyssey config file with user rules, to be included into odyssey.conf")
+	odysseyReloadCommand = flag.String("odyssey-reload-command", "", "command to reload odyssey using -odyssey-path, e.g. pkill -HUP odyssey")
+	odysseyDatabase      = flag.String("odyssey-database", "default", "database of odyssey user rules")
+	odysseyStorage       = flag.String("odyssey-storage", "postgres_server", "storage of odyssey user rules")
+	odysseyPool          = flag.String("odyssey-pool", "transaction", "pool mode of odyssey user rules")
+
+	pgcatPath          = flag.String("pgcat-path", "", "path to pgcat toml file with users of -pgcat-pool")
+	pgcatReloadCommand = flag.String("pgcat-reload-command", "", "command to reload pgcat using -pgcat-path, e.g. pkill -HUP pgcat")
+	pgcatAdmin         = flag.String("pgcat-admin", "", "connection string to pgcat admin database, RELOAD is sent to it when -pgcat-reload-command is empty")
+	pgcatPool          = flag.String("pgcat-pool", "default", "pool of pgcat users")
+	pgcatPoolSize      = flag.Int("pgcat-pool-size", 20, "pool_size of pgcat users")
+	pgcatPoolMode      = flag.String("pgcat-pool-mode", "", "pool_mode of pgcat users, empty inherits the pool setting")
+
+	simulateRoles = flag.Int("simulate-roles", 0, "generate the number of synthetic roles instead of reading the database, to benchmark write, compare and reload")
+	simulateChurn = flag.Float64("simulate-churn", 0.01, "share of synthetic roles whose passwords change on every run")
+
+	mappingFile      = flag.String("mapping-file", "", "path to yaml file with rules rewriting role names, roles mapped to the same name are merged and take the password of the role set as source of the rule")
+	fallbackRelation = flag.String("fallback-relation", "", "relation with usename and passwd columns, like pg_shadow or a security definer view, read when pg_authid access is denied")
+
+	plaintextFile     = flag.String("plaintext-file", "", "path to userlist formatted file with plain text passwords of roles managed outside of pg_authid, written hashed with md5")
+	managedRolesTable = flag.String("managed-roles-table", "", "relation, like pgbouncer.managed_roles, with rolname and mode columns read on every run: roles with mode exclude and their members are left out, with mode include only they are written")
+	plaintextRelation = flag.String("plaintext-relation", "", "relation with usename and passwd columns with plain text passwords of roles managed outside of pg_authid, written hashed with md5")
+
+	pgbouncerAdmin = flag.String("pgbouncer-admin", "", "connection string to pgbouncer admin console, clients are sampled with SHOW CLIENTS on every run for stale command")
+	staleAfter     = flag.Duration("stale-after", 30*24*time.Hour, "time without connections after which stale command reports the user")
+
+	shardDir = flag.String("shard-dir", "", "directory where userlist is additionally written split by name hash into -shards files and index.txt, switched atomically with current symlink")
+	shards   = flag.Int("shards", 16, "number of userlist files in -shard-dir")
+
+	cacheFile    = flag.String("cache-file", "", "path to file caching users of the last successful run encrypted, restored to -path when the database is unavailable")
+	cacheKeyFile = flag.String("cache-key-file", "", "path to file with secret encrypting -cache-file")
+
+	authQuerySample = flag.Int("auth-query-sample", 20, "number of users check-auth-query command looks up with auth_query, 0 looks up all users")
+	hybridAuth      = flag.Bool("hybrid-auth", false, "write only auth_user, admin_users and stats_users of -pgbouncer-ini to the userlist, other users are looked up with auth_query, see check-hybrid command")
+	authUser        = flag.String("auth-user", "", "write only the user to the userlist, for pgbouncer with auth_user looking up other users with auth_query, see auth-query-sql command")
+
+	skipSystemRoles = flag.Bool("skip-system-roles", false, "skip roles created by initdb (oid below 16384) and pg_* predefined roles, including ones added by future postgres versions")
+	skipSuperusers  = flag.Bool("skip-superusers", false, "skip superuser roles, so they can't log in through pgbouncer")
+	onlyLoginRoles  = flag.Bool("only-login-roles", false, "skip roles without login attribute, postgres rejects their logins anyway")
+	skipReplication = flag.Bool("skip-replication-roles", false, "skip roles with replication attribute")
+	skipExpired     = flag.Bool("skip-expired", false, "skip roles whose password expired by rolvaliduntil, postgres rejects their logins")
+	expiringWithin  = flag.Duration("skip-expiring-within", 0, "skip roles whose password expires within the duration, like 24h, implies -skip-expired")
+	memberOf        = flag.String("member-of", "", "comma separated group roles, when set only roles granted membership in any of them directly are written to userlist")
+	includeAccounts = flag.String("include", "", "comma separated users, when set only they are written to userlist and -exclude must not be set")
+	excludeRegex    = flag.String("exclude-regex", "", "regular expression of role names left out of userlist, like ^(svc|tmp)_, matched after the query")
+	includeRegex    = flag.String("include-regex", "", "regular expression of role names, when set only matching roles are written to userlist, matched after the query")
+
+	roleSettings = flag.Bool("role-settings", false, "read pgbouncer.* settings of roles, pgbouncer.userlist = off leaves the role out, [users] settings like pgbouncer.pool_mode go to -users-ini-path")
+	usersIniPath = flag.String("users-ini-path", "", "path to pgbouncer ini file with [users] section, to be included at the end of pgbouncer.ini with %include")
+	usersTable   = flag.String("users-table", "", "relation with rolname, setting and value columns of [users] settings like pool_mode written to -users-ini-path, overriding -role-settings")
+
+	hbaPath          = flag.String("hba-path", "", "path to hba file generated for pgbouncer with auth_type = hba and auth_hba_file, from -hba-rules or -hba-table")
+	hbaReloadCommand = flag.String("hba-reload-command", "", "command to reload pgbouncer using -hba-path, defaults to -reload-command")
+	hbaRulesFile     = flag.String("hba-rules", "", "path to yaml file with a list of hba rules with type, database, user, address and method, user may be a glob pattern of generated users")
+	hbaTable         = flag.String("hba-table", "", "relation with line_number, type, database, user_name, address and auth_method columns of hba rules read on every run")
+
+	logFormat = flag.String("log-format", logFormatText, "format of logs, text or json lines with level, ts, msg, labels and key=value fields for loki or elk")
+	logLevel  = flag.String("log-level", "info", "minimal level of logs, debug adds sql timings, row counts and file comparison decisions, or info, warn, error")
+	logTarget = flag.String("log-target", logTargetStderr, "where logs go, stderr, syslog, or journald with labels and key=value fields as journal fields")
 )
 
+// commandTimeout bounds a run and commands reading the database, commands working through
+// many hosts or databases bound each of them instead.
+const commandTimeout = time.Minute
+
 func main() {
 	flag.Parse()
-	db, errOpen := sql.Open(`postgres`, *connectionString)
+	command := flag.Arg(0)
+	var args []string
+	if flag.NArg() > 1 {
+		var err error
+		if args, err = parseCommandArgs(flag.Args()[1:]); err != nil {
+			log.Fatalf("%s: %s\n", command, err)
+		}
+		if len(args) > 0 && !commandArgs[command] {
+			log.Fatalf("%s: unexpected arguments %q\n", command, args)
+		}
+	}
+	if err := resolveConfig(); err != nil {
+		log.Fatalf("config: %s\n", err)
+	}
+	if err := setupLabels(); err != nil {
+		log.Fatalf("labels: %s\n", err)
+	}
+	if err := setupLogging(); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if err := validateRecoveryPolicy(); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if err := validateInclude(); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if err := validateBootstrapReload(); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if err := validateScram(); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if err := validateHBA(); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if err := validateTenants(); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if err := validateFreezeWindows(); err != nil {
+		log.Fatalf("-freeze-windows: %s\n", err)
+	}
+	var errFetcher error
+	if runFetcher, errFetcher = newFetcher(nil); errFetcher != nil {
+		log.Fatalf("%s\n", errFetcher)
+	}
+	if err := validateOutput(); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if err := validateFaults(); err != nil {
+		log.Fatalf("%s\n", err)
+	}
+	if err := validateNotifications(); err != nil {
+		log.Fatalf("notifications: %s\n", err)
+	}
+	db, errOpen := openDB(*connectionString)
 	if errOpen != nil {
 		log.Fatalf("open connection: %s\n", errOpen)
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
 	defer cancel()
-	if errGenerate := generateUserList(ctx, db, *filePath, strings.Split(*excludeAccounts, ",")); errGenerate != nil {
-		log.Fatalf("generate userlist: %s\n", errGenerate)
+	switch command {
+	case "", "generate":
+	case "watch":
+		*daemon = true
+	case "verify":
+		if err := runVerify(ctx, db, os.Stdout, strings.Split(*excludeAccounts, ",")); err != nil {
+			log.Fatalf("verify: %s\n", err)
+		}
+		return
+	case "diff":
+		if err := runDiff(ctx, db, os.Stdout, strings.Split(*excludeAccounts, ","), args); err != nil {
+			log.Fatalf("diff: %s\n", err)
+		}
+		return
+	case "export":
+		if err := runExport(ctx, db, os.Stdout, strings.Split(*excludeAccounts, ","), args); err != nil {
+			log.Fatalf("export: %s\n", err)
+		}
+		return
+	case "restore":
+		if err := runRestore(args); err != nil {
+			log.Fatalf("restore: %s\n", err)
+		}
+		return
+	case "preflight":
+		if err := runPreflight(ctx, db); err != nil {
+			log.Fatalf("preflight: %s\n", err)
+		}
+		return
+	case "doctor":
+		if err := runDoctor(); err != nil {
+			log.Fatalf("doctor: %s\n", err)
+		}
+		return
+	case "check-auth-query":
+		if err := runCheckAuthQuery(ctx, db, os.Stdout, strings.Split(*excludeAccounts, ",")); err != nil {
+			log.Fatalf("check auth query: %s\n", err)
+		}
+		return
+	case "check-hybrid":
+		if err := runCheckHybrid(ctx, db, os.Stdout, strings.Split(*excludeAccounts, ",")); err != nil {
+			log.Fatalf("check hybrid: %s\n", err)
+		}
+		return
+	case "check-standby":
+		if err := runCheckStandby(context.Background(), db, strings.Split(*excludeAccounts, ",")); err != nil {
+			log.Fatalf("check standby: %s\n", err)
+		}
+		return
+	case "fleet":
+		if err := runFleet(context.Background(), db, strings.Split(*excludeAccounts, ",")); err != nil {
+			log.Fatalf("fleet: %s\n", err)
+		}
+		return
+	case "citus":
+		if err := runCitus(context.Background(), db, strings.Split(*excludeAccounts, ",")); err != nil {
+			log.Fatalf("citus: %s\n", err)
+		}
+		return
+	case "terraform":
+		if err := runTerraform(ctx, db, os.Stdin, os.Stdout); err != nil {
+			log.Fatalf("terraform: %s\n", err)
+		}
+		return
+	case "explain":
+		if err := runExplain(ctx, db, os.Stdout, strings.Split(*excludeAccounts, ","), args); err != nil {
+			log.Fatalf("explain: %s\n", err)
+		}
+		return
+	case "config":
+		if err := runConfig(os.Stdout, args); err != nil {
+			log.Fatalf("config: %s\n", err)
+		}
+		return
+	case "ctl":
+		if err := runCtl(os.Stdout, args); err != nil {
+			log.Fatalf("ctl: %s\n", err)
+		}
+		return
+	case "support-bundle":
+		if err := runSupportBundle(os.Stdout, args); err != nil {
+			log.Fatalf("support bundle: %s\n", err)
+		}
+		return
+	case "stale":
+		if err := runStale(ctx, os.Stdout); err != nil {
+			log.Fatalf("stale: %s\n", err)
+		}
+		return
+	case "listen-sql":
+		if *listenChannel == "" {
+			log.Fatalf("listen sql: -listen-channel is required\n")
+		}
+		if err := runListenSQL(os.Stdout); err != nil {
+			log.Fatalf("listen sql: %s\n", err)
+		}
+		return
+	case "auth-query-sql":
+		if err := runAuthQuerySQL(os.Stdout); err != nil {
+			log.Fatalf("auth query sql: %s\n", err)
+		}
+		return
+	case "install-auth-query":
+		if err := runInstallAuthQuery(context.Background(), db, os.Stdout); err != nil {
+			log.Fatalf("install auth query: %s\n", err)
+		}
+		return
+	case "history":
+		if err := runHistory(os.Stdout, args); err != nil {
+			log.Fatalf("history: %s\n", err)
+		}
+		return
+	case "pending":
+		if err := runPending(os.Stdout); err != nil {
+			log.Fatalf("pending: %s\n", err)
+		}
+		return
+	case "approve":
+		if *stateFile == "" {
+			log.Fatalf("approve: -state-file is required\n")
+		}
+		if err := approveAndRun(db, strings.Split(*excludeAccounts, ",")); err != nil {
+			log.Fatalf("approve: %s\n", err)
+		}
+		return
+	case "pause", "resume", "freeze", "unfreeze":
+		if err := runPause(os.Stdout, command, args); err != nil {
+			log.Fatalf("%s: %s\n", command, err)
+		}
+		return
+	default:
+		log.Fatalf("unknown command: %q\n", command)
+	}
+	if *daemon && *interval <= 0 {
+		log.Fatalf("-interval must be positive\n")
+	}
+	if *maxInterval != 0 && *maxInterval < *interval {
+		log.Fatalf("-max-interval must not be less than -interval\n")
+	}
+	if *dryRun {
+		if err := runDryRun(ctx, db, os.Stdout, strings.Split(*excludeAccounts, ",")); err != nil {
+			log.Fatalf("dry run: %s\n", err)
+		}
+		return
+	}
+	if *initMode {
+		if err := runInitMode(ctx, db, strings.Split(*excludeAccounts, ",")); err != nil {
+			log.Fatalf("init mode: %s\n", err)
+		}
+		return
 	}
-	// if trigger file exists - run reload.
-	if err := processTriggerFile(); err != nil {
-		log.Fatalf("process trigger file: %s\n", err)
+	report := runCycle(db, strings.Split(*excludeAccounts, ","))
+	if report.Err != nil && !*daemon {
+		if report.ErrClass == errClassCanary {
+			log.Printf("[ERROR] %s\n", report.Err)
+			os.Exit(exitCodeCanary)
+		}
+		log.Fatalf("%s\n", report.Err)
+	}
+	if *daemon || *restoreOnTamper || *listenChannel != "" {
+		if err := serve(db, strings.Split(*excludeAccounts, ",")); err != nil {
+			log.Fatalf("serve: %s\n", err)
+		}
 	}
 }
 
-func generateUserList(ctx context.Context, db *sql.DB, path string, exclude []string) error {
-	tmpConfigPath := path + ".tmp"
-	tx, errTx := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
-	if errTx != nil {
-		return errTx
-	}
-	// nolint:errcheck
-	defer tx.Commit()
-	rows, errRows := tx.QueryContext(ctx, `
-select distinct
-    id.rolname,
-    id.rolpassword
-from pg_authid as id
-    left join pg_catalog.pg_auth_members m on id.oid = m.member
-    left join pg_catalog.pg_roles r on m.roleid = r.oid
-where (r.rolname is null or not(r.rolname::TEXT=any($1))) and id.rolpassword is not null
-`, pq.Array(exclude))
-	if errRows != nil {
-		return errRows
-	}
-	// notlint:errcheck
-	defer rows.Close()
-	var lines []string
-	for rows.Next() {
-		var username, password string
-		if errScan := rows.Scan(&username, &password); errScan != nil {
-			return errScan
-		}
-		lines = append(lines, fmt.Sprintf(`"%s" "%s"`, username, password))
-	}
-	if errRowsClose := rows.Err(); errRowsClose != nil {
-		return errRowsClose
-	}
-	sort.Strings(lines)
-	if errWrite := ioutil.WriteFile(tmpConfigPath, []byte(strings.Join(lines, "\n")+"\n"), 0600); errWrite != nil {
-		return errWrite
-	}
-	// nolint:errcheck
-	defer os.Remove(tmpConfigPath)
-	if _, err := os.Stat(path); err == nil {
-		currentMd5, errCurrentMd5 := calcMd5File(tmpConfigPath)
-		if errCurrentMd5 != nil {
-			return errCurrentMd5
-		}
-		oldMd5, errOldMd5 := calcMd5File(path)
-		if errOldMd5 != nil {
-			return errOldMd5
-		}
-		if currentMd5 == oldMd5 {
-			log.Printf("[INFO] pgbouncer user list files doesn't have any changes, skipping update\n")
-			return nil
-		}
-		if errBackup := copyFile(path,
-			fmt.Sprintf("%s.backup-%d", path, time.Now().UTC().Unix())); errBackup != nil {
-			return errBackup
+// publishReport evaluates freshness, pushes metrics, prints the run result, runs the failure
+// command if alert is set and sends notifications.
+func publishReport(report *runReport, alert bool) {
+	stale := evaluateFreshness(report, time.Now())
+	if err := pushMetrics(report); err != nil {
+		log.Printf("[ERROR] push metrics: %s\n", err)
+	}
+	if err := writeMetricsTextfile(report); err != nil {
+		log.Printf("[ERROR] write metrics textfile: %s\n", err)
+	}
+	if err := printRunResult(os.Stdout, report); err != nil {
+		log.Printf("[ERROR] print result: %s\n", err)
+	}
+	if alert {
+		if err := runFailureCommand(report); err != nil {
+			log.Printf("[ERROR] on failure command: %s\n", err)
 		}
 	}
-	// before rename - write trigger file.
-	if err := writeTriggerFile(); err != nil {
-		return err
+	if err := sendNotifications(report, alert, stale); err != nil {
+		log.Printf("[ERROR] notifications: %s\n", err)
+	}
+}
+
+// runReport describes the outcome of a single run.
+type runReport struct {
+	RunID    string
+	Start    time.Time
+	Duration time.Duration
+	Phases   userlist.Timings
+	Snapshot *catalog.Snapshot
+	Users    int
+	Changed  bool
+	Added    []string
+	Removed  []string
+	Updated  []string
+	Attempts int
+	// CircuitOpen is set when runs are suspended after consecutive failures.
+	CircuitOpen bool
+	// Paused is set when the run is skipped by the pause command.
+	Paused bool
+	// Frozen is set when changes are computed but not applied in a freeze window.
+	Frozen bool
+	// PendingApproval is set when changes are staged for the approve command.
+	PendingApproval bool
+	// DryRun is set when changes are computed by -dry-run and not applied.
+	DryRun bool
+	// ConsecutiveFailures and LastSuccess come from the state including this run.
+	ConsecutiveFailures int
+	LastSuccess         time.Time
+	ErrClass            string
+	Err                 error
+	// PropagationLatency is the time from the commit of the oldest applied change of roles.
+	PropagationLatency time.Duration
+	// Staleness is the time the userlist hasn't reflected the database for, set with -freshness-slo.
+	Staleness         time.Duration
+	FreshnessBreached bool
+	// ShadowDifferences is the number of users -shadow-config generates differently.
+	ShadowDifferences int
+}
+
+const (
+	errClassGenerate = "generate"
+	errClassReload   = "reload"
+	errClassAudit    = "audit"
+	errClassMarkers  = "markers"
+)
+
+// fail records the error of the run with the class of the failed phase.
+func (r *runReport) fail(class string, err error) {
+	r.ErrClass, r.Err = class, err
+}
+
+// runWithRetries runs the whole generation cycle until it succeeds or -retries are exhausted.
+func runWithRetries(db *sql.DB, exclude []string) *runReport {
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		report := runOnce(ctx, db, exclude)
+		cancel()
+		report.Attempts = attempt
+		// a retry wouldn't reload the userlist rejected by the canary again.
+		if report.Err == nil || report.ErrClass == errClassCanary || attempt > *retries {
+			return report
+		}
+		log.Printf("[WARN] attempt %d of %d failed: %s, retrying in %s\n", attempt, *retries+1, report.Err, *retryDelay)
+		time.Sleep(*retryDelay)
 	}
-	return os.Rename(tmpConfigPath, path)
 }
 
-func calcMd5File(filename string) (string, error) {
-	filename = filepath.Clean(filename)
-	// nolint:gosec
-	fd, err := os.Open(filename)
+// runOnce generates userlist, reloads pgbouncer if it has changed and reports the outcome.
+func runOnce(ctx context.Context, db *sql.DB, exclude []string) *runReport {
+	report := &runReport{Start: time.Now(), RunID: newRunID(), Phases: make(userlist.Timings)}
+	defer func() {
+		report.Duration = time.Since(report.Start)
+		log.Printf("[INFO] run finished path=%s user_count=%d duration=%s %s\n", *filePath, report.Users, report.Duration.Round(time.Microsecond), report.Phases)
+		if *simulateRoles > 0 {
+			logMemStats()
+		}
+	}()
+	if err := retargetFromIni(); err != nil {
+		report.fail(errClassGenerate, err)
+		return report
+	}
+	previous, errPrevious := readUserList(*filePath)
+	if errPrevious != nil && !os.IsNotExist(errPrevious) {
+		log.Printf("[WARN] read current userlist: %s\n", errPrevious)
+	}
+	if err := checkClusterIdentity(ctx, db); err != nil {
+		report.fail(errClassGenerate, err)
+		return report
+	}
+	reason, _ := freezeActive(time.Now())
+	run := &generation{
+		fetchSource: fetchSource{f: runFetcher.forRun(), db: db, exclude: exclude, timings: report.Phases},
+		report:      report,
+		warnings:    strictLog{strict: strict},
+		file:        &userlist.File{Path: *filePath, TriggerFile: *reloadTriggerFile, Timings: report.Phases},
+		previous:    previous,
+		bootstrap:   os.IsNotExist(errPrevious),
+		freeze:      reason,
+	}
+	result, err := run.generator().Run(ctx)
+	report.Changed = report.Changed || result.OutputsChanged
 	if err != nil {
-		return "", err
+		report.fail(errClassOf(err), err)
+		return report
 	}
-	// nolint:errcheck,gosec
-	defer fd.Close()
-	// nolint:gosec
-	hash := md5.New()
-	if _, err := io.Copy(hash, fd); err != nil {
-		return "", err
+	if result.Held && reason == "" {
+		return report
 	}
-	hashInBytes := hash.Sum(nil)[:16]
-	return hex.EncodeToString(hashInBytes), nil
+	if result.Changed {
+		if err := commitAudit(report, result.Users); err != nil {
+			report.fail(errClassAudit, fmt.Errorf("audit commit: %w", err))
+			return report
+		}
+	}
+	if err := touchMarkers(); err != nil {
+		report.fail(errClassMarkers, fmt.Errorf("touch markers: %w", err))
+	}
+	return report
 }
 
-func copyFile(src, dst string) error {
-	src, dst = filepath.Clean(src), filepath.Clean(dst)
-	// nolint:gosec
-	in, errOpen := os.Open(src)
-	if errOpen != nil {
-		return errOpen
+// generateUserList writes userlist to the path and returns written users and whether the file has changed.
+func generateUserList(ctx context.Context, db *sql.DB, path string, exclude []string, timings userlist.Timings) (map[string]string, bool, error) {
+	g := &userlist.Generator{
+		Source: fetchSource{f: runFetcher, db: db, exclude: exclude, timings: timings},
+		File:   &userlist.File{Path: path, TriggerFile: *reloadTriggerFile, Timings: timings},
+		Gate: func(context.Context, map[string]string, []byte) (bool, error) {
+			return true, checkWrite(path)
+		},
+		Written: func(_ context.Context, result userlist.Result) error {
+			wroteUserList(path, userlist.Render(result.Users), result.Changed)
+			return nil
+		},
+		// the caller processes the trigger file.
+		Reload: func(context.Context, userlist.Result) error { return nil },
+	}
+	result, err := g.Run(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return result.Users, result.Changed, nil
+}
+
+// writeUserList atomically replaces the file at path with content if it differs,
+// keeping a backup of the previous version and writing the trigger file before
+// the swap. Empty triggerFile means the file doesn't have a reload binding.
+func writeUserList(path, triggerFile string, content []byte, timings userlist.Timings) (bool, error) {
+	return writeAnnotatedUserList(path, triggerFile, content, nil, timings)
+}
+
+// writeAnnotatedUserList is writeUserList writing the annotation next to the backup.
+func writeAnnotatedUserList(path, triggerFile string, content, annotation []byte, timings userlist.Timings) (bool, error) {
+	if err := checkWrite(path); err != nil {
+		return false, err
+	}
+	file := &userlist.File{Path: path, TriggerFile: triggerFile, Timings: timings, BackupAnnotation: annotation}
+	changed, err := file.Write(content)
+	if err == nil {
+		wroteUserList(path, content, changed)
 	}
-	// nolint:errcheck,gosec
-	defer in.Close()
+	return changed, err
+}
 
-	out, errCreate := os.Create(dst)
-	if errCreate != nil {
-		return errCreate
+// checkWrite checks that the userlist may be written to the path.
+func checkWrite(path string) error {
+	if err := checkAllowedRoot(path); err != nil {
+		return err
 	}
-	// nolint:errcheck,gosec
-	defer out.Close()
+	return injectedError(faultWrite)
+}
 
-	_, errCopy := io.Copy(out, in)
-	if errCopy != nil {
-		return errCopy
+// wroteUserList records the content written to the path for tamper checks and logs the write.
+func wroteUserList(path string, content []byte, changed bool) {
+	rememberManaged(path, content)
+	if changed {
+		log.Printf("[DEBUG] %s differs from the generated content, replaced bytes=%d\n", path, len(content))
+	} else {
+		log.Printf("[INFO] %s doesn't have any changes, skipping update\n", path)
 	}
-	return out.Close()
 }
 
-func writeTriggerFile() error {
-	return os.WriteFile(*reloadTriggerFile, nil, 0600)
+// fetchUserList fetches users with options of the flags.
+func fetchUserList(ctx context.Context, db *sql.DB, exclude []string, timings userlist.Timings) (map[string]string, error) {
+	return runFetcher.fetch(ctx, db, exclude, timings)
 }
 
 // processTriggerFile:
@@ -160,15 +615,19 @@ func writeTriggerFile() error {
 //   - exit
 //
 // if trigger file exist:
-//   - run reload command
+//   - run reload command with the reloader
 //   - remove trigger file
-func processTriggerFile() error {
-	_, errStat := os.Stat(*reloadTriggerFile)
-	if errStat != nil {
+func processTriggerFile(triggerFile, path, reloadCommand string, reloader userlist.Runner, report *runReport) error {
+	file := &userlist.File{Path: path, TriggerFile: triggerFile, Timings: report.Phases}
+	if !file.ReloadPending() {
 		return nil
 	}
-	if err := exec.Command("/bin/bash", "-ec", *reloadCommand).Run(); err != nil {
-		return err
+	command, errRender := renderReloadCommand(reloadCommand, path, report)
+	if errRender != nil {
+		return errRender
+	}
+	if faultInjected(faultReloadTimeout) {
+		command = faultReloadCommand
 	}
-	return os.Remove(*reloadTriggerFile)
+	return file.Reload(reloader, command, *reloadTimeout)
 }
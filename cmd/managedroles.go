@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+const (
+	managedInclude = "include"
+	managedExclude = "exclude"
+)
+
+// readManagedRoles reads names of roles to include and to exclude from the relation
+// with rolname and mode columns, rows with other modes are skipped.
+func (f *fetcher) readManagedRoles(ctx context.Context, db *sql.DB, relation string) (include, exclude []string, err error) {
+	quoted, err := quoteRelation(relation)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := db.QueryContext(ctx, `select rolname::text, mode::text from `+quoted+` where rolname is not null order by rolname`)
+	if err != nil {
+		return nil, nil, err
+	}
+	// nolint:errcheck
+	defer rows.Close()
+	for rows.Next() {
+		var rolname string
+		var mode sql.NullString
+		if err := rows.Scan(&rolname, &mode); err != nil {
+			return nil, nil, err
+		}
+		switch mode.String {
+		case managedInclude:
+			include = append(include, rolname)
+		case managedExclude:
+			exclude = append(exclude, rolname)
+		default:
+			f.warnings.warnSkipped("role %q has unknown mode %q in %s, expected %s or %s", rolname, mode.String, relation, managedInclude, managedExclude)
+		}
+	}
+	return include, exclude, rows.Err()
+}
+
+// applyManagedRoles adds roles excluded by -managed-roles-table to exclude, so members of them
+// are left out like with -exclude, and keeps the roles of the table for filterManaged.
+func (f *fetcher) applyManagedRoles(ctx context.Context, db *sql.DB, exclude []string) ([]string, error) {
+	f.managedIncluded, f.managedExcluded = nil, nil
+	if f.managedRolesTable == "" || *simulateRoles > 0 {
+		return exclude, nil
+	}
+	include, excludeManaged, err := f.readManagedRoles(ctx, db, f.managedRolesTable)
+	if err != nil {
+		return nil, fmt.Errorf("read managed roles table %s: %w", f.managedRolesTable, err)
+	}
+	if len(include) > 0 {
+		f.managedIncluded = make(map[string]bool, len(include))
+		for _, rolname := range include {
+			f.managedIncluded[rolname] = true
+		}
+	}
+	f.managedExcluded = make(map[string]bool, len(excludeManaged))
+	for _, rolname := range excludeManaged {
+		f.managedExcluded[rolname] = true
+	}
+	return append(append([]string{}, exclude...), excludeManaged...), nil
+}
+
+// managedDecision returns the decision of -managed-roles-table about the role, empty if it is kept.
+func (f *fetcher) managedDecision(rolname string) string {
+	switch {
+	case f.managedExcluded[rolname]:
+		return decisionExcluded
+	case f.managedIncluded != nil && !f.managedIncluded[rolname]:
+		return decisionNotIncluded
+	}
+	return ""
+}
+
+// filterManaged leaves out roles excluded by -managed-roles-table and roles it doesn't include.
+func (f *fetcher) filterManaged(users map[string]string) map[string]string {
+	for rolname := range users {
+		if f.managedDecision(rolname) != "" {
+			delete(users, rolname)
+		}
+	}
+	return users
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mappingRule rewrites role names matched by exactly one of name, prefix, suffix or regex
+// to the value of to, which for regex may reference capture groups like $1. Source names
+// the role whose password the user gets when several roles are merged into it.
+type mappingRule struct {
+	Name   string `yaml:"name"`
+	Prefix string `yaml:"prefix"`
+	Suffix string `yaml:"suffix"`
+	Regex  string `yaml:"regex"`
+	To     string `yaml:"to"`
+	Source string `yaml:"source"`
+
+	re *regexp.Regexp
+}
+
+type mappingRules []mappingRule
+
+// readMappingRules loads YAML list of rules, e.g. [{regex: '^(\w+)_tenant\d+$', to: '$1'}],
+// the first matching rule wins.
+func readMappingRules(path string) (mappingRules, error) {
+	// nolint:gosec
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	var rules mappingRules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range rules {
+		r := &rules[i]
+		set := 0
+		for _, v := range []string{r.Name, r.Prefix, r.Suffix, r.Regex} {
+			if v != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return nil, fmt.Errorf("%s: rule %d: exactly one of name, prefix, suffix or regex must be set", path, i+1)
+		}
+		if r.Regex != "" {
+			if r.re, err = regexp.Compile(r.Regex); err != nil {
+				return nil, fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// mapName returns the rewritten role name, or the name itself if no rule matches.
+func (rules mappingRules) mapName(name string) string {
+	for _, r := range rules {
+		switch {
+		case r.Name != "" && name == r.Name:
+			return r.To
+		case r.Prefix != "" && strings.HasPrefix(name, r.Prefix):
+			return r.To + strings.TrimPrefix(name, r.Prefix)
+		case r.Suffix != "" && strings.HasSuffix(name, r.Suffix):
+			return strings.TrimSuffix(name, r.Suffix) + r.To
+		case r.re != nil:
+			if m := r.re.FindStringSubmatchIndex(name); m != nil {
+				return string(r.re.ExpandString(nil, r.To, name, m))
+			}
+		}
+	}
+	return name
+}
+
+// apply rewrites names of users. Merged roles take the password of the declared source
+// role, or must share the same password without one. md5 secrets are salted with the
+// role name, so roles with them can't be renamed.
+func (rules mappingRules) apply(users map[string]string) (map[string]string, error) {
+	declared := make(map[string]bool)
+	for _, r := range rules {
+		if r.Source != "" {
+			declared[r.Source] = true
+		}
+	}
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	mapped := make(map[string]string, len(users))
+	sources := make(map[string]string, len(users))
+	for _, name := range names {
+		to := rules.mapName(name)
+		if to == "" {
+			return nil, fmt.Errorf("role %q is mapped to empty name", name)
+		}
+		source, ok := sources[to]
+		switch {
+		case !ok:
+		case declared[source] && declared[name]:
+			return nil, fmt.Errorf("roles %q and %q are mapped to %q and both are declared as source", source, name, to)
+		case declared[source]:
+			continue
+		case !declared[name] && mapped[to] != users[name]:
+			return nil, fmt.Errorf("roles %q and %q are mapped to %q but have different passwords, declare the source of the password", source, name, to)
+		}
+		mapped[to], sources[to] = users[name], name
+	}
+	for to, source := range sources {
+		if to != source && passwordType(mapped[to]) == passwordMD5 {
+			return nil, fmt.Errorf("role %q is mapped to %q but its md5 password is salted with its name", source, to)
+		}
+	}
+	return mapped, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestMappingRulesApply(t *testing.T) {
+	const (
+		scramA = "SCRAM-SHA-256$4096:c2FsdEE=$a:a"
+		scramB = "SCRAM-SHA-256$4096:c2FsdEI=$b:b"
+		md5App = "md5" + "0123456789abcdef0123456789abcdef"
+	)
+	tenants := mappingRule{Regex: `^(\w+)_tenant\d+$`, To: "$1", re: regexp.MustCompile(`^(\w+)_tenant\d+$`)}
+	tests := []struct {
+		name  string
+		rules mappingRules
+		users map[string]string
+		want  map[string]string
+		err   bool
+	}{
+		{
+			name:  "rename scram",
+			rules: mappingRules{{Prefix: "old_", To: "new_"}},
+			users: map[string]string{"old_app": scramA, "other": scramB},
+			want:  map[string]string{"new_app": scramA, "other": scramB},
+		},
+		{
+			name:  "rename plain text",
+			rules: mappingRules{{Name: "app", To: "service"}},
+			users: map[string]string{"app": "secret"},
+			want:  map[string]string{"service": "secret"},
+		},
+		{
+			name:  "rename md5",
+			rules: mappingRules{{Name: "app", To: "service"}},
+			users: map[string]string{"app": md5App},
+			err:   true,
+		},
+		{
+			name:  "merge with the same password",
+			rules: mappingRules{tenants},
+			users: map[string]string{"app_tenant1": "secret", "app_tenant2": "secret"},
+			want:  map[string]string{"app": "secret"},
+		},
+		{
+			name:  "merge without source",
+			rules: mappingRules{tenants},
+			users: map[string]string{"app_tenant1": scramA, "app_tenant2": scramB},
+			err:   true,
+		},
+		{
+			name:  "merge into source",
+			rules: mappingRules{{Regex: tenants.Regex, To: tenants.To, Source: "app", re: tenants.re}},
+			users: map[string]string{"app": md5App, "app_tenant1": scramA, "app_tenant2": scramB},
+			want:  map[string]string{"app": md5App},
+		},
+		{
+			name:  "merge renamed source",
+			rules: mappingRules{{Regex: tenants.Regex, To: tenants.To, Source: "app_tenant2", re: tenants.re}},
+			users: map[string]string{"app_tenant1": scramA, "app_tenant2": scramB},
+			want:  map[string]string{"app": scramB},
+		},
+		{
+			name:  "merge renamed md5 source",
+			rules: mappingRules{{Regex: tenants.Regex, To: tenants.To, Source: "app_tenant1", re: tenants.re}},
+			users: map[string]string{"app_tenant1": md5App, "app_tenant2": scramB},
+			err:   true,
+		},
+		{
+			name: "conflicting sources",
+			rules: mappingRules{
+				{Name: "a", To: "app", Source: "a"},
+				{Name: "b", To: "app", Source: "b"},
+			},
+			users: map[string]string{"a": scramA, "b": scramB},
+			err:   true,
+		},
+		{
+			name:  "empty name",
+			rules: mappingRules{{Name: "app", To: ""}},
+			users: map[string]string{"app": "secret"},
+			err:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.rules.apply(tt.users)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
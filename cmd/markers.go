@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	healthyMarker = "healthy"
+	readyMarker   = "ready"
+	pausedMarker  = "paused"
+)
+
+// touchMarkers updates healthy and ready markers after a successful cycle,
+// so exec probes can check their presence and age with test/find.
+func touchMarkers() error {
+	if *markerDir == "" {
+		return nil
+	}
+	now := time.Now()
+	for _, name := range []string{healthyMarker, readyMarker} {
+		marker := filepath.Join(*markerDir, name)
+		if err := os.WriteFile(marker, nil, 0600); err != nil {
+			return err
+		}
+		if err := os.Chtimes(marker, now, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markDegraded removes the healthy marker while runs are suspended by the circuit breaker.
+func markDegraded() error {
+	if *markerDir == "" {
+		return nil
+	}
+	if err := os.Remove(filepath.Join(*markerDir, healthyMarker)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// markPaused creates the paused marker while generation is paused and removes it otherwise.
+func markPaused(paused bool) error {
+	if *markerDir == "" {
+		return nil
+	}
+	marker := filepath.Join(*markerDir, pausedMarker)
+	if paused {
+		return os.WriteFile(marker, []byte(pauseStatus()+"\n"), 0600)
+	}
+	if err := os.Remove(marker); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const metricsPrefix = "pgbouncer_userlist_generator_"
+
+// formatMetrics renders the run report in prometheus text exposition format.
+// Metrics which are known only after a successful run are omitted on failure.
+func formatMetrics(report *runReport) string {
+	var b strings.Builder
+	labels := metricLabels()
+	metric := func(name, help string, value float64) {
+		fmt.Fprintf(&b, "# HELP %s%s %s\n# TYPE %s%s gauge\n%s%s%s %s\n",
+			metricsPrefix, name, help, metricsPrefix, name, metricsPrefix, name, labels, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	boolValue := func(v bool) float64 {
+		if v {
+			return 1
+		}
+		return 0
+	}
+	metric("last_run_timestamp_seconds", "Time of the last run.", float64(report.Start.Unix()))
+	metric("last_run_duration_seconds", "Duration of the last run.", report.Duration.Seconds())
+	metric("last_run_success", "Whether the last run has succeeded.", boolValue(report.Err == nil))
+	metric("circuit_open", "Whether runs are suspended after consecutive failures.", boolValue(report.CircuitOpen))
+	metric("consecutive_failures", "Number of consecutive failed runs.", float64(report.ConsecutiveFailures))
+	if !report.LastSuccess.IsZero() {
+		age := report.Start.Sub(report.LastSuccess)
+		if (report.Err == nil && !report.Paused) || age < 0 {
+			age = 0
+		}
+		metric("last_success_age_seconds", "Time since the last successful run at the time of the last run.", age.Seconds())
+	}
+	if *freshnessSLO > 0 {
+		metric("staleness_seconds", "Time the userlist hasn't reflected the database for.", report.Staleness.Seconds())
+		metric("freshness_slo_breached", "Whether the userlist is staler than the freshness SLO.", boolValue(report.FreshnessBreached))
+	}
+	metric("paused", "Whether generation is paused.", boolValue(report.Paused))
+	metric("frozen", "Whether changes are not applied in a freeze window.", boolValue(report.Frozen))
+	metric("pending_approval", "Whether a change of the userlist waits for approval.", boolValue(report.PendingApproval))
+	if report.Frozen || report.PendingApproval {
+		metric("pending_changes", "Number of users changed in the database but not in the userlist.", float64(len(report.Added)+len(report.Removed)+len(report.Updated)))
+	}
+	if report.Err == nil && !report.Paused {
+		metric("last_success_timestamp_seconds", "Time of the last successful run.", float64(report.Start.Add(report.Duration).Unix()))
+		metric("users", "Number of users in the userlist.", float64(report.Users))
+		metric("last_run_changed", "Whether the last run has changed the userlist.", boolValue(report.Changed))
+		if *shadowConfig != "" {
+			metric("shadow_differences", "Number of users generated differently with the shadow config in the last run.", float64(report.ShadowDifferences))
+		}
+		if report.PropagationLatency > 0 {
+			metric("propagation_latency_seconds", "Time from the commit of the oldest role change to the applied userlist in the last run.", report.PropagationLatency.Seconds())
+		}
+	} else if !report.LastSuccess.IsZero() {
+		// files of textfile collector are replaced as a whole, keep the last success there.
+		metric("last_success_timestamp_seconds", "Time of the last successful run.", float64(report.LastSuccess.Unix()))
+	}
+	return b.String()
+}
+
+// metricLabels returns labels of every metric set with -cluster and -labels.
+func metricLabels() string {
+	if len(runLabels) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	pairs := make([]string, 0, len(runLabels))
+	for _, name := range labelNames() {
+		pairs = append(pairs, name+`="`+escape.Replace(runLabels[name])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// pushgatewayLabel encodes grouping label as path segments, values with slashes are base64 encoded.
+func pushgatewayLabel(name, value string) string {
+	if value == "" {
+		return name + "@base64/="
+	}
+	if strings.Contains(value, "/") {
+		return name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+	}
+	return name + "/" + url.PathEscape(value)
+}
+
+// pushMetrics pushes the run report to the pushgateway if it is configured.
+// POST replaces only pushed metrics, so the last success time survives failed runs.
+func pushMetrics(report *runReport) error {
+	if *pushgatewayURL == "" {
+		return nil
+	}
+	instance := *pushgatewayInstance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	target := fmt.Sprintf("%s/metrics/%s/%s",
+		strings.TrimRight(*pushgatewayURL, "/"), pushgatewayLabel("job", *pushgatewayJob), pushgatewayLabel("instance", instance))
+	// jobs of several clusters on the same host must not replace metrics of each other.
+	if *cluster != "" {
+		target += "/" + pushgatewayLabel("cluster", *cluster)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(target, "text/plain; version=0.0.4", bytes.NewBufferString(formatMetrics(report)))
+	if err != nil {
+		return err
+	}
+	// nolint:errcheck
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("pushgateway responded %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// writeMetricsTextfile atomically writes the run report for node_exporter textfile collector,
+// which reads only files with .prom extension.
+func writeMetricsTextfile(report *runReport) error {
+	if *metricsTextfile == "" {
+		return nil
+	}
+	tmp := *metricsTextfile + ".tmp"
+	// nolint:gosec
+	if err := os.WriteFile(tmp, []byte(formatMetrics(report)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *metricsTextfile)
+}
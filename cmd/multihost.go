@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	targetSessionAttrs = "target_session_attrs"
+	hostaddrKey        = "hostaddr"
+)
+
+// hostList is a libpq style multi-host connection string split into connection strings of its hosts.
+type hostList struct {
+	dsns []string
+	// hostaddrs are addresses of hostaddr parallel to dsns, empty where none is given. Lib/pq
+	// doesn't support hostaddr, the hosts are dialed at them and dsns keep host names, which
+	// sslmode=verify-full checks certificates against.
+	hostaddrs []string
+	// attrs is target_session_attrs, which lib/pq doesn't support either.
+	attrs string
+}
+
+// splitMultiHost returns connection strings of every host of the libpq style multi-host
+// connection string, like host=a,b port=5432,5433 or postgres://a:5432,[::1]:5433/db,
+// with hostaddr and target_session_attrs removed from them.
+func splitMultiHost(dsn string) (hostList, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return splitMultiHostURL(dsn)
+	}
+	return splitMultiHostKV(dsn)
+}
+
+func splitMultiHostURL(dsn string) (hostList, error) {
+	var list hostList
+	idx := strings.Index(dsn, "://")
+	scheme, rest := dsn[:idx+3], dsn[idx+3:]
+	authorityEnd := strings.IndexAny(rest, "/?")
+	if authorityEnd < 0 {
+		authorityEnd = len(rest)
+	}
+	authority, tail := rest[:authorityEnd], rest[authorityEnd:]
+	userinfo := ""
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		userinfo, authority = authority[:at+1], authority[at+1:]
+	}
+	var hostaddrs []string
+	if q := strings.Index(tail, "?"); q >= 0 {
+		query, err := url.ParseQuery(tail[q+1:])
+		if err != nil {
+			return list, err
+		}
+		list.attrs = query.Get(targetSessionAttrs)
+		if addrs := query.Get(hostaddrKey); addrs != "" {
+			hostaddrs = strings.Split(addrs, ",")
+		}
+		query.Del(targetSessionAttrs)
+		query.Del(hostaddrKey)
+		tail = tail[:q]
+		if len(query) > 0 {
+			tail += "?" + query.Encode()
+		}
+	}
+	hostports := strings.Split(authority, ",")
+	if hostaddrs != nil && len(hostaddrs) != len(hostports) {
+		return list, fmt.Errorf("%d hostaddrs given for %d hosts", len(hostaddrs), len(hostports))
+	}
+	for i, hostport := range hostports {
+		host, port := hostport, ""
+		if h, p, err := net.SplitHostPort(hostport); err == nil {
+			host, port = h, p
+		} else {
+			host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+		}
+		list.hostaddrs = append(list.hostaddrs, "")
+		if hostaddrs != nil {
+			list.hostaddrs[i] = hostaddrs[i]
+		}
+		if host == "" && port == "" {
+			list.dsns = append(list.dsns, scheme+userinfo+tail)
+			continue
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		if port != "" {
+			host += ":" + port
+		}
+		list.dsns = append(list.dsns, scheme+userinfo+host+tail)
+	}
+	return list, nil
+}
+
+// dsnParam is a key and value of key=value connection string.
+type dsnParam struct {
+	key   string
+	value string
+}
+
+func splitMultiHostKV(dsn string) (hostList, error) {
+	var list hostList
+	params, err := parseKV(dsn)
+	if err != nil {
+		return list, err
+	}
+	var hosts, hostaddrs, ports []string
+	var common []dsnParam
+	for _, p := range params {
+		switch p.key {
+		case "host":
+			hosts = strings.Split(p.value, ",")
+		case hostaddrKey:
+			hostaddrs = strings.Split(p.value, ",")
+		case "port":
+			ports = strings.Split(p.value, ",")
+		case targetSessionAttrs:
+			list.attrs = p.value
+		default:
+			common = append(common, p)
+		}
+	}
+	count := len(hosts)
+	switch {
+	case hosts != nil && hostaddrs != nil && len(hostaddrs) != len(hosts):
+		return list, fmt.Errorf("%d hostaddrs given for %d hosts", len(hostaddrs), len(hosts))
+	case hosts == nil:
+		count = len(hostaddrs)
+	}
+	if len(ports) > 1 && len(ports) != count {
+		return list, fmt.Errorf("%d ports given for %d hosts", len(ports), count)
+	}
+	if count == 0 {
+		count = 1
+	}
+	for i := 0; i < count; i++ {
+		items := make([]string, 0, len(common)+2)
+		if i < len(hosts) && hosts[i] != "" {
+			items = append(items, "host="+quoteKV(strings.TrimSuffix(strings.TrimPrefix(hosts[i], "["), "]")))
+		}
+		switch {
+		case len(ports) == 1:
+			items = append(items, "port="+quoteKV(ports[0]))
+		case len(ports) > 1:
+			items = append(items, "port="+quoteKV(ports[i]))
+		}
+		for _, p := range common {
+			items = append(items, p.key+"="+quoteKV(p.value))
+		}
+		hostaddr := ""
+		if i < len(hostaddrs) {
+			hostaddr = hostaddrs[i]
+		}
+		list.dsns = append(list.dsns, strings.Join(items, " "))
+		list.hostaddrs = append(list.hostaddrs, hostaddr)
+	}
+	return list, nil
+}
+
+// parseKV parses key=value connection string, values may be single quoted with backslash escapes.
+func parseKV(dsn string) ([]dsnParam, error) {
+	var params []dsnParam
+	s := strings.TrimSpace(dsn)
+	for s != "" {
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("missing \"=\" after %q in connection string", s)
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		var value strings.Builder
+		if strings.HasPrefix(s, "'") {
+			i := 1
+			for ; i < len(s) && s[i] != '\''; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, errors.New("unterminated quoted value in connection string")
+			}
+			s = s[i+1:]
+		} else {
+			end := strings.IndexAny(s, " \t")
+			if end < 0 {
+				end = len(s)
+			}
+			value.WriteString(s[:end])
+			s = s[end:]
+		}
+		params = append(params, dsnParam{key: key, value: value.String()})
+		s = strings.TrimLeft(s, " \t")
+	}
+	return params, nil
+}
+
+func quoteKV(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t'\\") {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// multiHostConnector connects to the first host accepting the connection
+// and matching target_session_attrs.
+type multiHostConnector struct {
+	connectors []*pq.Connector
+	attrs      string
+}
+
+func newMultiHostConnector(hosts hostList, dialer pq.Dialer) (*multiHostConnector, error) {
+	switch hosts.attrs {
+	case "", "any", "read-write", "read-only", "primary", "standby":
+	default:
+		return nil, fmt.Errorf("unsupported %s: %q", targetSessionAttrs, hosts.attrs)
+	}
+	c := &multiHostConnector{attrs: hosts.attrs}
+	for i, dsn := range hosts.dsns {
+		connector, err := pq.NewConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		connector.Dialer(hostDialer(dialer, hosts.hostaddrs[i]))
+		c.connectors = append(c.connectors, connector)
+	}
+	return c, nil
+}
+
+// hostDialer returns the dialer connecting to hostaddr instead of the host when it is set.
+func hostDialer(dialer pq.Dialer, hostaddr string) pq.Dialer {
+	if hostaddr == "" {
+		return dialer
+	}
+	return &hostaddrDialer{dialer: dialer, hostaddr: hostaddr}
+}
+
+// hostaddrDialer dials hostaddr at the port of the dialed address, like libpq with both host
+// and hostaddr set.
+type hostaddrDialer struct {
+	dialer   pq.Dialer
+	hostaddr string
+}
+
+func (d *hostaddrDialer) address(address string) string {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	return net.JoinHostPort(d.hostaddr, port)
+}
+
+func (d *hostaddrDialer) Dial(network, address string) (net.Conn, error) {
+	return d.dialer.Dial(network, d.address(address))
+}
+
+func (d *hostaddrDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	return d.dialer.DialTimeout(network, d.address(address), timeout)
+}
+
+func (d *hostaddrDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if dialer, ok := d.dialer.(pq.DialerContext); ok {
+		return dialer.DialContext(ctx, network, d.address(address))
+	}
+	return d.dialer.Dial(network, d.address(address))
+}
+
+func (c *multiHostConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var errs []string
+	for _, connector := range c.connectors {
+		conn, err := connector.Connect(ctx)
+		if err == nil {
+			if err = c.checkSession(ctx, conn); err == nil {
+				return conn, nil
+			}
+			// nolint:errcheck,gosec
+			conn.Close()
+		}
+		errs = append(errs, err.Error())
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("no suitable host: %s", strings.Join(errs, "; "))
+}
+
+func (c *multiHostConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// checkSession verifies the connection matches target_session_attrs.
+func (c *multiHostConnector) checkSession(ctx context.Context, conn driver.Conn) error {
+	if c.attrs == "" || c.attrs == "any" {
+		return nil
+	}
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return errors.New("connection doesn't support queries")
+	}
+	rows, err := queryer.QueryContext(ctx, `select pg_is_in_recovery()::text, current_setting('transaction_read_only')`, nil)
+	if err != nil {
+		return err
+	}
+	// nolint:errcheck
+	defer rows.Close()
+	values := make([]driver.Value, 2)
+	if err := rows.Next(values); err != nil {
+		if err == io.EOF {
+			return errors.New("empty session state")
+		}
+		return err
+	}
+	inRecovery := fmt.Sprint(values[0]) == "true"
+	readOnly := fmt.Sprint(values[1]) == "on"
+	switch {
+	case c.attrs == "read-write" && readOnly, c.attrs == "primary" && inRecovery:
+		return fmt.Errorf("session is read-only, %s=%s", targetSessionAttrs, c.attrs)
+	case c.attrs == "read-only" && !readOnly, c.attrs == "standby" && !inRecovery:
+		return fmt.Errorf("session is read-write, %s=%s", targetSessionAttrs, c.attrs)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitMultiHostURL(t *testing.T) {
+	tests := []struct {
+		name string
+		dsn  string
+		want hostList
+		err  bool
+	}{
+		{
+			name: "ipv6 with port",
+			dsn:  "postgres://u:p@[::1]:5433/db",
+			want: hostList{dsns: []string{"postgres://u:p@[::1]:5433/db"}, hostaddrs: []string{""}},
+		},
+		{
+			name: "bare ipv6",
+			dsn:  "postgres://[::1]/db",
+			want: hostList{dsns: []string{"postgres://[::1]/db"}, hostaddrs: []string{""}},
+		},
+		{
+			name: "host and ipv6",
+			dsn:  "postgresql://u@a:5432,[::1]:5433/db?sslmode=disable",
+			want: hostList{
+				dsns:      []string{"postgresql://u@a:5432/db?sslmode=disable", "postgresql://u@[::1]:5433/db?sslmode=disable"},
+				hostaddrs: []string{"", ""},
+			},
+		},
+		{
+			name: "target_session_attrs stripped",
+			dsn:  "postgres://a,b/db?target_session_attrs=read-write&sslmode=require",
+			want: hostList{
+				dsns:      []string{"postgres://a/db?sslmode=require", "postgres://b/db?sslmode=require"},
+				hostaddrs: []string{"", ""},
+				attrs:     "read-write",
+			},
+		},
+		{
+			name: "only target_session_attrs",
+			dsn:  "postgres://a/db?target_session_attrs=read-write",
+			want: hostList{dsns: []string{"postgres://a/db"}, hostaddrs: []string{""}, attrs: "read-write"},
+		},
+		{
+			name: "hostaddr keeps host names",
+			dsn:  "postgres://db1.example,db2.example/db?hostaddr=10.0.0.1,10.0.0.2&sslmode=verify-full",
+			want: hostList{
+				dsns:      []string{"postgres://db1.example/db?sslmode=verify-full", "postgres://db2.example/db?sslmode=verify-full"},
+				hostaddrs: []string{"10.0.0.1", "10.0.0.2"},
+			},
+		},
+		{
+			name: "hostaddr count mismatch",
+			dsn:  "postgres://a,b/db?hostaddr=10.0.0.1",
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitMultiHostURL(tt.dsn)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitMultiHostKV(t *testing.T) {
+	tests := []struct {
+		name string
+		dsn  string
+		want hostList
+		err  bool
+	}{
+		{
+			name: "ipv6 with port",
+			dsn:  "host=[::1] port=5433 dbname=db",
+			want: hostList{dsns: []string{"host=::1 port=5433 dbname=db"}, hostaddrs: []string{""}},
+		},
+		{
+			name: "bare ipv6",
+			dsn:  "host=::1 dbname=db",
+			want: hostList{dsns: []string{"host=::1 dbname=db"}, hostaddrs: []string{""}},
+		},
+		{
+			name: "host and ipv6",
+			dsn:  "host=a,[::1] port=5432,5433 user=u",
+			want: hostList{dsns: []string{"host=a port=5432 user=u", "host=::1 port=5433 user=u"}, hostaddrs: []string{"", ""}},
+		},
+		{
+			name: "single port for every host",
+			dsn:  "host=a,b port=6432",
+			want: hostList{dsns: []string{"host=a port=6432", "host=b port=6432"}, hostaddrs: []string{"", ""}},
+		},
+		{
+			name: "port count mismatch",
+			dsn:  "host=a,b,c port=5432,5433",
+			err:  true,
+		},
+		{
+			name: "target_session_attrs stripped",
+			dsn:  "host=a,b target_session_attrs=read-write dbname='my db'",
+			want: hostList{
+				dsns:      []string{"host=a dbname='my db'", "host=b dbname='my db'"},
+				hostaddrs: []string{"", ""},
+				attrs:     "read-write",
+			},
+		},
+		{
+			name: "hostaddr keeps host name",
+			dsn:  "host=db.example hostaddr=10.0.0.1 sslmode=verify-full",
+			want: hostList{dsns: []string{"host=db.example sslmode=verify-full"}, hostaddrs: []string{"10.0.0.1"}},
+		},
+		{
+			name: "hostaddr without host",
+			dsn:  "hostaddr=10.0.0.1,10.0.0.2 port=5432,5433",
+			want: hostList{dsns: []string{"port=5432", "port=5433"}, hostaddrs: []string{"10.0.0.1", "10.0.0.2"}},
+		},
+		{
+			name: "hostaddr count mismatch",
+			dsn:  "host=a,b hostaddr=10.0.0.1",
+			err:  true,
+		},
+		{
+			name: "no host",
+			dsn:  "dbname=db",
+			want: hostList{dsns: []string{"dbname=db"}, hostaddrs: []string{""}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := splitMultiHostKV(tt.dsn)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	eventFailure = "failure"
+	eventChange  = "change"
+	// eventFreshness is sent when the userlist becomes staler than -freshness-slo.
+	eventFreshness = "freshness"
+	// eventAll matches every event in routes.
+	eventAll = "all"
+
+	notifyTimeout = 10 * time.Second
+)
+
+// notification describes the event of a run, it never carries password hashes.
+type notification struct {
+	Event      string            `json:"event"`
+	Cluster    string            `json:"cluster,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	Host       string            `json:"host"`
+	Path       string            `json:"path"`
+	Start      time.Time         `json:"start"`
+	Users      int               `json:"users"`
+	Added      []string          `json:"added,omitempty"`
+	Removed    []string          `json:"removed,omitempty"`
+	Updated    []string          `json:"updated,omitempty"`
+	ErrorClass string            `json:"error_class,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Staleness  string            `json:"staleness,omitempty"`
+}
+
+// summary returns one line description of the event.
+func (n notification) summary() string {
+	where := n.Host + ":" + n.Path
+	if n.Cluster != "" {
+		where = n.Cluster + " " + where
+	}
+	if n.Event == eventFailure {
+		return fmt.Sprintf("pgbouncer userlist generation failed on %s: %s", where, n.Error)
+	}
+	if n.Event == eventFreshness {
+		return fmt.Sprintf("pgbouncer userlist on %s is stale for %s, over freshness SLO of %s", where, n.Staleness, *freshnessSLO)
+	}
+	return fmt.Sprintf("pgbouncer userlist changed on %s: %d added, %d removed, %d updated, %d users",
+		where, len(n.Added), len(n.Removed), len(n.Updated), n.Users)
+}
+
+// notifier delivers notifications to a channel.
+type notifier interface {
+	Notify(n notification) error
+}
+
+// notifierConfig configures a notifier, fields used depend on the type.
+type notifierConfig struct {
+	Type       string   `yaml:"type" toml:"type"`
+	URL        string   `yaml:"url" toml:"url"`
+	RoutingKey string   `yaml:"routing_key" toml:"routing_key"`
+	Command    string   `yaml:"command" toml:"command"`
+	SMTP       string   `yaml:"smtp" toml:"smtp"`
+	Username   string   `yaml:"username" toml:"username"`
+	Password   string   `yaml:"password" toml:"password"`
+	From       string   `yaml:"from" toml:"from"`
+	To         []string `yaml:"to" toml:"to"`
+}
+
+// notificationRoute sends events of the route to the named notifiers.
+type notificationRoute struct {
+	Events []string `yaml:"events" toml:"events"`
+	Notify []string `yaml:"notify" toml:"notify"`
+}
+
+// notificationsConfig is the notifications section of -config, e.g.
+// {notifiers: {oncall: {type: pagerduty, routing_key: KEY}}, routes: [{events: [failure], notify: [oncall]}]}.
+type notificationsConfig struct {
+	Notifiers map[string]notifierConfig `yaml:"notifiers" toml:"notifiers"`
+	Routes    []notificationRoute       `yaml:"routes" toml:"routes"`
+}
+
+// notifications routes events of runs, nil without the notifications section of -config.
+var notifications *notificationRouter
+
+// notifierTypes creates notifiers by type, other channels like kafka are reachable through webhook to their REST proxies.
+var notifierTypes = map[string]func(c notifierConfig) (notifier, error){
+	"webhook": func(c notifierConfig) (notifier, error) {
+		if c.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		return webhookNotifier{url: c.URL}, nil
+	},
+	"slack": func(c notifierConfig) (notifier, error) {
+		if c.URL == "" {
+			return nil, fmt.Errorf("url is required")
+		}
+		return slackNotifier{url: c.URL}, nil
+	},
+	"pagerduty": func(c notifierConfig) (notifier, error) {
+		if c.RoutingKey == "" {
+			return nil, fmt.Errorf("routing_key is required")
+		}
+		url := c.URL
+		if url == "" {
+			url = "https://events.pagerduty.com/v2/enqueue"
+		}
+		return pagerdutyNotifier{url: url, routingKey: c.RoutingKey}, nil
+	},
+	"command": func(c notifierConfig) (notifier, error) {
+		if c.Command == "" {
+			return nil, fmt.Errorf("command is required")
+		}
+		return commandNotifier{command: c.Command}, nil
+	},
+	"email": func(c notifierConfig) (notifier, error) {
+		if c.SMTP == "" || c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("smtp, from and to are required")
+		}
+		return emailNotifier(c), nil
+	},
+}
+
+// notificationRouter holds notifiers and routes of the notifications section of -config.
+type notificationRouter struct {
+	notifiers map[string]notifier
+	routes    []notificationRoute
+}
+
+// validateNotifications reads notifiers and routes of -config once, so mistakes in them
+// are reported at startup rather than when the first event is sent.
+func validateNotifications() error {
+	if *configFile == "" {
+		return nil
+	}
+	router, err := readNotifications(*configFile)
+	if err != nil {
+		return err
+	}
+	notifications = router
+	return nil
+}
+
+// readNotifications loads and validates notifiers and routes of the notifications section
+// of the config file, nil without the section.
+func readNotifications(path string) (*notificationRouter, error) {
+	// nolint:gosec
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Notifications *notificationsConfig `yaml:"notifications" toml:"notifications"`
+	}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		err = toml.Unmarshal(data, &file)
+	} else {
+		err = yaml.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if file.Notifications == nil {
+		return nil, nil
+	}
+	config := *file.Notifications
+	router := &notificationRouter{notifiers: make(map[string]notifier, len(config.Notifiers)), routes: config.Routes}
+	for name, c := range config.Notifiers {
+		newNotifier, ok := notifierTypes[c.Type]
+		if !ok {
+			types := make([]string, 0, len(notifierTypes))
+			for t := range notifierTypes {
+				types = append(types, t)
+			}
+			sort.Strings(types)
+			return nil, fmt.Errorf("%s: notifier %q: unknown type %q, expected one of %s", path, name, c.Type, strings.Join(types, ", "))
+		}
+		if router.notifiers[name], err = newNotifier(c); err != nil {
+			return nil, fmt.Errorf("%s: notifier %q: %w", path, name, err)
+		}
+	}
+	for i, route := range config.Routes {
+		for _, event := range route.Events {
+			if event != eventFailure && event != eventChange && event != eventFreshness && event != eventAll {
+				return nil, fmt.Errorf("%s: route %d: unknown event %q", path, i+1, event)
+			}
+		}
+		for _, name := range route.Notify {
+			if _, ok := router.notifiers[name]; !ok {
+				return nil, fmt.Errorf("%s: route %d: unknown notifier %q", path, i+1, name)
+			}
+		}
+	}
+	return router, nil
+}
+
+// send delivers the notification to notifiers of every matching route, once per notifier.
+func (r *notificationRouter) send(n notification) error {
+	sent := make(map[string]bool)
+	var failed []string
+	for _, route := range r.routes {
+		matched := false
+		for _, event := range route.Events {
+			matched = matched || event == n.Event || event == eventAll
+		}
+		if !matched {
+			continue
+		}
+		for _, name := range route.Notify {
+			if sent[name] {
+				continue
+			}
+			sent[name] = true
+			if err := r.notifiers[name].Notify(n); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %s", name, err))
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// sendNotifications routes failure, change and freshness events of the run to notifiers of -config.
+func sendNotifications(report *runReport, alert, stale bool) error {
+	if notifications == nil {
+		return nil
+	}
+	var events []string
+	if alert {
+		events = append(events, eventFailure)
+	}
+	if report.Err == nil && report.Changed && !report.DryRun {
+		events = append(events, eventChange)
+	}
+	if stale {
+		events = append(events, eventFreshness)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	host, _ := os.Hostname()
+	for _, event := range events {
+		n := notification{
+			Event: event, Cluster: *cluster, Labels: runLabels, Host: host, Path: *filePath, Start: report.Start.UTC(),
+			Users: report.Users, Added: report.Added, Removed: report.Removed, Updated: report.Updated,
+		}
+		if report.Err != nil {
+			n.ErrorClass, n.Error = report.ErrClass, report.Err.Error()
+		}
+		if event == eventFreshness {
+			n.Staleness = report.Staleness.Round(time.Second).String()
+		}
+		if err := notifications.send(n); err != nil {
+			return fmt.Errorf("%s event: %w", event, err)
+		}
+	}
+	return nil
+}
+
+// postJSON posts the value as json and fails on non 2xx responses.
+func postJSON(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	// nolint:errcheck
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s responded %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// webhookNotifier posts the notification as json.
+type webhookNotifier struct {
+	url string
+}
+
+func (w webhookNotifier) Notify(n notification) error {
+	return postJSON(w.url, n)
+}
+
+// slackNotifier posts the summary to slack incoming webhook.
+type slackNotifier struct {
+	url string
+}
+
+func (s slackNotifier) Notify(n notification) error {
+	return postJSON(s.url, map[string]string{"text": n.summary()})
+}
+
+// pagerdutyNotifier triggers pagerduty events v2 deduplicated by host and path.
+type pagerdutyNotifier struct {
+	url        string
+	routingKey string
+}
+
+func (p pagerdutyNotifier) Notify(n notification) error {
+	severity := "info"
+	if n.Event == eventFailure || n.Event == eventFreshness {
+		severity = "error"
+	}
+	return postJSON(p.url, map[string]interface{}{
+		"routing_key":  p.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    "pgbouncer-userlist-generator/" + n.Event + "/" + n.Host + n.Path,
+		"payload": map[string]interface{}{
+			"summary":        n.summary(),
+			"source":         n.Host,
+			"severity":       severity,
+			"custom_details": n,
+		},
+	})
+}
+
+// commandNotifier runs the command with the notification json in PGBOUNCER_USERLIST_NOTIFICATION.
+type commandNotifier struct {
+	command string
+}
+
+func (c commandNotifier) Notify(n notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return runner.Run(c.command, notifyTimeout, []string{
+		"PGBOUNCER_USERLIST_EVENT=" + n.Event,
+		"PGBOUNCER_USERLIST_NOTIFICATION=" + string(data),
+	})
+}
+
+// emailNotifier sends the summary and the notification over smtp, with plain auth if username is set.
+type emailNotifier notifierConfig
+
+func (e emailNotifier) Notify(n notification) error {
+	data, err := json.MarshalIndent(n, "", "  ")
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		e.From, strings.Join(e.To, ", "), strings.NewReplacer("\r", " ", "\n", " ").Replace(n.summary()), data)
+	var auth smtp.Auth
+	if e.Username != "" {
+		host, _, _ := net.SplitHostPort(e.SMTP)
+		auth = smtp.PlainAuth("", e.Username, e.Password, host)
+	}
+	return smtp.SendMail(e.SMTP, auth, e.From, e.To, msg.Bytes())
+}
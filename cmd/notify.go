@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// notifySettle is the time notifications of a single change are coalesced for.
+const notifySettle = time.Second
+
+// watchNotify regenerates the userlist when a notification arrives on -listen-channel.
+// Multi-host connection strings listen on the first host.
+func watchNotify(ctx context.Context, db *sql.DB, exclude []string) error {
+	hosts, err := splitMultiHost(*connectionString)
+	if err != nil {
+		return err
+	}
+	dialer := hostDialer(newResolvingDialer(*dnsTTL, net.Dialer{Timeout: *connectTimeout, KeepAlive: *tcpKeepaliveInterval}), hosts.hostaddrs[0])
+	listener := pq.NewDialListener(dialer, hosts.dsns[0], time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("[WARN] listen %s: %s\n", *listenChannel, err)
+		}
+	})
+	done := make(chan struct{})
+	defer close(done)
+	// Listen blocks until connected, closing the listener interrupts it.
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		// nolint:errcheck
+		listener.Close()
+	}()
+	if err := listener.Listen(*listenChannel); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	log.Printf("[INFO] listening on channel %s\n", *listenChannel)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-listener.Notify:
+			// nil notification follows reconnect, notifications may have been missed.
+			if n == nil {
+				log.Printf("[INFO] reconnected to channel %s, regenerating userlist\n", *listenChannel)
+			}
+			timer := time.NewTimer(notifySettle)
+		settle:
+			for {
+				select {
+				case <-listener.Notify:
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				case <-timer.C:
+					break settle
+				}
+			}
+			runCycle(db, exclude)
+		case <-time.After(90 * time.Second):
+			// detect dead connections which don't deliver notifications.
+			// nolint:errcheck
+			go listener.Ping()
+		}
+	}
+}
+
+// runListenSQL prints SQL notifying -listen-channel. Event triggers don't fire
+// for roles, which are shared objects, so the function is called after role changes.
+func runListenSQL(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `-- event triggers don't fire for CREATE, ALTER and DROP ROLE, which change shared objects,
+-- so call pgbouncer_userlist_changed() after role changes, e.g. at the end of migrations.
+create or replace function pgbouncer_userlist_changed() returns void
+    language sql
+as $$ select pg_notify(%s, '') $$;
+`, pq.QuoteLiteral(*listenChannel))
+	return err
+}
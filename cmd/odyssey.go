@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// odysseyAdapter writes odyssey user rules reloaded with the shell command.
+type odysseyAdapter struct {
+	database string
+	storage  string
+	pool     string
+}
+
+func (odysseyAdapter) Reload(command string) (string, userlist.Runner) {
+	return command, runner
+}
+
+// odysseyAuthentication returns odyssey authentication method for the password.
+func odysseyAuthentication(password string) string {
+	switch passwordType(password) {
+	case passwordMD5:
+		return "md5"
+	case passwordSCRAM:
+		return "scram-sha-256"
+	default:
+		return "clear_text"
+	}
+}
+
+// Render renders users as rules of the database sorted by name, users whose
+// names or passwords can't be quoted in odyssey config are skipped.
+func (a odysseyAdapter) Render(users map[string]string, warnings *strictLog) []byte {
+	names := make([]string, 0, len(users))
+	for username := range users {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("# generated by pgbouncer-userlist-generator, do not edit\n")
+	fmt.Fprintf(&b, "database %s {\n", odysseyName(a.database))
+	for _, username := range names {
+		password := users[username]
+		if strings.ContainsAny(username+password, "\"\\\n") {
+			warnings.warnSkipped("user %q can't be written to odyssey config", username)
+			continue
+		}
+		fmt.Fprintf(&b, "\tuser \"%s\" {\n", username)
+		fmt.Fprintf(&b, "\t\tauthentication \"%s\"\n", odysseyAuthentication(password))
+		fmt.Fprintf(&b, "\t\tpassword \"%s\"\n", password)
+		fmt.Fprintf(&b, "\t\tstorage \"%s\"\n", a.storage)
+		fmt.Fprintf(&b, "\t\tpool \"%s\"\n", a.pool)
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
+
+// odysseyName returns the database name, default is a keyword and stays unquoted.
+func odysseyName(name string) string {
+	if name == "default" {
+		return name
+	}
+	return `"` + name + `"`
+}
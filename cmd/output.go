@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	outputText    = "text"
+	outputJSON    = "json"
+	outputAnsible = "ansible"
+)
+
+// ansibleResult follows the ansible module return values convention.
+type ansibleResult struct {
+	Changed bool   `json:"changed"`
+	Failed  bool   `json:"failed,omitempty"`
+	Msg     string `json:"msg"`
+	Users   int    `json:"users"`
+	Path    string `json:"path"`
+	Cluster string `json:"cluster,omitempty"`
+}
+
+// validateOutput checks the -output flag.
+func validateOutput() error {
+	switch *outputFormat {
+	case outputText, outputJSON, outputAnsible:
+		return nil
+	default:
+		return fmt.Errorf("unknown output format: %q", *outputFormat)
+	}
+}
+
+// reportJSON is the run report printed with -output json.
+type reportJSON struct {
+	Cluster         string             `json:"cluster,omitempty"`
+	Labels          map[string]string  `json:"labels,omitempty"`
+	RunID           string             `json:"run_id,omitempty"`
+	Start           time.Time          `json:"start"`
+	DurationSeconds float64            `json:"duration_seconds"`
+	Phases          map[string]float64 `json:"phases_seconds"`
+	SnapshotLSN     string             `json:"snapshot_lsn,omitempty"`
+	SnapshotTime    *time.Time         `json:"snapshot_time,omitempty"`
+	Propagation     float64            `json:"propagation_latency_seconds,omitempty"`
+	Path            string             `json:"path"`
+	Users           int                `json:"users"`
+	Changed         bool               `json:"changed"`
+	Added           []string           `json:"added,omitempty"`
+	Removed         []string           `json:"removed,omitempty"`
+	Updated         []string           `json:"updated,omitempty"`
+	Attempts        int                `json:"attempts"`
+	CircuitOpen     bool               `json:"circuit_open,omitempty"`
+	Paused          bool               `json:"paused,omitempty"`
+	Frozen          bool               `json:"frozen,omitempty"`
+	PendingApproval bool               `json:"pending_approval,omitempty"`
+	DryRun          bool               `json:"dry_run,omitempty"`
+	Failures        int                `json:"consecutive_failures"`
+	ErrorClass      string             `json:"error_class,omitempty"`
+	Error           string             `json:"error,omitempty"`
+}
+
+// printRunResult prints the run report to w in the format requested by -output.
+// Text output is empty because the run is already described by the log.
+func printRunResult(w io.Writer, report *runReport) error {
+	switch *outputFormat {
+	case outputJSON:
+		return printReportJSON(w, report)
+	case outputAnsible:
+		return printAnsibleResult(w, report)
+	default:
+		return nil
+	}
+}
+
+func printReportJSON(w io.Writer, report *runReport) error {
+	result := reportJSON{
+		Cluster:         *cluster,
+		Labels:          runLabels,
+		RunID:           report.RunID,
+		Start:           report.Start.UTC(),
+		DurationSeconds: report.Duration.Seconds(),
+		Phases:          report.Phases.Seconds(),
+		Propagation:     report.PropagationLatency.Seconds(),
+		Path:            *filePath,
+		Users:           report.Users,
+		Changed:         report.Changed,
+		Added:           report.Added,
+		Removed:         report.Removed,
+		Updated:         report.Updated,
+		Attempts:        report.Attempts,
+		CircuitOpen:     report.CircuitOpen,
+		Paused:          report.Paused,
+		Frozen:          report.Frozen,
+		PendingApproval: report.PendingApproval,
+		DryRun:          report.DryRun,
+		Failures:        report.ConsecutiveFailures,
+		ErrorClass:      report.ErrClass,
+	}
+	if report.Snapshot != nil {
+		snapshotTime := report.Snapshot.Time.UTC()
+		result.SnapshotLSN, result.SnapshotTime = report.Snapshot.LSN, &snapshotTime
+	}
+	if report.Err != nil {
+		result.Error = report.Err.Error()
+	}
+	return json.NewEncoder(w).Encode(result)
+}
+
+func printAnsibleResult(w io.Writer, report *runReport) error {
+	result := ansibleResult{Changed: report.Changed, Users: report.Users, Path: *filePath, Cluster: *cluster}
+	switch {
+	case report.Err != nil:
+		result.Failed, result.Msg = true, report.Err.Error()
+	case report.Paused:
+		result.Msg = pauseStatus()
+	case report.PendingApproval:
+		result.Msg = fmt.Sprintf("change of %d user(s) is staged for approval", len(report.Added)+len(report.Removed)+len(report.Updated))
+	case report.Frozen:
+		result.Msg = fmt.Sprintf("changes are frozen, %d user(s) differ", len(report.Added)+len(report.Removed)+len(report.Updated))
+	case report.DryRun && report.Changed:
+		result.Msg = fmt.Sprintf("userlist would be updated with %d users", report.Users)
+	case report.Changed:
+		result.Msg = fmt.Sprintf("userlist updated with %d users", report.Users)
+	default:
+		result.Msg = fmt.Sprintf("userlist is up to date with %d users", report.Users)
+	}
+	return json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// adminReload is the admin console command reloading pgbouncer configuration and auth_file.
+const adminReload = "RELOAD"
+
+// peerPollInterval is the interval between SHOW USERS of a peer which hasn't loaded the userlist yet.
+const peerPollInterval = 200 * time.Millisecond
+
+// peerAdminRunner runs commands in admin consoles of pgbouncer peers sharing the listen socket
+// with so_reuseport, each of them listens on its own port for admin connections.
+type peerAdminRunner struct {
+	dsn   string
+	ports []string
+}
+
+// Run runs the command on every peer, it fails if any of them hasn't acknowledged it.
+func (r peerAdminRunner) Run(command string, timeout time.Duration, env []string) error {
+	if len(r.ports) == 0 {
+		return pgcatAdminRunner{dsn: r.dsn}.Run(command, timeout, env)
+	}
+	dsn, err := keyValueDSN(r.dsn)
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, port := range r.ports {
+		// the last port of the connection string wins.
+		if err := (pgcatAdminRunner{dsn: dsn + " port=" + port}).Run(command, timeout, env); err != nil {
+			failed = append(failed, fmt.Sprintf("port %s: %s", port, err))
+		}
+	}
+	return peersError(failed, len(r.ports))
+}
+
+// keyValueDSN converts URL connection strings to key=value ones, which take the port of a peer appended.
+func keyValueDSN(dsn string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		return pq.ParseURL(dsn)
+	}
+	return dsn, nil
+}
+
+// verifyPeers polls admin consoles of the peers with SHOW USERS until each of them lists
+// every user of -path, so peers which haven't re-read auth_file after SIGHUP are reported.
+func verifyPeers(dsn string, ports []string, timeout time.Duration) error {
+	users, err := readUserList(*filePath)
+	if err != nil {
+		return err
+	}
+	if dsn, err = keyValueDSN(dsn); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	var failed []string
+	for _, port := range ports {
+		missing, err := waitForPeerUsers(dsn+" port="+port, users, deadline)
+		switch {
+		case err != nil:
+			failed = append(failed, fmt.Sprintf("port %s: %s", port, err))
+		case len(missing) > 0:
+			failed = append(failed, fmt.Sprintf("port %s: %d users of %s are not loaded after the reload, like %s",
+				port, len(missing), *filePath, missing[0]))
+		}
+	}
+	return peersError(failed, len(ports))
+}
+
+// waitForPeerUsers returns sorted users the peer doesn't list by the deadline.
+func waitForPeerUsers(dsn string, users map[string]string, deadline time.Time) ([]string, error) {
+	connector, err := pq.NewConnector(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db := sql.OpenDB(connector)
+	// nolint:errcheck
+	defer db.Close()
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	for {
+		loaded, err := peerUsers(ctx, db)
+		if err != nil {
+			return nil, err
+		}
+		var missing []string
+		for username := range users {
+			if !loaded[username] {
+				missing = append(missing, username)
+			}
+		}
+		sort.Strings(missing)
+		if len(missing) == 0 || !time.Now().Before(deadline) {
+			return missing, nil
+		}
+		select {
+		case <-ctx.Done():
+			return missing, nil
+		case <-time.After(peerPollInterval):
+		}
+	}
+}
+
+// peerUsers returns names of users listed by SHOW USERS, users of auth_file among them.
+func peerUsers(ctx context.Context, db *sql.DB) (map[string]bool, error) {
+	rows, err := db.QueryContext(ctx, "SHOW USERS")
+	if err != nil {
+		return nil, err
+	}
+	// nolint:errcheck
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	// the name comes first, other columns differ between pgbouncer versions.
+	values := make([]interface{}, len(columns))
+	var name sql.NullString
+	values[0] = &name
+	for i := 1; i < len(values); i++ {
+		values[i] = new(sql.RawBytes)
+	}
+	users := make(map[string]bool)
+	for rows.Next() {
+		if err := rows.Scan(values...); err != nil {
+			return nil, err
+		}
+		users[name.String] = true
+	}
+	return users, rows.Err()
+}
+
+// peersError returns the error of failed peers.
+func peersError(failed []string, total int) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d pgbouncer peers failed: %s", len(failed), total, strings.Join(failed, "; "))
+}
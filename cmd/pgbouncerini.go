@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxIniIncludeDepth protects against %include loops.
+const maxIniIncludeDepth = 10
+
+// pgbouncerIni holds pgbouncer.ini sections and their keys, both lower-cased.
+type pgbouncerIni map[string]map[string]string
+
+// get returns a value from the section, empty if it is not set.
+func (ini pgbouncerIni) get(section, key string) string {
+	return ini[strings.ToLower(section)][strings.ToLower(key)]
+}
+
+// readPgbouncerIni parses pgbouncer.ini following %include directives.
+func readPgbouncerIni(path string) (pgbouncerIni, error) {
+	ini := make(pgbouncerIni)
+	if err := ini.load(path, "", 0); err != nil {
+		return nil, err
+	}
+	return ini, nil
+}
+
+func (ini pgbouncerIni) load(path, section string, depth int) error {
+	if depth > maxIniIncludeDepth {
+		return fmt.Errorf("%s: too many nested includes", path)
+	}
+	path = filepath.Clean(path)
+	// nolint:gosec
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	// nolint:errcheck,gosec
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", strings.HasPrefix(line, ";"), strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "%include"):
+			include := strings.TrimSpace(strings.TrimPrefix(line, "%include"))
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(path), include)
+			}
+			if err := ini.load(include, section, depth+1); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+		default:
+			idx := strings.Index(line, "=")
+			if idx < 0 {
+				continue
+			}
+			if ini[section] == nil {
+				ini[section] = make(map[string]string)
+			}
+			key := strings.ToLower(strings.TrimSpace(line[:idx]))
+			ini[section][key] = strings.TrimSpace(line[idx+1:])
+		}
+	}
+	return scanner.Err()
+}
+
+// authFile returns auth_file of [pgbouncer] section resolved against the directory of ini file.
+func (ini pgbouncerIni) authFile(iniPath string) string {
+	authFile := ini.get("pgbouncer", "auth_file")
+	if authFile != "" && !filepath.IsAbs(authFile) {
+		authFile = filepath.Join(filepath.Dir(iniPath), authFile)
+	}
+	return authFile
+}
+
+// authFileDiscovered is set once -path has been taken from pgbouncer.ini.
+var authFileDiscovered bool
+
+// retargetFromIni points -path to auth_file of -pgbouncer-ini if -auth-file-from-ini is set,
+// so moving auth_file in pgbouncer configuration doesn't orphan the generator.
+func retargetFromIni() error {
+	if !*authFileFromIni {
+		return nil
+	}
+	ini, err := readPgbouncerIni(*pgbouncerIniPath)
+	if err != nil {
+		return fmt.Errorf("discover auth_file: %w", err)
+	}
+	authFile := ini.authFile(*pgbouncerIniPath)
+	if authFile == "" {
+		return fmt.Errorf("discover auth_file: auth_file is not set in %s", *pgbouncerIniPath)
+	}
+	switch {
+	case !authFileDiscovered:
+		log.Printf("[INFO] writing userlist to auth_file %s of %s\n", authFile, *pgbouncerIniPath)
+	case filepath.Clean(authFile) != filepath.Clean(*filePath):
+		log.Printf("[WARN] auth_file of %s moved from %s to %s, the old file is no longer managed\n", *pgbouncerIniPath, *filePath, authFile)
+		forgetManaged(*filePath)
+	}
+	authFileDiscovered = true
+	*filePath = authFile
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// pgcatReload is the admin command reloading pgcat configuration.
+const pgcatReload = "RELOAD"
+
+// pgcatAdapter writes pgcat users toml reloaded with the shell command,
+// or with RELOAD sent to the admin database if the command is empty.
+type pgcatAdapter struct {
+	pool     string
+	poolSize int
+	poolMode string
+	admin    string
+}
+
+func (a pgcatAdapter) Reload(command string) (string, userlist.Runner) {
+	if command == "" && a.admin != "" {
+		return pgcatReload, pgcatAdminRunner{dsn: a.admin}
+	}
+	return command, runner
+}
+
+// Render renders users as [pools.<pool>.users.<n>] tables sorted by name,
+// to be included into pgcat.toml.
+func (a pgcatAdapter) Render(users map[string]string, _ *strictLog) []byte {
+	names := make([]string, 0, len(users))
+	for username := range users {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("# generated by pgbouncer-userlist-generator, do not edit\n")
+	for i, username := range names {
+		fmt.Fprintf(&b, "\n[pools.%s.users.%d]\n", tomlString(a.pool), i)
+		fmt.Fprintf(&b, "username = %s\n", tomlString(username))
+		fmt.Fprintf(&b, "password = %s\n", tomlString(users[username]))
+		fmt.Fprintf(&b, "pool_size = %d\n", a.poolSize)
+		if a.poolMode != "" {
+			fmt.Fprintf(&b, "pool_mode = %s\n", tomlString(a.poolMode))
+		}
+	}
+	return []byte(b.String())
+}
+
+// tomlString returns toml basic string.
+func tomlString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			fmt.Fprintf(&b, "\\u%04X", r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// pgcatAdminRunner runs commands in pgcat admin database.
+type pgcatAdminRunner struct {
+	dsn string
+}
+
+func (r pgcatAdminRunner) Run(command string, timeout time.Duration, _ []string) error {
+	connector, err := pq.NewConnector(r.dsn)
+	if err != nil {
+		return err
+	}
+	db := sql.OpenDB(connector)
+	// nolint:errcheck
+	defer db.Close()
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	_, err = db.ExecContext(ctx, command)
+	return err
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/md5" // nolint:gosec
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+// md5Secret returns the secret postgres stores for the password with password_encryption = md5.
+func md5Secret(username, password string) string {
+	// nolint:gosec
+	sum := md5.Sum([]byte(password + username))
+	return "md5" + hex.EncodeToString(sum[:])
+}
+
+// readPlaintextRelation reads users with plain text passwords from -plaintext-relation.
+func (f *fetcher) readPlaintextRelation(ctx context.Context, db *sql.DB, relation string) (map[string]string, error) {
+	quoted, err := quoteRelation(relation)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, `select usename, passwd from `+quoted+` where usename is not null and passwd is not null`)
+	if err != nil {
+		return nil, err
+	}
+	// nolint:errcheck
+	defer rows.Close()
+	users := make(map[string]string)
+	for rows.Next() {
+		var username, password string
+		if err := rows.Scan(&username, &password); err != nil {
+			return nil, err
+		}
+		if first, ok := users[username]; ok {
+			if first != password {
+				f.warnings.warnSkipped("user %q has several plain text passwords in %s, the first one is used", username, relation)
+			}
+			continue
+		}
+		users[username] = password
+	}
+	return users, rows.Err()
+}
+
+// mergePlaintext adds users of -plaintext-file and -plaintext-relation to the users read
+// from the catalog, plain text passwords are hashed with md5 and secrets are kept as is.
+// Users which are in the catalog keep their catalog secrets.
+func (f *fetcher) mergePlaintext(ctx context.Context, db *sql.DB, users map[string]string) (map[string]string, error) {
+	sources := make([]map[string]string, 0, 2)
+	names := make([]string, 0, 2)
+	if f.plaintextFile != "" {
+		external, err := readUserList(f.plaintextFile)
+		if err != nil {
+			return nil, fmt.Errorf("read plaintext file: %w", err)
+		}
+		sources, names = append(sources, external), append(names, f.plaintextFile)
+	}
+	if f.plaintextRelation != "" && *simulateRoles == 0 {
+		external, err := f.readPlaintextRelation(ctx, db, f.plaintextRelation)
+		if err != nil {
+			return nil, fmt.Errorf("read plaintext relation %s: %w", f.plaintextRelation, err)
+		}
+		sources, names = append(sources, external), append(names, f.plaintextRelation)
+	}
+	catalogUsers := make(map[string]bool, len(users))
+	for username := range users {
+		catalogUsers[username] = true
+	}
+	// origin is the source where the plain text password of the user is found first.
+	origin := make(map[string]string)
+	for i, external := range sources {
+		for username, password := range external {
+			if catalogUsers[username] {
+				f.warnings.warnSkipped("plain text password of user %q is shadowed by pg_authid", username)
+				continue
+			}
+			if first, ok := origin[username]; ok {
+				f.warnings.warnSkipped("plain text password of user %q in %s is shadowed by %s", username, names[i], first)
+				continue
+			}
+			origin[username] = names[i]
+			if passwordType(password) == passwordPlain {
+				password = md5Secret(username, password)
+			}
+			users[username] = password
+		}
+	}
+	return users, nil
+}
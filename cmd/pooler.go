@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+const (
+	poolerPgbouncer = "pgbouncer"
+	poolerOdyssey   = "odyssey"
+	poolerPgcat     = "pgcat"
+)
+
+// poolerAdapter bundles the output format of a pooler with its reload mechanism.
+type poolerAdapter interface {
+	// Render returns content of the output file with the users, warnings
+	// about users left out are recorded to the warnings of the run.
+	Render(users map[string]string, warnings *strictLog) []byte
+	// Reload returns the effective reload command of the output and the runner executing it.
+	Reload(command string) (string, userlist.Runner)
+}
+
+// poolerAdapters creates adapters by name, options of adapters come from flags.
+var poolerAdapters = map[string]func() poolerAdapter{
+	poolerPgbouncer: func() poolerAdapter { return pgbouncerAdapter{} },
+	poolerOdyssey: func() poolerAdapter {
+		return odysseyAdapter{database: *odysseyDatabase, storage: *odysseyStorage, pool: *odysseyPool}
+	},
+	poolerPgcat: func() poolerAdapter {
+		return pgcatAdapter{pool: *pgcatPool, poolSize: *pgcatPoolSize, poolMode: *pgcatPoolMode, admin: *pgcatAdmin}
+	},
+}
+
+// newPoolerAdapter returns adapter of the pooler, empty name is pgbouncer.
+func newPoolerAdapter(name string) (poolerAdapter, error) {
+	if name == "" {
+		name = poolerPgbouncer
+	}
+	newAdapter, ok := poolerAdapters[name]
+	if !ok {
+		names := make([]string, 0, len(poolerAdapters))
+		for n := range poolerAdapters {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown pooler %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return newAdapter(), nil
+}
+
+// pgbouncerAdapter writes userlist.txt reloaded with the shell command.
+type pgbouncerAdapter struct{}
+
+func (pgbouncerAdapter) Render(users map[string]string, _ *strictLog) []byte {
+	return userlist.Render(users)
+}
+
+func (pgbouncerAdapter) Reload(command string) (string, userlist.Runner) {
+	return pgbouncerReload(command)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	preflightOK   = "OK"
+	preflightWarn = "WARN"
+	preflightFail = "FAIL"
+)
+
+// preflightResult is the outcome of a single preflight check.
+type preflightResult struct {
+	name        string
+	status      string
+	detail      string
+	remediation string
+}
+
+// runPreflight verifies that the environment is able to run the generator
+// and prints a report with remediation hints for every failed check.
+func runPreflight(ctx context.Context, db *sql.DB) error {
+	connectivity := checkDBConnectivity(ctx, db)
+	catalog := preflightResult{name: "pg_authid read permission", status: preflightWarn, detail: "skipped, database is unreachable"}
+	if connectivity.status == preflightOK {
+		catalog = checkCatalogRead(ctx, db)
+	}
+	results := []preflightResult{
+		connectivity,
+		catalog,
+		checkWritableDir("userlist directory", filepath.Dir(*filePath)),
+		checkWritableDir("trigger file directory", filepath.Dir(*reloadTriggerFile)),
+		checkReloadCommand(*reloadCommand),
+		checkFileMode(*filePath),
+		checkSELinux(*filePath),
+		checkAppArmor(*filePath),
+		checkSystemdSandbox(*pgbouncerUnit, *filePath),
+	}
+	return printReport(results)
+}
+
+// printReport prints check results and fails if any of them has failed.
+func printReport(results []preflightResult) error {
+	failed := 0
+	for _, r := range results {
+		fmt.Printf("[%s] %s", r.status, r.name)
+		if r.detail != "" {
+			fmt.Printf(": %s", r.detail)
+		}
+		fmt.Println()
+		if r.status != preflightOK && r.remediation != "" {
+			fmt.Printf("       remediation: %s\n", r.remediation)
+		}
+		if r.status == preflightFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d check(s) failed", failed)
+	}
+	return nil
+}
+
+func checkDBConnectivity(ctx context.Context, db *sql.DB) preflightResult {
+	r := preflightResult{name: "database connectivity", status: preflightOK}
+	if err := db.PingContext(ctx); err != nil {
+		r.status, r.detail = preflightFail, err.Error()
+		r.remediation = "check -connection (host, port, sslmode, credentials) and pg_hba.conf on the server"
+	}
+	return r
+}
+
+func checkCatalogRead(ctx context.Context, db *sql.DB) preflightResult {
+	r := preflightResult{name: "pg_authid read permission", status: preflightOK}
+	var username, password sql.NullString
+	err := db.QueryRowContext(ctx, `select rolname, rolpassword from pg_authid limit 1`).Scan(&username, &password)
+	if err != nil && err != sql.ErrNoRows {
+		r.status, r.detail = preflightFail, err.Error()
+		r.remediation = "connect as a superuser, or run as superuser: GRANT SELECT ON pg_catalog.pg_authid TO <role>"
+		if isInsufficientPrivilege(err) && *fallbackRelation != "" {
+			return checkFallbackRead(ctx, db, r)
+		}
+	}
+	return r
+}
+
+// checkFallbackRead downgrades denied pg_authid read to warning when -fallback-relation is readable.
+func checkFallbackRead(ctx context.Context, db *sql.DB, r preflightResult) preflightResult {
+	query, err := fallbackUsersQuery(*fallbackRelation)
+	if err == nil {
+		var rows *sql.Rows
+		if rows, err = db.QueryContext(ctx, query+" limit 1", pq.Array([]string{})); err == nil {
+			// nolint:errcheck
+			rows.Close()
+		}
+	}
+	if err != nil {
+		r.detail += "; fallback " + *fallbackRelation + ": " + err.Error()
+		return r
+	}
+	r.status = preflightWarn
+	r.detail += "; users are read from " + *fallbackRelation
+	return r
+}
+
+func checkWritableDir(name, dir string) preflightResult {
+	r := preflightResult{name: name + " is writable", status: preflightOK, detail: dir}
+	fd, err := os.CreateTemp(dir, ".preflight-")
+	if err != nil {
+		r.status, r.detail = preflightFail, err.Error()
+		r.remediation = fmt.Sprintf("create %s and make it writable for uid %d (files are renamed in place, so the directory itself must be writable)", dir, os.Geteuid())
+		if cause := accessDeniedCause(err); cause != "" {
+			r.remediation += "; " + cause
+		}
+		return r
+	}
+	// nolint:errcheck,gosec
+	fd.Close()
+	// nolint:errcheck
+	os.Remove(fd.Name())
+	return r
+}
+
+func checkReloadCommand(command string) preflightResult {
+	if *reloadAdmin != "" {
+		return checkReloadAdmin(peerAdminRunner{dsn: *reloadAdmin, ports: splitNames(*reloadAdminPorts)})
+	}
+	if *reloadPidfile != "" || *reloadProcess != "" {
+		return checkReloadSignal(signalRunner{pidfile: *reloadPidfile, process: *reloadProcess})
+	}
+	r := preflightResult{name: "reload command", status: preflightOK, detail: command}
+	if _, err := exec.LookPath("/bin/bash"); err != nil {
+		r.status, r.detail = preflightFail, err.Error()
+		r.remediation = "the reload command is executed with /bin/bash -ec, install bash"
+		return r
+	}
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		r.status, r.detail = preflightFail, "empty command"
+		r.remediation = "set -reload-command, e.g. \"systemctl reload pgbouncer\""
+		return r
+	}
+	if _, err := exec.LookPath(fields[0]); err != nil {
+		r.status, r.detail = preflightFail, err.Error()
+		r.remediation = fmt.Sprintf("install %s or point -reload-command to an available executable", fields[0])
+	}
+	return r
+}
+
+func checkReloadSignal(r signalRunner) preflightResult {
+	result := preflightResult{name: "reload signal", status: preflightOK}
+	pids, err := r.pids()
+	if err != nil {
+		result.status, result.detail = preflightFail, err.Error()
+		result.remediation = "point -reload-pidfile to pidfile of pgbouncer or -reload-process to its process name"
+		return result
+	}
+	result.detail = fmt.Sprintf("SIGHUP to pid %v", pids)
+	return result
+}
+
+func checkReloadAdmin(r peerAdminRunner) preflightResult {
+	result := preflightResult{name: "reload admin console", status: preflightOK, detail: adminReload + " in admin console"}
+	if len(r.ports) > 0 {
+		result.detail = fmt.Sprintf("%s in admin consoles on ports %s", adminReload, strings.Join(r.ports, ", "))
+	}
+	if err := r.Run("SHOW VERSION", *reloadTimeout, nil); err != nil {
+		result.status, result.detail = preflightFail, err.Error()
+		result.remediation = "check -reload-admin and -reload-admin-ports, the user must be in admin_users of pgbouncer"
+	}
+	return result
+}
+
+func checkFileMode(path string) preflightResult {
+	r := preflightResult{name: "userlist file mode", status: preflightOK, detail: path}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		r.detail = path + " does not exist yet, it will be created with mode 0600"
+		return r
+	}
+	if err != nil {
+		r.status, r.detail = preflightFail, err.Error()
+		r.remediation = "make sure the current user can stat the userlist file"
+		return r
+	}
+	if mode := info.Mode().Perm(); mode&0077 != 0 {
+		r.status, r.detail = preflightWarn, fmt.Sprintf("%s has mode %#o and exposes password hashes", path, mode)
+		r.remediation = fmt.Sprintf("chmod 600 %s", path)
+		return r
+	}
+	if uid, ok := fileOwner(info); ok && uid != os.Geteuid() {
+		r.status = preflightWarn
+		r.detail = fmt.Sprintf("%s is owned by uid %d, but regenerated files will be owned by uid %d with mode 0600", path, uid, os.Geteuid())
+		r.remediation = "run the generator as the pgbouncer user, otherwise pgbouncer may lose read access after the first update"
+	}
+	return r
+}
+
+func checkSELinux(path string) preflightResult {
+	r := preflightResult{name: "SELinux", status: preflightOK}
+	if !selinuxEnforcing() {
+		r.detail = "not enforcing"
+		return r
+	}
+	label, ok := selinuxLabel(filepath.Dir(path))
+	if !ok {
+		r.status, r.detail = preflightWarn, "enforcing, unable to read the label of "+filepath.Dir(path)
+		r.remediation = fmt.Sprintf("check the context with: ls -Zd %s", filepath.Dir(path))
+		return r
+	}
+	r.detail = "enforcing, " + filepath.Dir(path) + " is labeled " + label
+	if !strings.Contains(label, "etc_t") && !strings.Contains(label, "pgbouncer") {
+		r.status = preflightWarn
+		r.remediation = fmt.Sprintf("pgbouncer may be denied reading files with this label, run: restorecon -Rv %s", filepath.Dir(path))
+	}
+	return r
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"syscall"
+)
+
+func fileOwner(info os.FileInfo) (int, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return int(stat.Uid), true
+}
+
+func selinuxLabel(path string) (string, bool) {
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(path, "security.selinux", buf)
+	if err != nil || n <= 0 {
+		return "", false
+	}
+	return strings.TrimRight(string(buf[:n]), "\x00"), true
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+func fileOwner(_ os.FileInfo) (int, bool) {
+	return 0, false
+}
+
+func selinuxLabel(_ string) (string, bool) {
+	return "", false
+}
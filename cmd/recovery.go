@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	recoveryContinue = "continue"
+	recoveryPause    = "pause"
+	recoveryPrimary  = "primary"
+
+	// recoveryCheckTimeout limits the pg_is_in_recovery() query before the run.
+	recoveryCheckTimeout = 10 * time.Second
+)
+
+// primaryDB is the handle connecting only to a primary of -connection, opened on the first
+// run finding the connected node in recovery with -recovery-policy=primary.
+var primaryDB *sql.DB
+
+func validateRecoveryPolicy() error {
+	switch *recoveryPolicy {
+	case recoveryContinue, recoveryPause, recoveryPrimary:
+		return nil
+	}
+	return fmt.Errorf("unknown -recovery-policy %q, expected %s, %s or %s", *recoveryPolicy, recoveryContinue, recoveryPause, recoveryPrimary)
+}
+
+// inRecovery tells whether the node of db is a standby.
+func inRecovery(db *sql.DB) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), recoveryCheckTimeout)
+	defer cancel()
+	var recovery bool
+	err := db.QueryRowContext(ctx, `select pg_is_in_recovery()`).Scan(&recovery)
+	return recovery, err
+}
+
+// recoveryHandle applies -recovery-policy when the connected node is in recovery, after a failover
+// it keeps serving data which may be stale. It returns the handle to run with, nil skips the run.
+func recoveryHandle(db *sql.DB) (*sql.DB, error) {
+	if *simulateRoles > 0 {
+		return db, nil
+	}
+	recovery, err := inRecovery(db)
+	if err != nil {
+		// the run fails on the same connection with a better error.
+		log.Printf("[WARN] check recovery: %s\n", err)
+		return db, nil
+	}
+	if !recovery {
+		return db, nil
+	}
+	switch *recoveryPolicy {
+	case recoveryPause:
+		log.Printf("[WARN] connected node is in recovery, skipping run by -recovery-policy=%s\n", *recoveryPolicy)
+		return nil, nil
+	case recoveryPrimary:
+		if primaryDB == nil {
+			hosts, errSplit := splitMultiHost(*connectionString)
+			if errSplit != nil {
+				return nil, errSplit
+			}
+			hosts.attrs = "primary"
+			handle, errOpen := openHosts(hosts)
+			if errOpen != nil {
+				return nil, errOpen
+			}
+			primaryDB = handle
+		}
+		log.Printf("[INFO] connected node is in recovery, running on primary by -recovery-policy=%s\n", *recoveryPolicy)
+		return primaryDB, nil
+	default:
+		log.Printf("[WARN] connected node is in recovery, the userlist may be stale\n")
+		return db, nil
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"text/template"
+)
+
+// shellWords is a list of shell quoted names, rendered as a single comma separated word.
+type shellWords []string
+
+func newShellWords(names []string) shellWords {
+	words := make(shellWords, 0, len(names))
+	for _, name := range names {
+		words = append(words, shellQuote(name))
+	}
+	return words
+}
+
+func (w shellWords) String() string {
+	if len(w) == 0 {
+		return "''"
+	}
+	return strings.Join(w, ",")
+}
+
+// reloadContext holds values available in -reload-command placeholders.
+// Strings are shell quoted, so they can't inject commands.
+type reloadContext struct {
+	Path         string
+	Users        int
+	ChangedCount int
+	Added        shellWords
+	Removed      shellWords
+	Updated      shellWords
+}
+
+// renderReloadCommand fills -reload-command placeholders like {{.Path}} or {{.Added}} from the run report.
+func renderReloadCommand(command, path string, report *runReport) (string, error) {
+	if !strings.Contains(command, "{{") {
+		return command, nil
+	}
+	tmpl, err := template.New("reload-command").Option("missingkey=error").Parse(command)
+	if err != nil {
+		return "", err
+	}
+	data := reloadContext{
+		Path:         shellQuote(path),
+		Users:        report.Users,
+		ChangedCount: len(report.Added) + len(report.Removed) + len(report.Updated),
+		Added:        newShellWords(report.Added),
+		Removed:      newShellWords(report.Removed),
+		Updated:      newShellWords(report.Updated),
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
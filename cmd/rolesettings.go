@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// roleSettingPrefix is the prefix of role settings read as generation hints,
+// like ALTER ROLE app SET pgbouncer.pool_mode = 'transaction'.
+const roleSettingPrefix = "pgbouncer."
+
+// roleSettingUserlist set to off leaves the role out of generated files.
+const roleSettingUserlist = "userlist"
+
+// usersSectionKeys are settings of pgbouncer [users] section.
+var usersSectionKeys = map[string]bool{
+	"pool_mode":                   true,
+	"pool_size":                   true,
+	"reserve_pool_size":           true,
+	"max_user_connections":        true,
+	"max_user_client_connections": true,
+}
+
+// roleSettingsQuery selects settings of roles set for all databases.
+const roleSettingsQuery = `
+select r.rolname, s.setconfig
+from pg_catalog.pg_db_role_setting as s
+    join pg_catalog.pg_roles as r on r.oid = s.setrole
+where s.setdatabase = 0
+`
+
+// readRoleSettings returns pgbouncer.* settings of roles without the prefix.
+func readRoleSettings(ctx context.Context, db *sql.DB) (map[string]map[string]string, error) {
+	rows, err := db.QueryContext(ctx, roleSettingsQuery)
+	if err != nil {
+		return nil, err
+	}
+	// nolint:errcheck
+	defer rows.Close()
+	settings := make(map[string]map[string]string)
+	for rows.Next() {
+		var rolname string
+		var config []string
+		if err := rows.Scan(&rolname, pq.Array(&config)); err != nil {
+			return nil, err
+		}
+		for _, setting := range config {
+			i := strings.IndexByte(setting, '=')
+			if i < 0 || !strings.HasPrefix(setting[:i], roleSettingPrefix) {
+				continue
+			}
+			if settings[rolname] == nil {
+				settings[rolname] = make(map[string]string)
+			}
+			settings[rolname][strings.TrimPrefix(setting[:i], roleSettingPrefix)] = setting[i+1:]
+		}
+	}
+	return settings, rows.Err()
+}
+
+// applyRoleSettings drops users with pgbouncer.userlist = off and keeps
+// [users] section settings of the rest in the settings of the fetcher.
+func (f *fetcher) applyRoleSettings(ctx context.Context, db *sql.DB, users map[string]string) (map[string]string, error) {
+	settings, err := readRoleSettings(ctx, db)
+	if err != nil {
+		return nil, fmt.Errorf("read role settings: %w", err)
+	}
+	f.settings = make(map[string]map[string]string)
+	for rolname, s := range settings {
+		if _, ok := users[rolname]; !ok {
+			continue
+		}
+		for key, value := range s {
+			switch {
+			case key == roleSettingUserlist:
+				if !settingEnabled(value) {
+					delete(users, rolname)
+				}
+			case usersSectionKeys[key]:
+				if f.settings[rolname] == nil {
+					f.settings[rolname] = make(map[string]string)
+				}
+				f.settings[rolname][key] = value
+			default:
+				f.warnings.warnStrict("ignoring it", "unknown setting %s%s of role %q", roleSettingPrefix, key, rolname)
+			}
+		}
+	}
+	for rolname := range f.settings {
+		if _, ok := users[rolname]; !ok {
+			delete(f.settings, rolname)
+		}
+	}
+	return users, nil
+}
+
+// usersTableQuery selects [users] section settings of the control table.
+const usersTableQuery = `select rolname::text, setting::text, value::text from %s where value is not null`
+
+// applyUsersTable adds [users] section settings of -users-table to the settings of the fetcher,
+// they override settings of roles read with -role-settings.
+func (f *fetcher) applyUsersTable(ctx context.Context, db *sql.DB, users map[string]string) error {
+	relation, err := quoteRelation(f.usersTable)
+	if err != nil {
+		return err
+	}
+	rows, err := db.QueryContext(ctx, fmt.Sprintf(usersTableQuery, relation))
+	if err != nil {
+		return fmt.Errorf("read users table %s: %w", f.usersTable, err)
+	}
+	// nolint:errcheck
+	defer rows.Close()
+	if f.settings == nil {
+		f.settings = make(map[string]map[string]string)
+	}
+	for rows.Next() {
+		var rolname, key, value string
+		if err := rows.Scan(&rolname, &key, &value); err != nil {
+			return err
+		}
+		if _, ok := users[rolname]; !ok {
+			continue
+		}
+		if !usersSectionKeys[key] {
+			f.warnings.warnStrict("ignoring it", "unknown setting %s of role %q in %s", key, rolname, f.usersTable)
+			continue
+		}
+		if f.settings[rolname] == nil {
+			f.settings[rolname] = make(map[string]string)
+		}
+		f.settings[rolname][key] = value
+	}
+	return rows.Err()
+}
+
+// settingEnabled parses boolean setting like postgres does, unknown values are on.
+func settingEnabled(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "off", "false", "no", "0":
+		return false
+	default:
+		return true
+	}
+}
+
+// usersSectionAdapter writes pgbouncer [users] section with role settings,
+// to be included at the end of pgbouncer.ini with %include.
+type usersSectionAdapter struct {
+	// settings are settings of the fetched users by name.
+	settings map[string]map[string]string
+}
+
+func (a usersSectionAdapter) Reload(command string) (string, userlist.Runner) {
+	return pgbouncerReload(command)
+}
+
+// Render renders settings of the users sorted by name, users whose names
+// or settings can't be written to pgbouncer ini are skipped.
+func (a usersSectionAdapter) Render(users map[string]string, warnings *strictLog) []byte {
+	userSettings := a.settings
+	names := make([]string, 0, len(userSettings))
+	for username := range userSettings {
+		if _, ok := users[username]; ok {
+			names = append(names, username)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("# generated by pgbouncer-userlist-generator, do not edit\n")
+	b.WriteString("[users]\n")
+	for _, username := range names {
+		keys := make([]string, 0, len(userSettings[username]))
+		for key := range userSettings[username] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, 0, len(keys))
+		for _, key := range keys {
+			pairs = append(pairs, key+"="+userSettings[username][key])
+		}
+		line := strings.Join(pairs, " ")
+		if strings.ContainsAny(username, " \t\n=;#\"'") || strings.ContainsAny(line, "\n;#") {
+			warnings.warnStrict("leaving them out", "settings of user %q can't be written to pgbouncer ini", username)
+			continue
+		}
+		fmt.Fprintf(&b, "%s = %s\n", username, line)
+	}
+	return []byte(b.String())
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// rollback moves the backup made by the run back over -path and reloads pgbouncer again
+// after the reload or the canary login failed with errFailed, returning the error of the run.
+func rollback(errFailed error, report *runReport) error {
+	all, err := backups(*filePath)
+	if err != nil {
+		return fmt.Errorf("%w, rollback: %s", errFailed, err)
+	}
+	if len(all) == 0 {
+		return fmt.Errorf("%w, nothing to roll back to", errFailed)
+	}
+	backup := all[len(all)-1]
+	if stamp, _ := strconv.ParseInt(strings.TrimPrefix(backup, *filePath+".backup-"), 10, 64); stamp < report.Start.Unix() {
+		return fmt.Errorf("%w, the run has no backup to roll back to", errFailed)
+	}
+	file := &userlist.File{Path: *filePath, TriggerFile: *reloadTriggerFile, Timings: report.Phases}
+	if err := file.Rollback(backup); err != nil {
+		return fmt.Errorf("%w, rollback to %s: %s", errFailed, backup, err)
+	}
+	command, reloader := pgbouncerReload(*reloadCommand)
+	if err := processTriggerFile(*reloadTriggerFile, *filePath, command, reloader, report); err != nil {
+		return fmt.Errorf("%w, rolled back to %s, reload: %s", errFailed, backup, err)
+	}
+	log.Printf("[WARN] %s rolled back to %s after: %s\n", *filePath, backup, errFailed)
+	return fmt.Errorf("%w, rolled back to %s", errFailed, backup)
+}
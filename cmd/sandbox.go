@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// selinuxEnforcing reports whether SELinux is in enforcing mode.
+func selinuxEnforcing() bool {
+	enforce, err := os.ReadFile("/sys/fs/selinux/enforce")
+	return err == nil && strings.TrimSpace(string(enforce)) == "1"
+}
+
+// apparmorProfile returns AppArmor profile confining the current process, if any.
+func apparmorProfile() (string, bool) {
+	enabled, err := os.ReadFile("/sys/module/apparmor/parameters/enabled")
+	if err != nil || !strings.HasPrefix(string(enabled), "Y") {
+		return "", false
+	}
+	current, err := os.ReadFile("/proc/self/attr/current")
+	if err != nil {
+		return "", false
+	}
+	profile := strings.TrimSpace(strings.TrimRight(string(current), "\x00"))
+	if profile == "" || profile == "unconfined" {
+		return "", false
+	}
+	return profile, true
+}
+
+// accessDeniedCause names the mechanisms which may produce the error,
+// which is an opaque EACCES or EROFS otherwise.
+func accessDeniedCause(err error) string {
+	var causes []string
+	switch {
+	case errors.Is(err, syscall.EROFS):
+		causes = append(causes, "the file system is read-only, check systemd ProtectSystem/ReadOnlyPaths of the unit and mount options")
+	case errors.Is(err, syscall.EACCES), errors.Is(err, syscall.EPERM):
+		if selinuxEnforcing() {
+			causes = append(causes, "SELinux is enforcing, check denials with: ausearch -m avc -ts recent")
+		}
+		if profile, ok := apparmorProfile(); ok {
+			causes = append(causes, "AppArmor profile "+profile+" confines the generator, check denials with: journalctl -k | grep apparmor")
+		}
+		if os.Getenv("INVOCATION_ID") != "" {
+			causes = append(causes, "running under systemd, check ProtectSystem/ReadWritePaths of the unit")
+		}
+	}
+	return strings.Join(causes, "; ")
+}
+
+func checkAppArmor(path string) preflightResult {
+	r := preflightResult{name: "AppArmor", status: preflightOK}
+	enabled, err := os.ReadFile("/sys/module/apparmor/parameters/enabled")
+	if err != nil || !strings.HasPrefix(string(enabled), "Y") {
+		r.detail = "not enabled"
+		return r
+	}
+	dir := filepath.Dir(path)
+	if profile, ok := apparmorProfile(); ok {
+		r.status, r.detail = preflightWarn, "the generator is confined by "+profile
+		r.remediation = fmt.Sprintf("allow \"%s/** rw,\" in the profile and reload it with apparmor_parser -r", dir)
+		return r
+	}
+	r.detail = "enabled, the generator is unconfined"
+	for _, profile := range []string{"/etc/apparmor.d/usr.sbin.pgbouncer", "/etc/apparmor.d/usr.bin.pgbouncer"} {
+		// nolint:gosec
+		data, err := os.ReadFile(profile)
+		if err != nil {
+			continue
+		}
+		if !strings.Contains(string(data), dir) {
+			r.status, r.detail = preflightWarn, profile+" doesn't mention "+dir
+			r.remediation = fmt.Sprintf("allow \"%s r,\" in %s, otherwise pgbouncer may be denied reading the userlist", path, profile)
+		}
+		break
+	}
+	return r
+}
+
+// systemdSandbox holds sandboxing properties of a systemd unit.
+type systemdSandbox struct {
+	unit              string
+	protectSystem     string
+	protectHome       string
+	readWritePaths    []string
+	readOnlyPaths     []string
+	inaccessiblePaths []string
+}
+
+func readSystemdSandbox(unit string) (systemdSandbox, error) {
+	s := systemdSandbox{unit: unit}
+	// nolint:gosec
+	out, err := exec.Command("systemctl", "show", unit,
+		"-p", "ProtectSystem", "-p", "ProtectHome", "-p", "ReadWritePaths", "-p", "ReadOnlyPaths", "-p", "InaccessiblePaths").Output()
+	if err != nil {
+		return s, err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		idx := strings.Index(scanner.Text(), "=")
+		if idx < 0 {
+			continue
+		}
+		key, value := scanner.Text()[:idx], scanner.Text()[idx+1:]
+		switch key {
+		case "ProtectSystem":
+			s.protectSystem = value
+		case "ProtectHome":
+			s.protectHome = value
+		case "ReadWritePaths":
+			s.readWritePaths = sandboxPaths(value)
+		case "ReadOnlyPaths":
+			s.readOnlyPaths = sandboxPaths(value)
+		case "InaccessiblePaths":
+			s.inaccessiblePaths = sandboxPaths(value)
+		}
+	}
+	return s, scanner.Err()
+}
+
+// sandboxPaths splits paths of a property dropping "-" and "+" prefixes.
+func sandboxPaths(value string) []string {
+	fields := strings.Fields(value)
+	for i, field := range fields {
+		fields[i] = strings.TrimLeft(field, "-+")
+	}
+	return fields
+}
+
+func pathUnder(path string, dirs ...string) bool {
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		if path == dir || strings.HasPrefix(path, dir+"/") || dir == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// blocks returns the setting of the unit which makes the directory read-only or inaccessible.
+func (s systemdSandbox) blocks(dir string) string {
+	dir = filepath.Clean(dir)
+	if pathUnder(dir, s.inaccessiblePaths...) {
+		return "InaccessiblePaths"
+	}
+	if pathUnder(dir, s.readWritePaths...) {
+		return ""
+	}
+	if pathUnder(dir, s.readOnlyPaths...) {
+		return "ReadOnlyPaths"
+	}
+	switch s.protectSystem {
+	case "strict":
+		if !pathUnder(dir, "/dev", "/proc", "/sys") {
+			return "ProtectSystem=strict"
+		}
+	case "full":
+		if pathUnder(dir, "/usr", "/boot", "/efi", "/etc") {
+			return "ProtectSystem=full"
+		}
+	case "yes", "true":
+		if pathUnder(dir, "/usr", "/boot", "/efi") {
+			return "ProtectSystem=yes"
+		}
+	}
+	if s.protectHome != "" && s.protectHome != "no" && pathUnder(dir, "/home", "/root", "/run/user") {
+		return "ProtectHome=" + s.protectHome
+	}
+	return ""
+}
+
+// currentUnit returns systemd service running the generator, if any.
+func currentUnit() (string, bool) {
+	if os.Getenv("INVOCATION_ID") == "" {
+		return "", false
+	}
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if unit := filepath.Base(line); strings.HasSuffix(unit, ".service") {
+			return unit, true
+		}
+	}
+	return "", false
+}
+
+// checkSystemdSandbox reports sandboxing of the generator and pgbouncer units
+// which makes the userlist directory unwritable for their processes.
+func checkSystemdSandbox(unit, path string) preflightResult {
+	r := preflightResult{name: "systemd sandboxing", status: preflightOK}
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		r.detail = "systemctl is not available, skipped"
+		return r
+	}
+	dir := filepath.Dir(path)
+	units := []string{unit}
+	if own, ok := currentUnit(); ok && own != unit {
+		units = append(units, own)
+	}
+	var inspected, blocked []string
+	for _, u := range units {
+		s, err := readSystemdSandbox(u)
+		if err != nil {
+			continue
+		}
+		inspected = append(inspected, u)
+		if setting := s.blocks(dir); setting != "" {
+			blocked = append(blocked, fmt.Sprintf("%s of %s", setting, u))
+		}
+	}
+	if len(inspected) == 0 {
+		r.detail = "unable to inspect " + strings.Join(units, ", ") + ", skipped"
+		return r
+	}
+	if len(blocked) == 0 {
+		r.detail = dir + " is not protected by " + strings.Join(inspected, ", ")
+		return r
+	}
+	r.status = preflightWarn
+	r.detail = fmt.Sprintf("%s makes %s read-only for processes of the unit (ExecStartPre, ExecReload)", strings.Join(blocked, ", "), dir)
+	r.remediation = fmt.Sprintf("add ReadWritePaths=%s to the unit with systemctl edit", dir)
+	return r
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	scramAllow = "allow"
+	scramSkip  = "skip"
+	scramFail  = "fail"
+)
+
+// scramMinVersion is the first pgbouncer version verifying SCRAM-SHA-256 secrets of auth_file.
+var scramMinVersion = [2]int{1, 11}
+
+var versionRe = regexp.MustCompile(`([0-9]+)\.([0-9]+)`)
+
+var (
+	detectVersionOnce sync.Once
+	detectedVersion   string
+)
+
+// checkScramPolicy rejects unknown -scram policies.
+func checkScramPolicy(policy string) error {
+	switch policy {
+	case scramAllow, scramSkip, scramFail:
+		return nil
+	}
+	return fmt.Errorf("unknown -scram %q, expected %s, %s or %s", policy, scramAllow, scramSkip, scramFail)
+}
+
+func validateScram() error {
+	if *pgbouncerVersion != "" && !versionRe.MatchString(*pgbouncerVersion) {
+		return fmt.Errorf("-pgbouncer-version %q is not a version like 1.21", *pgbouncerVersion)
+	}
+	return nil
+}
+
+// targetVersion returns -pgbouncer-version or the version of pgbouncer binary
+// found in PATH, empty if it is unknown.
+func targetVersion() string {
+	if *pgbouncerVersion != "" {
+		return *pgbouncerVersion
+	}
+	detectVersionOnce.Do(func() {
+		out, err := exec.Command("pgbouncer", "--version").Output()
+		if err != nil {
+			log.Printf("[DEBUG] unable to detect pgbouncer version: %s\n", err)
+			return
+		}
+		detectedVersion = versionRe.FindString(string(out))
+	})
+	return detectedVersion
+}
+
+// scramSupported reports whether pgbouncer of the version verifies SCRAM secrets,
+// unknown versions are supposed to.
+func scramSupported(version string) bool {
+	m := versionRe.FindStringSubmatch(version)
+	if m == nil {
+		return true
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return major > scramMinVersion[0] || major == scramMinVersion[0] && minor >= scramMinVersion[1]
+}
+
+// applyScramPolicy handles SCRAM-SHA-256 secrets by -scram and logs how many secrets
+// of each type the userlist has, warning when pgbouncer is too old for SCRAM.
+func (o *fetchOptions) applyScramPolicy(users map[string]string) error {
+	var scram []string
+	counts := make(map[string]int)
+	for username, password := range users {
+		kind := passwordType(password)
+		counts[kind]++
+		if kind == passwordSCRAM {
+			scram = append(scram, username)
+		}
+	}
+	sort.Strings(scram)
+	switch {
+	case len(scram) == 0:
+	case o.scramPolicy == scramFail:
+		return fmt.Errorf("%d users have SCRAM-SHA-256 secrets with -scram=%s: %s", len(scram), scramFail, strings.Join(scram, ", "))
+	case o.scramPolicy == scramSkip:
+		log.Printf("[INFO] skipping %d users with SCRAM-SHA-256 secrets by -scram=%s: %s\n", len(scram), scramSkip, strings.Join(scram, ", "))
+		for _, username := range scram {
+			delete(users, username)
+		}
+		counts[passwordSCRAM] = 0
+	}
+	summary := fmt.Sprintf("userlist has %d SCRAM-SHA-256, %d md5 and %d plain text secrets",
+		counts[passwordSCRAM], counts[passwordMD5], counts[passwordPlain])
+	if version := targetVersion(); counts[passwordSCRAM] > 0 && !scramSupported(version) {
+		log.Printf("[WARN] %s, but pgbouncer %s verifies SCRAM secrets since %d.%d, set -scram=%s or upgrade pgbouncer\n",
+			summary, version, scramMinVersion[0], scramMinVersion[1], scramSkip)
+		return nil
+	}
+	log.Printf("[INFO] %s\n", summary)
+	return nil
+}
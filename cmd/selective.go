@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// skipCosmeticReload cancels the reload triggered by the write when users and passwords
+// are the same as before and only the formatting, like ordering or the snapshot comment,
+// has changed. The reload pending before the write is kept.
+func skipCosmeticReload(pendingBefore bool, report *runReport) error {
+	if pendingBefore || len(report.Added)+len(report.Removed)+len(report.Updated) > 0 {
+		return nil
+	}
+	if err := os.Remove(*reloadTriggerFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Printf("[INFO] only formatting of %s has changed, skipping reload\n", *filePath)
+	return nil
+}
+
+// reloadPending tells whether the reload of -path is pending before the write.
+func reloadPending() bool {
+	return (&userlist.File{Path: *filePath, TriggerFile: *reloadTriggerFile}).ReloadPending()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// shadowUsers fetches users with its own fetcher of -shadow-config options over the effective ones,
+// sharing cluster handles of the base fetcher. Options of the file which don't change the fetched
+// users don't apply.
+func shadowUsers(ctx context.Context, db *sql.DB, base *fetcher) (map[string]string, error) {
+	values, err := readConfigFile(*shadowConfig)
+	if err != nil {
+		return nil, err
+	}
+	f, err := newFetcher(values)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", *shadowConfig, err)
+	}
+	f.clusterDBs = base.clusterDBs
+	exclude, ok := values["exclude"]
+	switch {
+	case ok:
+	case len(f.include) > 0:
+		// the include list replaces the default exclude like validateInclude does.
+		exclude = ""
+	default:
+		exclude = *excludeAccounts
+	}
+	return f.fetch(ctx, db, strings.Split(exclude, ","), nil)
+}
+
+// compareShadow fetches users with -shadow-config and logs how they differ from
+// the written users, the shadow output is never written.
+func compareShadow(ctx context.Context, db *sql.DB, base *fetcher, users map[string]string, report *runReport) {
+	shadow, err := shadowUsers(ctx, db, base)
+	if err != nil {
+		log.Printf("[WARN] shadow config %s: %s\n", *shadowConfig, err)
+		return
+	}
+	added, removed, updated := userlist.Diff(users, shadow)
+	report.ShadowDifferences = len(added) + len(removed) + len(updated)
+	if report.ShadowDifferences == 0 {
+		log.Printf("[DEBUG] shadow config %s generates the same %d users\n", *shadowConfig, len(shadow))
+		return
+	}
+	log.Printf("[WARN] shadow config %s differs: added %s, removed %s, updated %s\n",
+		*shadowConfig, namesOrNone(added), namesOrNone(removed), namesOrNone(updated))
+}
+
+func namesOrNone(names []string) string {
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
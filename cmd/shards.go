@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// shardIndex is the name of the index file listing shards of the generation.
+const shardIndex = "index.txt"
+
+// renderShards splits users by hash of the name into n userlist files and
+// renders the index file including them, keyed by file name.
+func renderShards(users map[string]string, n int) map[string][]byte {
+	buckets := make([]map[string]string, n)
+	for i := range buckets {
+		buckets[i] = make(map[string]string)
+	}
+	for username, password := range users {
+		h := fnv.New32a()
+		// nolint:errcheck,gosec
+		h.Write([]byte(username))
+		buckets[h.Sum32()%uint32(n)][username] = password
+	}
+	files := make(map[string][]byte, n+1)
+	var index bytes.Buffer
+	index.WriteString("# generated by pgbouncer-userlist-generator, do not edit\n")
+	for i, bucket := range buckets {
+		name := fmt.Sprintf("shard-%0*d.txt", len(strconv.Itoa(n-1)), i)
+		files[name] = userlist.Render(bucket)
+		fmt.Fprintf(&index, "%%include %s\n", name)
+	}
+	files[shardIndex] = index.Bytes()
+	return files
+}
+
+// writeShards writes users sharded into -shards files with the index to a new
+// generation directory and atomically switches <dir>/current symlink to it.
+// The previous generation is removed, unchanged shards are hard linked from it instead of rewritten.
+func writeShards(dir string, users map[string]string, n int) (bool, error) {
+	if n < 1 {
+		return false, fmt.Errorf("-shards must be positive")
+	}
+	if err := checkAllowedRoot(dir); err != nil {
+		return false, err
+	}
+	files := renderShards(users, n)
+	current := filepath.Join(dir, "current")
+	if shardsEqual(current, files) {
+		log.Printf("[INFO] %s doesn't have any changes, skipping update\n", current)
+		return false, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return false, err
+	}
+	generation := ".gen-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if err := os.Mkdir(filepath.Join(dir, generation), 0700); err != nil {
+		return false, err
+	}
+	previous, _ := os.Readlink(current)
+	for name, content := range files {
+		path := filepath.Join(dir, generation, name)
+		if previous != "" && !filepath.IsAbs(previous) && linkUnchanged(filepath.Join(dir, previous, name), path, content) {
+			continue
+		}
+		if err := os.WriteFile(path, content, 0600); err != nil {
+			return false, err
+		}
+	}
+	link := filepath.Join(dir, ".current.tmp")
+	// nolint:errcheck
+	os.Remove(link)
+	if err := os.Symlink(generation, link); err != nil {
+		return false, err
+	}
+	if err := os.Rename(link, current); err != nil {
+		return false, err
+	}
+	if previous != "" && !filepath.IsAbs(previous) {
+		if err := os.RemoveAll(filepath.Join(dir, previous)); err != nil {
+			log.Printf("[WARN] remove previous shards: %s\n", err)
+		}
+	}
+	log.Printf("[INFO] %d users written to %d shards in %s\n", len(users), n, current)
+	return true, nil
+}
+
+// linkUnchanged hard links the previous shard to path if it has the content.
+func linkUnchanged(previous, path string, content []byte) bool {
+	// nolint:gosec
+	data, err := os.ReadFile(previous)
+	if err != nil || !bytes.Equal(data, content) {
+		return false
+	}
+	return os.Link(previous, path) == nil
+}
+
+// shardsEqual returns whether the directory contains exactly the files.
+func shardsEqual(dir string, files map[string][]byte) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != len(files) {
+		return false
+	}
+	for name, content := range files {
+		existing, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil || !bytes.Equal(existing, content) {
+			return false
+		}
+	}
+	return true
+}
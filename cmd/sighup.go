@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// signalReload is the reload command shown for reloads by SIGHUP.
+const signalReload = "SIGHUP"
+
+// pgbouncerReload returns the reload of pgbouncer outputs: RELOAD in admin consoles of
+// -reload-admin peers, SIGHUP to processes of -reload-pidfile or -reload-process when set,
+// verified in -pgbouncer-admin consoles of -reload-admin-ports peers, otherwise the shell command.
+func pgbouncerReload(command string) (string, userlist.Runner) {
+	if *reloadAdmin != "" {
+		return adminReload, peerAdminRunner{dsn: *reloadAdmin, ports: splitNames(*reloadAdminPorts)}
+	}
+	if *reloadPidfile != "" || *reloadProcess != "" {
+		return signalReload, signalRunner{pidfile: *reloadPidfile, process: *reloadProcess, admin: *pgbouncerAdmin, ports: splitNames(*reloadAdminPorts)}
+	}
+	return command, runner
+}
+
+// signalRunner sends SIGHUP to pgbouncer, which re-reads its configuration and auth_file.
+// With admin and ports of peers it checks that every peer has loaded the userlist.
+type signalRunner struct {
+	pidfile string
+	process string
+	admin   string
+	ports   []string
+}
+
+func (r signalRunner) Run(_ string, timeout time.Duration, _ []string) error {
+	pids, err := r.pids()
+	if err != nil {
+		return err
+	}
+	// every peer is signaled even if some of them fail.
+	var failed []string
+	for _, pid := range pids {
+		process, errFind := os.FindProcess(pid)
+		if errFind == nil {
+			errFind = process.Signal(syscall.SIGHUP)
+		}
+		if errFind != nil {
+			failed = append(failed, fmt.Sprintf("pid %d: %s", pid, errFind))
+		}
+	}
+	if err := peersError(failed, len(pids)); err != nil || r.admin == "" || len(r.ports) == 0 {
+		return err
+	}
+	return verifyPeers(r.admin, r.ports, timeout)
+}
+
+// pids returns pids from comma separated pidfiles, or pids of processes with the name,
+// several pgbouncer peers run with so_reuseport.
+func (r signalRunner) pids() ([]int, error) {
+	if r.pidfile != "" {
+		var pids []int
+		for _, pidfile := range splitNames(r.pidfile) {
+			data, err := os.ReadFile(filepath.Clean(pidfile))
+			if err != nil {
+				return nil, err
+			}
+			pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil || pid <= 0 {
+				return nil, fmt.Errorf("%s: invalid pid %q", pidfile, strings.TrimSpace(string(data)))
+			}
+			pids = append(pids, pid)
+		}
+		return pids, nil
+	}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, entry := range entries {
+		pid, errPid := strconv.Atoi(entry.Name())
+		if errPid != nil {
+			continue
+		}
+		comm, errComm := os.ReadFile(filepath.Join("/proc", entry.Name(), "comm"))
+		if errComm == nil && strings.TrimSpace(string(comm)) == r.process {
+			pids = append(pids, pid)
+		}
+	}
+	if len(pids) == 0 {
+		return nil, errors.New("no process named " + r.process)
+	}
+	return pids, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/md5" // nolint:gosec
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math/rand"
+	"runtime"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// simulateUsers returns -simulate-roles synthetic users instead of reading the database, half of
+// them with md5 and half with scram-sha-256 passwords. Passwords of -simulate-churn share of users
+// change on every call, so both unchanged and changed runs can be measured.
+func simulateUsers(timings userlist.Timings) map[string]string {
+	start := time.Now()
+	defer timings.Add(userlist.PhaseQuery, start)
+	// nolint:gosec
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	users := make(map[string]string, *simulateRoles)
+	for i := 0; i < *simulateRoles; i++ {
+		username := fmt.Sprintf("simulated_%07d", i)
+		secret := username
+		if random.Float64() < *simulateChurn {
+			secret = fmt.Sprintf("%s-%d", username, random.Int63())
+		}
+		// nolint:gosec
+		sum := md5.Sum([]byte(secret + username))
+		if i%2 == 0 {
+			users[username] = "md5" + hex.EncodeToString(sum[:])
+			continue
+		}
+		// real scram verifiers take 4096 pbkdf2 iterations per role, only the format is simulated.
+		salt := base64.StdEncoding.EncodeToString(sum[:])
+		key := base64.StdEncoding.EncodeToString(append(sum[:], sum[:]...))
+		users[username] = fmt.Sprintf("SCRAM-SHA-256$4096:%s$%s:%s", salt, key, key)
+	}
+	return users
+}
+
+// logMemStats logs memory usage of the process for sizing large clusters in simulation mode.
+func logMemStats() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	log.Printf("[INFO] simulated %d roles: heap %d KiB, total allocated %d KiB, system %d KiB, gc cycles %d\n",
+		*simulateRoles, m.HeapAlloc/1024, m.TotalAlloc/1024, m.Sys/1024, m.NumGC)
+}
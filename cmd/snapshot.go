@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/catalog"
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// snapshotContent prepends the snapshot comment, which pgbouncer skips, to the content of changed users.
+// Unchanged users keep the current file, so it stays tied to the state it was generated at.
+func snapshotContent(content []byte, snapshot *catalog.Snapshot, previous, users map[string]string) []byte {
+	added, removed, updated := userlist.Diff(previous, users)
+	if len(added)+len(removed)+len(updated) == 0 {
+		// nolint:gosec
+		if current, err := os.ReadFile(filepath.Clean(*filePath)); err == nil {
+			return current
+		}
+	}
+	header := fmt.Sprintf("; snapshot lsn=%s time=%s\n", snapshot.LSN, snapshot.Time.UTC().Format(time.RFC3339Nano))
+	return append([]byte(header), content...)
+}
+
+// withoutSnapshot returns the content without the snapshot comment prepended to it.
+func withoutSnapshot(content []byte) []byte {
+	if !bytes.HasPrefix(content, []byte("; snapshot ")) {
+		return content
+	}
+	if i := bytes.IndexByte(content, '\n'); i >= 0 {
+		return content[i+1:]
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// observeClients records users connected to pgbouncer, as listed by SHOW CLIENTS of -pgbouncer-admin, as last connected now.
+func observeClients(ctx context.Context, now time.Time) error {
+	connector, err := pq.NewConnector(*pgbouncerAdmin)
+	if err != nil {
+		return err
+	}
+	db := sql.OpenDB(connector)
+	// nolint:errcheck
+	defer db.Close()
+	rows, err := db.QueryContext(ctx, "SHOW CLIENTS")
+	if err != nil {
+		return err
+	}
+	// nolint:errcheck
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	userColumn := -1
+	for i, c := range columns {
+		if c == "user" {
+			userColumn = i
+		}
+	}
+	if userColumn < 0 {
+		return errors.New("SHOW CLIENTS has no user column")
+	}
+	values := make([]interface{}, len(columns))
+	for i := range values {
+		values[i] = new(sql.RawBytes)
+	}
+	for rows.Next() {
+		if err := rows.Scan(values...); err != nil {
+			return err
+		}
+		username := string(*values[userColumn].(*sql.RawBytes))
+		if h, ok := state.Users[username]; ok {
+			h.LastConnected = now
+		}
+	}
+	return rows.Err()
+}
+
+// runStale samples pgbouncer clients and prints users of the userlist which were not seen connected for -stale-after.
+func runStale(ctx context.Context, w io.Writer) error {
+	if *stateFile == "" || *pgbouncerAdmin == "" {
+		return errors.New("-state-file and -pgbouncer-admin are required")
+	}
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := loadState(); err != nil {
+		return err
+	}
+	users, err := readUserList(*filePath)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := observeClients(ctx, now); err != nil {
+		return fmt.Errorf("show clients: %w", err)
+	}
+	if err := saveState(); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(users))
+	for username := range users {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tLAST CONNECTED\tIN USERLIST SINCE")
+	stale := 0
+	for _, username := range names {
+		// users without history are not judged, there is nothing to count from.
+		h, ok := state.Users[username]
+		if !ok {
+			continue
+		}
+		since := h.LastConnected
+		if since.IsZero() {
+			since = h.FirstSeen
+		}
+		if now.Sub(since) < *staleAfter {
+			continue
+		}
+		lastConnected := "never"
+		if !h.LastConnected.IsZero() {
+			lastConnected = h.LastConnected.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", username, lastConnected, h.FirstSeen.Format(time.RFC3339))
+		stale++
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	log.Printf("[INFO] %d of %d user(s) were not connected for %s\n", stale, len(names), *staleAfter)
+	return nil
+}
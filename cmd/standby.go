@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// runCheckStandby compares roles on the primary and on the standby and fails
+// if they differ although the standby has replayed wal of the primary read.
+func runCheckStandby(ctx context.Context, primary *sql.DB, exclude []string) error {
+	if *standbyConnectionString == "" {
+		return fmt.Errorf("-standby-connection is required")
+	}
+	standby, errOpen := openDB(*standbyConnectionString)
+	if errOpen != nil {
+		return errOpen
+	}
+	// nolint:errcheck
+	defer standby.Close()
+	fetchCtx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	primaryUsers, errPrimary := fetchUserList(fetchCtx, primary, exclude, nil)
+	if errPrimary != nil {
+		return fmt.Errorf("primary: %w", errPrimary)
+	}
+	var lsn string
+	if err := primary.QueryRowContext(fetchCtx, `select pg_current_wal_lsn()::text`).Scan(&lsn); err != nil {
+		return fmt.Errorf("primary: %w", err)
+	}
+	lag, inRecovery, errLag := waitForReplay(ctx, standby, lsn)
+	if errLag != nil {
+		return fmt.Errorf("standby: %w", errLag)
+	}
+	standbyCtx, cancelStandby := context.WithTimeout(ctx, commandTimeout)
+	defer cancelStandby()
+	standbyUsers, errStandby := fetchUserList(standbyCtx, standby, exclude, nil)
+	if errStandby != nil {
+		return fmt.Errorf("standby: %w", errStandby)
+	}
+
+	recovery := preflightResult{name: "standby is in recovery", status: preflightOK}
+	if !inRecovery {
+		recovery.status = preflightWarn
+		recovery.detail = "standby is not in recovery, it was promoted or it is a different cluster"
+		recovery.remediation = "check -standby-connection"
+	}
+	consistency := preflightResult{
+		name:   "roles are consistent",
+		status: preflightOK,
+		detail: fmt.Sprintf("%d role(s), standby replayed primary lsn %s", len(primaryUsers), lsn),
+	}
+	added, removed, changed := userlist.Diff(standbyUsers, primaryUsers)
+	if len(added)+len(removed)+len(changed) > 0 {
+		consistency.detail = fmt.Sprintf("missing on standby: [%s], only on standby: [%s], password differs: [%s], replay lag %d bytes",
+			strings.Join(added, ","), strings.Join(removed, ","), strings.Join(changed, ","), lag)
+		if lag > 0 {
+			consistency.status = preflightWarn
+			consistency.remediation = fmt.Sprintf("standby hasn't replayed primary lsn %s in %s, re-run the check when the standby catches up", lsn, *maxReplicationLag)
+		} else {
+			consistency.status = preflightFail
+			consistency.remediation = "standby has stale auth data although it is caught up, investigate before it gets promoted"
+		}
+	}
+	return printReport([]preflightResult{recovery, consistency})
+}
+
+// waitForReplay waits up to -max-replication-lag for the standby to replay wal up to the lsn
+// of the primary and returns how many bytes are left to replay.
+func waitForReplay(ctx context.Context, db *sql.DB, lsn string) (int64, bool, error) {
+	deadline := time.Now().Add(*maxReplicationLag)
+	for {
+		lag, inRecovery, err := replicationLag(ctx, db, lsn)
+		if err != nil || lag <= 0 || !inRecovery || time.Now().After(deadline) {
+			return lag, inRecovery, err
+		}
+		select {
+		case <-ctx.Done():
+			return lag, inRecovery, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// replicationLag returns how many bytes of wal up to the lsn of the primary the standby
+// has yet to replay, the standby out of recovery replays nothing.
+func replicationLag(ctx context.Context, db *sql.DB, lsn string) (int64, bool, error) {
+	queryCtx, cancel := context.WithTimeout(ctx, commandTimeout)
+	defer cancel()
+	var lag int64
+	var inRecovery bool
+	err := db.QueryRowContext(queryCtx, `
+select
+    greatest(coalesce(pg_wal_lsn_diff($1::pg_lsn, pg_last_wal_replay_lsn()), 0), 0)::int8,
+    pg_is_in_recovery()
+`, lsn).Scan(&lag, &inRecovery)
+	if err != nil {
+		return 0, false, err
+	}
+	return lag, inRecovery, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runState is kept between runs in -state-file and in memory of long-running processes.
+type runState struct {
+	ConsecutiveFailures int           `json:"consecutive_failures"`
+	LastSuccess         time.Time     `json:"last_success"`
+	LastFailure         time.Time     `json:"last_failure"`
+	CircuitOpenUntil    time.Time     `json:"circuit_open_until"`
+	CircuitBackoff      time.Duration `json:"circuit_backoff"`
+	Paused              bool          `json:"paused"`
+	PausedAt            time.Time     `json:"paused_at"`
+	PauseReason         string        `json:"pause_reason"`
+	Frozen              bool          `json:"frozen"`
+	FrozenAt            time.Time     `json:"frozen_at"`
+	FreezeReason        string        `json:"freeze_reason"`
+	PendingChecksum     string        `json:"pending_checksum"`
+	PendingSince        time.Time     `json:"pending_since"`
+	ApprovedChecksum    string        `json:"approved_checksum"`
+	// FreshnessBreached is whether the last run has breached -freshness-slo.
+	FreshnessBreached bool `json:"freshness_breached"`
+	// Tenants are tenants with files written at -tenant-path.
+	Tenants []string `json:"tenants,omitempty"`
+	// SystemIdentifier identifies the source cluster of the userlist.
+	SystemIdentifier string `json:"system_identifier,omitempty"`
+	// Users is the history of users of the userlist.
+	Users map[string]*userHistory `json:"users,omitempty"`
+}
+
+// state is the state of the current process, loaded from -state-file on start.
+var state = &runState{}
+
+// loadState reads -state-file, a missing file keeps the current state.
+func loadState() error {
+	if *stateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Clean(*stateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, state)
+}
+
+// saveState replaces -state-file with the current state.
+func saveState() error {
+	if *stateFile == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := *stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, *stateFile)
+}
+
+// lockState locks -state-file for a read, modify and save of the state.
+func lockState() (func(), error) {
+	if *stateFile == "" {
+		return func() {}, nil
+	}
+	return lockStateFile()
+}
+
+// runPause implements pause, resume, freeze and unfreeze commands, which suspend and resume
+// generation or applying changes by processes sharing -state-file without stopping them.
+func runPause(w io.Writer, command string, args []string) error {
+	if *stateFile == "" {
+		return errors.New("-state-file is required")
+	}
+	if err := setStateCommand(command, strings.Join(args, " ")); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w, pauseStatus())
+	return err
+}
+
+// setStateCommand applies pause, resume, freeze or unfreeze command to the state and saves it.
+func setStateCommand(command, reason string) error {
+	unlock, err := lockState()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if command == "freeze" || command == "unfreeze" {
+		return setFrozen(command == "freeze", reason)
+	}
+	return setPaused(command == "pause", reason)
+}
+
+// setFrozen updates the freeze toggle of the state and saves it.
+func setFrozen(frozen bool, reason string) error {
+	if err := loadState(); err != nil {
+		return err
+	}
+	if frozen {
+		state.Frozen, state.FrozenAt, state.FreezeReason = true, time.Now(), reason
+	} else {
+		state.Frozen, state.FrozenAt, state.FreezeReason = false, time.Time{}, ""
+	}
+	return saveState()
+}
+
+// setPaused updates pause of the state and saves it.
+func setPaused(paused bool, reason string) error {
+	if err := loadState(); err != nil {
+		return err
+	}
+	if paused {
+		state.Paused, state.PausedAt, state.PauseReason = true, time.Now(), reason
+	} else {
+		state.Paused, state.PausedAt, state.PauseReason = false, time.Time{}, ""
+	}
+	return saveState()
+}
+
+func pauseStatus() string {
+	status := "running"
+	if state.Paused {
+		status = "paused since " + state.PausedAt.Format(time.RFC3339) + reasonSuffix(state.PauseReason)
+	}
+	if state.Frozen {
+		status += ", frozen since " + state.FrozenAt.Format(time.RFC3339) + reasonSuffix(state.FreezeReason)
+	}
+	return status
+}
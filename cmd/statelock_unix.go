@@ -0,0 +1,30 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockStateFile takes an exclusive lock of -state-file, held by the process between
+// reading and saving the state, so changes of other processes aren't overwritten.
+func lockStateFile() (func(), error) {
+	// nolint:gosec
+	fd, err := os.OpenFile(*stateFile+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(fd.Fd()), syscall.LOCK_EX); err != nil {
+		// nolint:errcheck,gosec
+		fd.Close()
+		return nil, err
+	}
+	return func() {
+		// nolint:errcheck,gosec
+		syscall.Flock(int(fd.Fd()), syscall.LOCK_UN)
+		// nolint:errcheck,gosec
+		fd.Close()
+	}, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+var errStrict = errors.New("warnings about roles fail runs with -strict")
+
+// strictLog records warnings about roles as errors when strict is set, otherwise it logs them.
+type strictLog struct {
+	strict *bool
+	// violations are warnings recorded since the last strictError.
+	violations []string
+}
+
+// scramRe matches SCRAM-SHA-256$<iterations>:<salt>$<stored key>:<server key> secrets.
+var scramRe = regexp.MustCompile(`^SCRAM-SHA-256\$[0-9]+:[A-Za-z0-9+/=]+\$[A-Za-z0-9+/=]+:[A-Za-z0-9+/=]+$`)
+
+// md5Re matches md5 hashes.
+var md5Re = regexp.MustCompile(`^md5[0-9a-f]{32}$`)
+
+// warnSkipped logs the warning about a role left out of an output,
+// with -strict it is recorded to fail the run instead.
+func (l *strictLog) warnSkipped(format string, args ...interface{}) {
+	l.warnStrict("skipping", format, args...)
+}
+
+// warnWritten logs the warning about a role written anyway,
+// with -strict it is recorded to fail the run instead.
+func (l *strictLog) warnWritten(format string, args ...interface{}) {
+	l.warnStrict("writing it as is", format, args...)
+}
+
+// warnStrict logs the warning with the action taken about it,
+// with -strict the warning is recorded to fail the run instead.
+func (l *strictLog) warnStrict(action, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if *l.strict {
+		l.violations = append(l.violations, msg)
+		return
+	}
+	log.Printf("[WARN] %s, %s\n", msg, action)
+}
+
+// strictError returns the error of violations recorded with -strict and forgets them.
+func (l *strictLog) strictError() error {
+	if len(l.violations) == 0 {
+		return nil
+	}
+	err := fmt.Errorf("%w: %s", errStrict, strings.Join(l.violations, "; "))
+	l.violations = nil
+	return err
+}
+
+// checkUsers warns about users whose names can't be written to userlist and whose
+// passwords look like md5 or scram-sha-256 secrets but are malformed. They are
+// written as before unless -strict fails the run.
+func (f *fetcher) checkUsers(users map[string]string) error {
+	for username, password := range users {
+		switch {
+		case username == "" || strings.ContainsAny(username, "\"\n\r\x00"):
+			f.warnings.warnWritten("user %q has a name which can't be written to userlist", username)
+		case strings.ContainsAny(password, "\"\n\r\x00"):
+			f.warnings.warnWritten("user %q has a password which can't be written to userlist", username)
+		case strings.HasPrefix(password, "md5") && len(password) == 35 && !md5Re.MatchString(password),
+			strings.HasPrefix(password, "SCRAM-SHA-256$") && !scramRe.MatchString(password):
+			f.warnings.warnWritten("user %q has a malformed %s secret", username, passwordType(password))
+		}
+	}
+	return f.warnings.strictError()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// errOutOfSync is returned by verify when the userlist differs from the database.
+var errOutOfSync = errors.New("userlist is out of sync with the database")
+
+// commandArgs are commands taking arguments, like diff -show-hashes or explain <role>,
+// other commands fail on arguments which are not flags.
+var commandArgs = map[string]bool{
+	"diff": true, "export": true, "restore": true, "explain": true, "config": true, "ctl": true,
+	"support-bundle": true, "history": true, "pause": true, "resume": true, "freeze": true, "unfreeze": true,
+}
+
+// parseCommandArgs sets flags given after the command, like generate -path u.txt, and
+// returns the other arguments of the command in their order. Arguments after -- are
+// never taken as flags.
+func parseCommandArgs(args []string) ([]string, error) {
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return append(rest, args[i+1:]...), nil
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			rest = append(rest, arg)
+			continue
+		}
+		name, value := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-"), ""
+		eq := strings.Index(name, "=")
+		hasValue := eq >= 0
+		if hasValue {
+			name, value = name[:eq], name[eq+1:]
+		}
+		f := flag.Lookup(name)
+		if f == nil {
+			// a flag of the command itself, like -show-hashes of diff.
+			rest = append(rest, arg)
+			continue
+		}
+		if !hasValue {
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+				value = "true"
+			} else if i+1 < len(args) {
+				i++
+				value = args[i]
+			} else {
+				return nil, fmt.Errorf("flag needs an argument: -%s", name)
+			}
+		}
+		if err := flag.Set(name, value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for flag -%s: %w", value, name, err)
+		}
+	}
+	return rest, nil
+}
+
+// runVerify checks that -path has the users generated from the database without changing it.
+func runVerify(ctx context.Context, db *sql.DB, w io.Writer, exclude []string) error {
+	users, err := fetchUserList(ctx, db, exclude, nil)
+	if err != nil {
+		return err
+	}
+	previous, err := readUserList(*filePath)
+	if err != nil {
+		return err
+	}
+	// users are compared as parsed, comments like the snapshot header don't matter.
+	added, removed, updated := userlist.Diff(previous, users)
+	if len(added)+len(removed)+len(updated) == 0 {
+		_, err := fmt.Fprintf(w, "%s is in sync with %d users\n", *filePath, len(users))
+		return err
+	}
+	return fmt.Errorf("%w: %d added, %d removed, %d updated", errOutOfSync, len(added), len(removed), len(updated))
+}
+
+// runDiff prints users which the next run adds to, removes from and updates in -path,
+// with password types instead of hashes unless -show-hashes is given in args.
+func runDiff(ctx context.Context, db *sql.DB, w io.Writer, exclude []string, args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	showHashes := fs.Bool("show-hashes", false, "print password hashes instead of their types")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	users, err := fetchUserList(ctx, db, exclude, nil)
+	if err != nil {
+		return err
+	}
+	previous, err := readUserList(*filePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	password := func(p string) string {
+		if *showHashes {
+			return p
+		}
+		return passwordType(p)
+	}
+	added, removed, updated := userlist.Diff(previous, users)
+	tw := tabwriter.NewWriter(w, 0, 4, 1, ' ', 0)
+	for _, username := range added {
+		fmt.Fprintf(tw, "+\t%s\t%s\n", username, password(users[username]))
+	}
+	for _, username := range removed {
+		fmt.Fprintf(tw, "-\t%s\t%s\n", username, password(previous[username]))
+	}
+	for _, username := range updated {
+		fmt.Fprintf(tw, "~\t%s\t%s -> %s\n", username, password(previous[username]), password(users[username]))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%d added, %d removed, %d updated\n", len(added), len(removed), len(updated))
+	return err
+}
+
+// backups returns backups of the userlist at path from the oldest to the latest.
+func backups(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".backup-*")
+	if err != nil {
+		return nil, err
+	}
+	stamps := make(map[string]int64, len(matches))
+	var all []string
+	for _, backup := range matches {
+		// sidecar annotations share the prefix.
+		stamp, err := strconv.ParseInt(strings.TrimPrefix(backup, path+".backup-"), 10, 64)
+		if err == nil {
+			stamps[backup] = stamp
+			all = append(all, backup)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return stamps[all[i]] < stamps[all[j]] })
+	return all, nil
+}
+
+// runRestore replaces -path with the backup given in args or the latest one and reloads pgbouncer.
+func runRestore(args []string) error {
+	var backup string
+	switch len(args) {
+	case 0:
+		all, err := backups(*filePath)
+		if err != nil {
+			return err
+		}
+		if len(all) == 0 {
+			return fmt.Errorf("%s doesn't have backups", *filePath)
+		}
+		backup = all[len(all)-1]
+	case 1:
+		backup = args[0]
+	default:
+		return errors.New("usage: restore [backup]")
+	}
+	report := &runReport{Phases: make(userlist.Timings)}
+	file := &userlist.File{Path: *filePath, TriggerFile: *reloadTriggerFile, Timings: report.Phases}
+	changed, err := file.Restore(backup)
+	if err != nil {
+		return err
+	}
+	if !changed {
+		log.Printf("[INFO] %s already has content of %s\n", *filePath, backup)
+	} else {
+		log.Printf("[INFO] %s restored from %s\n", *filePath, backup)
+	}
+	command, reloader := pgbouncerReload(*reloadCommand)
+	return processTriggerFile(*reloadTriggerFile, *filePath, command, reloader, report)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// tamperSettle is the time to wait for the burst of file events to end before checking the files.
+const tamperSettle = 200 * time.Millisecond
+
+// managed holds checksums of the content last written to every managed file,
+// so writes of the generator itself are not taken for tampering.
+var managed = struct {
+	sync.Mutex
+	sums map[string][]byte
+}{sums: make(map[string][]byte)}
+
+// managedChanged is notified when files are added to or removed from the managed ones.
+var managedChanged = make(chan struct{}, 1)
+
+func notifyManagedChanged() {
+	select {
+	case managedChanged <- struct{}{}:
+	default:
+	}
+}
+
+func rememberManaged(path string, content []byte) {
+	sum := sha256.Sum256(content)
+	managed.Lock()
+	_, known := managed.sums[path]
+	managed.sums[path] = sum[:]
+	managed.Unlock()
+	if !known {
+		notifyManagedChanged()
+	}
+}
+
+// forgetManaged stops treating the file as managed, e.g. the old auth_file after it moved.
+func forgetManaged(path string) {
+	managed.Lock()
+	_, known := managed.sums[path]
+	delete(managed.sums, path)
+	managed.Unlock()
+	if known {
+		notifyManagedChanged()
+	}
+}
+
+func managedPaths() []string {
+	managed.Lock()
+	defer managed.Unlock()
+	paths := make([]string, 0, len(managed.sums))
+	for path := range managed.sums {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// tamperedFiles returns managed files which were deleted or whose content differs from the written one.
+func tamperedFiles() []string {
+	managed.Lock()
+	defer managed.Unlock()
+	var tampered []string
+	for path, sum := range managed.sums {
+		// nolint:gosec
+		data, err := os.ReadFile(path)
+		if err != nil {
+			tampered = append(tampered, path)
+			continue
+		}
+		current := sha256.Sum256(data)
+		if !bytes.Equal(current[:], sum) {
+			tampered = append(tampered, path)
+		}
+	}
+	return tampered
+}
+
+// watchTamper watches managed files and regenerates them when they are modified or deleted
+// out of band, the way kubelet restores secret mounts. The watch is rebuilt when the managed
+// files change, e.g. when auth_file moves.
+func watchTamper(ctx context.Context, db *sql.DB, exclude []string) error {
+	for ctx.Err() == nil {
+		// changes up to now are in the paths being watched.
+		select {
+		case <-managedChanged:
+		default:
+		}
+		paths := managedPaths()
+		watchCtx, cancel := context.WithCancel(ctx)
+		events, err := watchFiles(watchCtx, paths)
+		if err != nil {
+			cancel()
+			return err
+		}
+		log.Printf("[INFO] watching %d file(s) for external changes\n", len(paths))
+		watchEvents(events, db, exclude)
+		cancel()
+	}
+	return ctx.Err()
+}
+
+// watchEvents restores tampered files on events until the managed files change or the watch ends.
+func watchEvents(events <-chan struct{}, db *sql.DB, exclude []string) {
+	for {
+		select {
+		case <-managedChanged:
+			return
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		}
+		// drain the burst of events of a single change.
+		timer := time.NewTimer(tamperSettle)
+	settle:
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					timer.Stop()
+					return
+				}
+			case <-timer.C:
+				break settle
+			}
+		}
+		tampered := tamperedFiles()
+		if len(tampered) == 0 {
+			continue
+		}
+		log.Printf("[ERROR] %v modified externally, restoring\n", tampered)
+		runCycle(db, exclude)
+	}
+}
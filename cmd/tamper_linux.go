@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// watchFiles sends to the channel on every change of the files, directories are watched
+// because files are replaced by rename and events of other files in them are ignored.
+// The channel is closed when ctx is done.
+func watchFiles(ctx context.Context, paths []string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	inotify := os.NewFile(uintptr(fd), "inotify")
+	files := make(map[string]bool, len(paths))
+	// dirs are watched directories by watch descriptor.
+	dirs := make(map[int32]string, len(paths))
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if files[path] {
+			continue
+		}
+		files[path] = true
+		dir := filepath.Dir(path)
+		mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO)
+		wd, err := syscall.InotifyAddWatch(fd, dir, mask)
+		if err != nil {
+			// nolint:errcheck,gosec
+			inotify.Close()
+			return nil, os.NewSyscallError("inotify_add_watch "+dir, err)
+		}
+		dirs[int32(wd)] = dir
+	}
+	events := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		// nolint:errcheck,gosec
+		inotify.Close()
+	}()
+	go func() {
+		defer close(events)
+		buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+		for {
+			n, err := inotify.Read(buf)
+			if err != nil {
+				return
+			}
+			for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+				event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+				nameStart := offset + syscall.SizeofInotifyEvent
+				name := string(bytesUntilNull(buf[nameStart : nameStart+int(event.Len)]))
+				offset = nameStart + int(event.Len)
+				if files[filepath.Join(dirs[event.Wd], name)] {
+					select {
+					case events <- struct{}{}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+func bytesUntilNull(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
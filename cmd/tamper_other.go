@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// watchFiles requires inotify, which is available on linux only.
+func watchFiles(_ context.Context, _ []string) (<-chan struct{}, error) {
+	return nil, errors.New("watching files is supported on linux only")
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+	"gopkg.in/yaml.v3"
+)
+
+// userlistTarget is an additional output generated from the same fetched
+// users, with its own filter and pooler adapter rendering and reloading it.
+type userlistTarget struct {
+	path          string
+	triggerFile   string
+	reloadCommand string
+	filter        func(username, password string) bool
+	// adapter defaults to pgbouncer.
+	adapter poolerAdapter
+	// runner executes reload command, defaults to the shell runner.
+	runner userlist.Runner
+}
+
+// newTarget returns target of the pooler, reloads are triggered by <-reload-trigger-file>.<kind>.
+func newTarget(adapter poolerAdapter, path, reloadCommand, kind string) userlistTarget {
+	t := userlistTarget{path: path, adapter: adapter}
+	t.reloadCommand, t.runner = adapter.Reload(reloadCommand)
+	if t.reloadCommand != "" {
+		t.triggerFile = *reloadTriggerFile + "." + kind
+	}
+	return t
+}
+
+func (t userlistTarget) pooler() poolerAdapter {
+	if t.adapter == nil {
+		return pgbouncerAdapter{}
+	}
+	return t.adapter
+}
+
+// reloader returns the runner executing reload command of the target.
+func (t userlistTarget) reloader() userlist.Runner {
+	if t.runner == nil {
+		return runner
+	}
+	return t.runner
+}
+
+// write renders users accepted by the filter to the target file, warnings about
+// users left out fail the write with -strict.
+func (t userlistTarget) write(users map[string]string, warnings *strictLog, timings userlist.Timings) (bool, error) {
+	selected := make(map[string]string)
+	for username, password := range users {
+		if t.filter == nil || t.filter(username, password) {
+			selected[username] = password
+		}
+	}
+	content := t.pooler().Render(selected, warnings)
+	if err := warnings.strictError(); err != nil {
+		return false, err
+	}
+	return writeUserList(t.path, t.triggerFile, content, timings)
+}
+
+// extraTargets returns userlist files configured in addition to -path,
+// with the settings and hba rules read with the users.
+func extraTargets(settings map[string]map[string]string, rules []hbaRule) ([]userlistTarget, error) {
+	var targets []userlistTarget
+	targets = append(targets, replicaTargets()...)
+	if *md5Path != "" {
+		targets = append(targets, newPasswordTypeTarget(*md5Path, *md5ReloadCommand, passwordMD5))
+	}
+	if *scramPath != "" {
+		targets = append(targets, newPasswordTypeTarget(*scramPath, *scramReloadCommand, passwordSCRAM))
+	}
+	if *odysseyPath != "" {
+		targets = append(targets, newTarget(poolerAdapters[poolerOdyssey](), *odysseyPath, *odysseyReloadCommand, poolerOdyssey))
+	}
+	if *pgcatPath != "" {
+		targets = append(targets, newTarget(poolerAdapters[poolerPgcat](), *pgcatPath, *pgcatReloadCommand, poolerPgcat))
+	}
+	if *usersIniPath != "" {
+		targets = append(targets, newTarget(usersSectionAdapter{settings: settings}, *usersIniPath, *reloadCommand, "users"))
+	}
+	if *hbaPath != "" {
+		command := *hbaReloadCommand
+		if command == "" {
+			command = *reloadCommand
+		}
+		targets = append(targets, newTarget(hbaAdapter{rules: rules}, *hbaPath, command, "hba"))
+	}
+	if *subsetsFile != "" {
+		subsets, err := readSubsets(*subsetsFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range subsets {
+			t, err := s.target()
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+// replicaTargets returns copies of userlist at -replica-paths, reloads are triggered
+// by <-reload-trigger-file>.replica-<n>.
+func replicaTargets() []userlistTarget {
+	command := *replicaReload
+	if command == "" {
+		command = *reloadCommand
+	}
+	var targets []userlistTarget
+	for _, path := range strings.Split(*replicaPaths, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			targets = append(targets, newTarget(pgbouncerAdapter{}, path, command, fmt.Sprintf("replica-%d", len(targets)+1)))
+		}
+	}
+	return targets
+}
+
+// newPasswordTypeTarget returns target with users having passwords of the type only.
+func newPasswordTypeTarget(path, reloadCommand, kind string) userlistTarget {
+	t := newTarget(pgbouncerAdapter{}, path, reloadCommand, kind)
+	t.filter = func(_, password string) bool {
+		return passwordType(password) == kind
+	}
+	return t
+}
+
+// subset is an additional output of the pooler with users selected by glob patterns and password type.
+type subset struct {
+	Name          string   `yaml:"name"`
+	Pooler        string   `yaml:"pooler"`
+	Path          string   `yaml:"path"`
+	ReloadCommand string   `yaml:"reload_command"`
+	Include       []string `yaml:"include"`
+	Exclude       []string `yaml:"exclude"`
+	PasswordType  string   `yaml:"password_type"`
+}
+
+// readSubsets loads YAML list of subsets, e.g. [{name: ro, path: /etc/pgbouncer-ro/userlist.txt, include: ["*_ro"]}].
+func readSubsets(file string) ([]subset, error) {
+	// nolint:gosec
+	data, err := os.ReadFile(filepath.Clean(file))
+	if err != nil {
+		return nil, err
+	}
+	var subsets []subset
+	if err := yaml.Unmarshal(data, &subsets); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	names := make(map[string]bool, len(subsets))
+	for i, s := range subsets {
+		if s.Name == "" || s.Path == "" {
+			return nil, fmt.Errorf("%s: subset %d: name and path are required", file, i+1)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("%s: duplicate subset %q", file, s.Name)
+		}
+		names[s.Name] = true
+		for _, pattern := range append(append([]string{}, s.Include...), s.Exclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s: subset %q: pattern %q: %w", file, s.Name, pattern, err)
+			}
+		}
+		if _, err := newPoolerAdapter(s.Pooler); err != nil {
+			return nil, fmt.Errorf("%s: subset %q: %w", file, s.Name, err)
+		}
+		switch s.PasswordType {
+		case "", passwordMD5, passwordSCRAM, passwordPlain:
+		default:
+			return nil, fmt.Errorf("%s: subset %q: unknown password type %q", file, s.Name, s.PasswordType)
+		}
+	}
+	return subsets, nil
+}
+
+// target returns userlist target of the subset, users match any include pattern
+// (all users if there are none) and no exclude pattern.
+func (s subset) target() (userlistTarget, error) {
+	adapter, err := newPoolerAdapter(s.Pooler)
+	if err != nil {
+		return userlistTarget{}, err
+	}
+	t := newTarget(adapter, s.Path, s.ReloadCommand, s.Name)
+	t.filter = func(username, password string) bool {
+		if s.PasswordType != "" && passwordType(password) != s.PasswordType {
+			return false
+		}
+		if matchAny(s.Exclude, username) {
+			return false
+		}
+		return len(s.Include) == 0 || matchAny(s.Include, username)
+	}
+	return t, nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// tenantPlaceholder is replaced by the tenant in -tenant-path and -tenant-reload-command.
+const tenantPlaceholder = "{{.Tenant}}"
+
+// tenantRe is compiled -tenant-regex.
+var tenantRe *regexp.Regexp
+
+// tenantNameRe matches tenants which are safe as path components and trigger file suffixes.
+var tenantNameRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+func validateTenants() error {
+	if *tenantPath == "" && *tenantRegex == "" {
+		return nil
+	}
+	if *tenantPath == "" || *tenantRegex == "" {
+		return errors.New("-tenant-path and -tenant-regex are required together")
+	}
+	if !strings.Contains(*tenantPath, tenantPlaceholder) {
+		return fmt.Errorf("-tenant-path must contain %s", tenantPlaceholder)
+	}
+	var err error
+	if tenantRe, err = regexp.Compile(*tenantRegex); err != nil {
+		return fmt.Errorf("-tenant-regex: %w", err)
+	}
+	if tenantRe.NumSubexp() == 0 {
+		return errors.New("-tenant-regex must have a group capturing the tenant, like ^([a-z0-9]+)_")
+	}
+	return nil
+}
+
+// tenantOf returns the tenant of the role, the group named tenant or the first group of -tenant-regex.
+func tenantOf(username string) string {
+	m := tenantRe.FindStringSubmatch(username)
+	if m == nil {
+		return ""
+	}
+	if i := tenantRe.SubexpIndex("tenant"); i > 0 {
+		return m[i]
+	}
+	return m[1]
+}
+
+// tenantTargets returns a userlist file of every tenant found among the users at -tenant-path,
+// with users of the tenant only, directories of new tenants are created. Files of known
+// tenants left without users are emptied, so their credentials are no longer accepted.
+// The found tenants are returned to be recorded in the state once the files are written.
+func tenantTargets(users map[string]string, known []string, warnings *strictLog) ([]userlistTarget, []string, error) {
+	if tenantRe == nil {
+		return nil, nil, nil
+	}
+	tenants := make(map[string]bool)
+	for username := range users {
+		tenant := tenantOf(username)
+		switch {
+		case tenant == "":
+		case !tenantNameRe.MatchString(tenant):
+			warnings.warnSkipped("tenant %q of user %q can't be used in paths", tenant, username)
+		default:
+			tenants[tenant] = true
+		}
+	}
+	found := make([]string, 0, len(tenants))
+	for tenant := range tenants {
+		found = append(found, tenant)
+	}
+	sort.Strings(found)
+	names := append([]string(nil), found...)
+	for _, tenant := range known {
+		if !tenants[tenant] {
+			names = append(names, tenant)
+		}
+	}
+	command := *tenantReloadCommand
+	if command == "" {
+		command = *reloadCommand
+	}
+	targets := make([]userlistTarget, 0, len(names))
+	for _, tenant := range names {
+		tenant := tenant
+		path := strings.ReplaceAll(*tenantPath, tenantPlaceholder, tenant)
+		if err := checkAllowedRoot(path); err != nil {
+			return nil, nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			return nil, nil, err
+		}
+		t := newTarget(pgbouncerAdapter{}, path, strings.ReplaceAll(command, tenantPlaceholder, shellQuote(tenant)), "tenant-"+tenant)
+		t.filter = func(username, _ string) bool {
+			return tenantOf(username) == tenant
+		}
+		targets = append(targets, t)
+	}
+	return targets, found, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// runTerraform implements terraform external data source protocol: it reads
+// the query JSON object from r and writes a flat JSON object of strings to w.
+// The query may override the exclude list with the "exclude" key.
+func runTerraform(ctx context.Context, db *sql.DB, r io.Reader, w io.Writer) error {
+	query := make(map[string]string)
+	if err := json.NewDecoder(r).Decode(&query); err != nil && err != io.EOF {
+		return fmt.Errorf("parse query: %w", err)
+	}
+	exclude := strings.Split(*excludeAccounts, ",")
+	if value, ok := query["exclude"]; ok {
+		exclude = strings.Split(value, ",")
+	}
+	users, errFetch := fetchUserList(ctx, db, exclude, nil)
+	if errFetch != nil {
+		return errFetch
+	}
+	names := make([]string, 0, len(users))
+	for username := range users {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+	hash := sha256.Sum256(userlist.Render(users))
+	return json.NewEncoder(w).Encode(map[string]string{
+		"users": strings.Join(names, ","),
+		"count": strconv.Itoa(len(names)),
+		"hash":  hex.EncodeToString(hash[:]),
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+const (
+	passwordMD5   = "md5"
+	passwordSCRAM = "scram-sha-256"
+	passwordPlain = "plain"
+)
+
+// passwordType detects how the password is stored in the userlist.
+func passwordType(password string) string {
+	switch {
+	case strings.HasPrefix(password, "SCRAM-SHA-256$"):
+		return passwordSCRAM
+	case len(password) == 35 && strings.HasPrefix(password, "md5"):
+		return passwordMD5
+	default:
+		return passwordPlain
+	}
+}
+
+// readUserList parses an existing userlist.txt into a username to password map.
+func readUserList(path string) (map[string]string, error) {
+	path = filepath.Clean(path)
+	// nolint:gosec
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	// nolint:errcheck,gosec
+	defer fd.Close()
+	users, err := userlist.Parse(fd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return users, nil
+}
@@ -2,4 +2,8 @@ module github/vadv/pgbouncer-userlist-generator
 
 go 1.17
 
-require github.com/lib/pq v1.10.3
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/lib/pq v1.10.9
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,13 @@
+// Package userlist maintains pgbouncer userlist files: Generator renders
+// users of a Source, replaces the file atomically with backups and reloads
+// pgbouncer through trigger files, RenderTo and NewReader stream the content
+// to embedders, Parse and Diff read and compare existing files. Operating
+// system interactions go through FS, Clock and Runner, so embedders can
+// substitute them; the userlisttest package provides fakes for tests. The
+// package has no mutable global state, so an embedding service may run many
+// generators with different files concurrently.
+//
+// The pgbouncer-userlist-generator command runs its pipeline with Generator:
+// its role filters and mappings are the Source, verifications are Filters,
+// approvals and freezes are the Gate, and additional pooler files are Outputs.
+package userlist
@@ -0,0 +1,137 @@
+package userlist
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+)
+
+// File is a generated file which is replaced atomically, keeping a backup of
+// the previous version. The trigger file is written before the swap and
+// removed after a successful reload, so a failed reload is retried by the
+// next run. Nil FS and Clock default to the operating system ones.
+type File struct {
+	Path        string
+	TriggerFile string
+	FS          FS
+	Clock       Clock
+	Timings     Timings
+	// BackupAnnotation is written next to the backup with .json suffix when set.
+	BackupAnnotation []byte
+}
+
+func (f *File) fs() FS {
+	if f.FS == nil {
+		return OSFS
+	}
+	return f.FS
+}
+
+func (f *File) clock() Clock {
+	if f.Clock == nil {
+		return SystemClock
+	}
+	return f.Clock
+}
+
+// Write replaces the file with content if it differs and returns whether it has changed.
+func (f *File) Write(content []byte) (bool, error) {
+	fs := f.fs()
+	tmpPath := f.Path + ".tmp"
+	writeStart := time.Now()
+	errWrite := fs.WriteFile(tmpPath, content, 0600)
+	f.Timings.Add(PhaseWrite, writeStart)
+	if errWrite != nil {
+		return false, errWrite
+	}
+	// nolint:errcheck
+	defer fs.Remove(tmpPath)
+	compareStart := time.Now()
+	current, errRead := fs.ReadFile(f.Path)
+	f.Timings.Add(PhaseCompare, compareStart)
+	switch {
+	case errRead == nil && bytes.Equal(current, content):
+		return false, nil
+	case errRead == nil:
+		backupStart := time.Now()
+		backup := fmt.Sprintf("%s.backup-%d", f.Path, f.clock().Now().UTC().Unix())
+		errBackup := fs.WriteFile(backup, current, 0600)
+		if errBackup == nil && f.BackupAnnotation != nil {
+			errBackup = fs.WriteFile(backup+".json", f.BackupAnnotation, 0600)
+		}
+		f.Timings.Add(PhaseWrite, backupStart)
+		if errBackup != nil {
+			return false, errBackup
+		}
+	case !os.IsNotExist(errRead):
+		return false, errRead
+	}
+	// before rename - write trigger file.
+	renameStart := time.Now()
+	if f.TriggerFile != "" {
+		if err := fs.WriteFile(f.TriggerFile, nil, 0600); err != nil {
+			return false, err
+		}
+	}
+	errRename := fs.Rename(tmpPath, f.Path)
+	f.Timings.Add(PhaseWrite, renameStart)
+	if errRename != nil {
+		return false, errRename
+	}
+	return true, nil
+}
+
+// Restore replaces the file with content of the backup the way Write does,
+// so the current version is backed up and the reload is triggered.
+func (f *File) Restore(backup string) (bool, error) {
+	content, err := f.fs().ReadFile(backup)
+	if err != nil {
+		return false, err
+	}
+	return f.Write(content)
+}
+
+// Rollback moves the backup over the file and triggers the reload, unlike Restore
+// the replaced content isn't backed up and the annotation of the backup is removed.
+func (f *File) Rollback(backup string) error {
+	fs := f.fs()
+	start := time.Now()
+	defer f.Timings.Add(PhaseWrite, start)
+	if f.TriggerFile != "" {
+		if err := fs.WriteFile(f.TriggerFile, nil, 0600); err != nil {
+			return err
+		}
+	}
+	if err := fs.Rename(backup, f.Path); err != nil {
+		return err
+	}
+	if err := fs.Remove(backup + ".json"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ReloadPending reports whether the trigger file exists.
+func (f *File) ReloadPending() bool {
+	if f.TriggerFile == "" {
+		return false
+	}
+	_, err := f.fs().Stat(f.TriggerFile)
+	return err == nil
+}
+
+// Reload runs the command with the runner if the reload is pending and
+// removes the trigger file after it succeeds.
+func (f *File) Reload(runner Runner, command string, timeout time.Duration) error {
+	if !f.ReloadPending() {
+		return nil
+	}
+	reloadStart := time.Now()
+	errRun := runner.Run(command, timeout, nil)
+	f.Timings.Add(PhaseReload, reloadStart)
+	if errRun != nil {
+		return errRun
+	}
+	return f.fs().Remove(f.TriggerFile)
+}
@@ -0,0 +1,238 @@
+package userlist_test
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// memFS is an in-memory userlist.FS, failRename makes renames fail.
+type memFS struct {
+	mu         sync.Mutex
+	files      map[string][]byte
+	failRename error
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: make(map[string][]byte)}
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (m *memFS) WriteFile(name string, data []byte, _ os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failRename != nil {
+		return m.failRename
+	}
+	data, ok := m.files[oldpath]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	m.files[newpath] = data
+	delete(m.files, oldpath)
+	return nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	// callers only check the error.
+	return nil, nil
+}
+
+// names returns sorted names of the files.
+func (m *memFS) names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.files))
+	for name := range m.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// commandRunner records commands, failing them with err.
+type commandRunner struct {
+	commands []string
+	err      error
+}
+
+func (r *commandRunner) Run(command string, _ time.Duration, _ []string) error {
+	r.commands = append(r.commands, command)
+	return r.err
+}
+
+func newTestFile(fs *memFS) *userlist.File {
+	return &userlist.File{
+		Path:        "/etc/pgbouncer/userlist.txt",
+		TriggerFile: "/tmp/userlist.trigger",
+		FS:          fs,
+		Clock:       fixedClock(time.Unix(1700000000, 0)),
+	}
+}
+
+func TestFileWriteCreatesFileAndTrigger(t *testing.T) {
+	fs := newMemFS()
+	f := newTestFile(fs)
+	changed, err := f.Write([]byte("a\n"))
+	if err != nil || !changed {
+		t.Fatalf("Write() = %v, %v, want changed", changed, err)
+	}
+	want := []string{"/etc/pgbouncer/userlist.txt", "/tmp/userlist.trigger"}
+	if got := fs.names(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("files %v, want %v without backups and temp files", got, want)
+	}
+	if !f.ReloadPending() {
+		t.Fatal("reload isn't pending after the change")
+	}
+}
+
+func TestFileWriteUnchangedKeepsFile(t *testing.T) {
+	fs := newMemFS()
+	fs.files["/etc/pgbouncer/userlist.txt"] = []byte("a\n")
+	f := newTestFile(fs)
+	changed, err := f.Write([]byte("a\n"))
+	if err != nil || changed {
+		t.Fatalf("Write() = %v, %v, want unchanged", changed, err)
+	}
+	if got := fs.names(); len(got) != 1 {
+		t.Fatalf("files %v, want the userlist only", got)
+	}
+	if f.ReloadPending() {
+		t.Fatal("reload is pending without changes")
+	}
+}
+
+func TestFileWriteBacksUpPrevious(t *testing.T) {
+	fs := newMemFS()
+	fs.files["/etc/pgbouncer/userlist.txt"] = []byte("old\n")
+	f := newTestFile(fs)
+	f.BackupAnnotation = []byte(`{"changed":1}`)
+	if _, err := f.Write([]byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	backup := "/etc/pgbouncer/userlist.txt.backup-1700000000"
+	if data, err := fs.ReadFile(backup); err != nil || string(data) != "old\n" {
+		t.Fatalf("backup %s = %q, %v, want the previous content", backup, data, err)
+	}
+	if data, err := fs.ReadFile(backup + ".json"); err != nil || string(data) != `{"changed":1}` {
+		t.Fatalf("annotation = %q, %v", data, err)
+	}
+	if data, _ := fs.ReadFile(f.Path); string(data) != "new\n" {
+		t.Fatalf("userlist = %q, want the new content", data)
+	}
+}
+
+func TestFileWriteIsAtomic(t *testing.T) {
+	fs := newMemFS()
+	fs.files["/etc/pgbouncer/userlist.txt"] = []byte("old\n")
+	fs.failRename = errors.New("disk full")
+	f := newTestFile(fs)
+	if _, err := f.Write([]byte("new\n")); err == nil {
+		t.Fatal("Write() succeeded with failing rename")
+	}
+	if data, _ := fs.ReadFile(f.Path); string(data) != "old\n" {
+		t.Fatalf("userlist = %q, want the previous content kept", data)
+	}
+	if _, err := fs.ReadFile(f.Path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temp file is left behind: %v", err)
+	}
+}
+
+func TestFileReloadRemovesTriggerOnSuccess(t *testing.T) {
+	fs := newMemFS()
+	f := newTestFile(fs)
+	runner := &commandRunner{err: errors.New("pgbouncer is down")}
+	if err := f.Reload(runner, "reload", time.Second); err != nil {
+		t.Fatalf("Reload() without the trigger file = %v", err)
+	}
+	if len(runner.commands) != 0 {
+		t.Fatalf("commands %v run without the trigger file", runner.commands)
+	}
+	if _, err := f.Write([]byte("a\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(runner, "reload", time.Second); err == nil {
+		t.Fatal("Reload() hides the failure of the command")
+	}
+	if !f.ReloadPending() {
+		t.Fatal("trigger file is removed after the failed reload")
+	}
+	runner.err = nil
+	if err := f.Reload(runner, "reload", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if f.ReloadPending() {
+		t.Fatal("trigger file is kept after the reload")
+	}
+	if got := strings.Join(runner.commands, ","); got != "reload,reload" {
+		t.Fatalf("commands %s, want the failed reload retried", got)
+	}
+}
+
+func TestFileRollback(t *testing.T) {
+	fs := newMemFS()
+	fs.files["/etc/pgbouncer/userlist.txt"] = []byte("old\n")
+	f := newTestFile(fs)
+	f.BackupAnnotation = []byte("{}")
+	if _, err := f.Write([]byte("new\n")); err != nil {
+		t.Fatal(err)
+	}
+	backup := "/etc/pgbouncer/userlist.txt.backup-1700000000"
+	if err := fs.Remove(f.TriggerFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Rollback(backup); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := fs.ReadFile(f.Path); !bytes.Equal(data, []byte("old\n")) {
+		t.Fatalf("userlist = %q, want the backup", data)
+	}
+	want := []string{"/etc/pgbouncer/userlist.txt", "/tmp/userlist.trigger"}
+	if got := fs.names(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("files %v, want %v", got, want)
+	}
+}
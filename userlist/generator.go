@@ -0,0 +1,207 @@
+package userlist
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Source provides usernames with their passwords.
+type Source interface {
+	Users(ctx context.Context) (map[string]string, error)
+}
+
+// Render returns userlist.txt content sorted by lines.
+func Render(users map[string]string) []byte {
+	var b bytes.Buffer
+	// nolint:errcheck
+	RenderTo(&b, users)
+	return b.Bytes()
+}
+
+// RenderTo writes userlist.txt content sorted by lines to w line by line,
+// so it can be streamed into HTTP responses or archives without temp files.
+func RenderTo(w io.Writer, users map[string]string) (int64, error) {
+	return io.Copy(w, NewReader(users))
+}
+
+// NewReader returns a reader of userlist.txt content sorted by lines,
+// lines are produced as they are read.
+func NewReader(users map[string]string) io.Reader {
+	return &lineReader{lines: renderLines(users)}
+}
+
+// renderLines returns sorted lines of the userlist without line breaks.
+func renderLines(users map[string]string) []string {
+	lines := make([]string, 0, len(users))
+	for username, password := range users {
+		lines = append(lines, fmt.Sprintf(`"%s" "%s"`, username, password))
+	}
+	sort.Strings(lines)
+	if len(lines) == 0 {
+		// an empty userlist still ends with the line break.
+		lines = append(lines, "")
+	}
+	return lines
+}
+
+// lineReader reads lines each followed by the line break.
+type lineReader struct {
+	lines   []string
+	current string
+}
+
+func (r *lineReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if r.current == "" {
+			if len(r.lines) == 0 {
+				break
+			}
+			r.current, r.lines = r.lines[0]+"\n", r.lines[1:]
+		}
+		copied := copy(p[n:], r.current)
+		r.current = r.current[copied:]
+		n += copied
+	}
+	if n == 0 && len(p) > 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// Filter rewrites or drops users of the source before they are written.
+type Filter interface {
+	Filter(ctx context.Context, users map[string]string) (map[string]string, error)
+}
+
+// FilterFunc adapts a function to Filter.
+type FilterFunc func(ctx context.Context, users map[string]string) (map[string]string, error)
+
+// Filter calls f(ctx, users).
+func (f FilterFunc) Filter(ctx context.Context, users map[string]string) (map[string]string, error) {
+	return f(ctx, users)
+}
+
+// Output is an additional file generated from the same users, like userlists
+// of other poolers, and reports whether it has changed.
+type Output interface {
+	Write(ctx context.Context, users map[string]string) (bool, error)
+}
+
+// OutputFunc adapts a function to Output.
+type OutputFunc func(ctx context.Context, users map[string]string) (bool, error)
+
+// Write calls f(ctx, users).
+func (f OutputFunc) Write(ctx context.Context, users map[string]string) (bool, error) {
+	return f(ctx, users)
+}
+
+// Generator writes users of the source to the file and reloads pgbouncer
+// with the reload command when the file has changed. Nil Runner defaults
+// to ShellRunner, empty reload command skips the reload.
+//
+// Users of the source pass Filters in order. The content rendered by Render,
+// Render of the package by default, replaces the file unless Gate holds it
+// back. Written is called after the write, Reload replaces the reload by the
+// reload command when set, and Outputs are written last.
+//
+// A Generator keeps all of its configuration in its fields, so generators
+// with their own Source and File run concurrently. Runs of the same
+// Generator are serialized.
+type Generator struct {
+	Source        Source
+	File          *File
+	Runner        Runner
+	ReloadCommand string
+	ReloadTimeout time.Duration
+
+	Filters []Filter
+	Render  func(users map[string]string) []byte
+	// Gate reports whether the content may replace the file, held back content
+	// leaves the file and outputs as they are.
+	Gate    func(ctx context.Context, users map[string]string, content []byte) (bool, error)
+	Written func(ctx context.Context, result Result) error
+	Reload  func(ctx context.Context, result Result) error
+	Outputs []Output
+
+	mu sync.Mutex
+}
+
+// Result is the outcome of a generator run.
+type Result struct {
+	Users map[string]string
+	// Changed is whether the file has changed, OutputsChanged whether any of outputs has.
+	Changed, OutputsChanged bool
+	// Held is whether Gate has held back the content.
+	Held bool
+}
+
+// Run fetches users, replaces the file if they have changed and reloads pgbouncer
+// if the reload is pending, including one left by a previous failed run.
+func (g *Generator) Run(ctx context.Context) (Result, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var result Result
+	users, err := g.Source.Users(ctx)
+	if err != nil {
+		return result, fmt.Errorf("fetch users: %w", err)
+	}
+	for _, f := range g.Filters {
+		if users, err = f.Filter(ctx, users); err != nil {
+			return result, fmt.Errorf("filter users: %w", err)
+		}
+	}
+	result.Users = users
+	render := g.Render
+	if render == nil {
+		render = Render
+	}
+	content := render(users)
+	if g.Gate != nil {
+		apply, err := g.Gate(ctx, users, content)
+		if err != nil {
+			return result, err
+		}
+		if result.Held = !apply; result.Held {
+			return result, nil
+		}
+	}
+	if result.Changed, err = g.File.Write(content); err != nil {
+		return result, fmt.Errorf("write %s: %w", g.File.Path, err)
+	}
+	if g.Written != nil {
+		if err := g.Written(ctx, result); err != nil {
+			return result, err
+		}
+	}
+	if err := g.reload(ctx, result); err != nil {
+		return result, fmt.Errorf("reload: %w", err)
+	}
+	for _, output := range g.Outputs {
+		changed, err := output.Write(ctx, users)
+		if err != nil {
+			return result, err
+		}
+		result.OutputsChanged = result.OutputsChanged || changed
+	}
+	return result, nil
+}
+
+func (g *Generator) reload(ctx context.Context, result Result) error {
+	if g.Reload != nil {
+		return g.Reload(ctx, result)
+	}
+	if g.ReloadCommand == "" {
+		return nil
+	}
+	runner := g.Runner
+	if runner == nil {
+		runner = ShellRunner
+	}
+	return g.File.Reload(runner, g.ReloadCommand, g.ReloadTimeout)
+}
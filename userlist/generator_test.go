@@ -0,0 +1,176 @@
+package userlist_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+	"github/vadv/pgbouncer-userlist-generator/userlisttest"
+)
+
+func TestGeneratorRun(t *testing.T) {
+	source := userlisttest.NewSource(map[string]string{"bob": "md5b", "alice": "md5a"})
+	output := userlisttest.NewOutput(t)
+	reloader := &userlisttest.Reloader{}
+	g := userlisttest.NewGenerator(source, output, reloader)
+
+	result, err := g.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Changed || len(result.Users) != 2 {
+		t.Fatalf("first run = %+v, want 2 users changed", result)
+	}
+	if got, want := string(output.Content()), "\"alice\" \"md5a\"\n\"bob\" \"md5b\"\n"; got != want {
+		t.Fatalf("userlist = %q, want %q", got, want)
+	}
+	if got := reloader.Commands(); len(got) != 1 || got[0] != "reload" {
+		t.Fatalf("reloads %v, want one", got)
+	}
+
+	result, err = g.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Changed || len(reloader.Commands()) != 1 {
+		t.Fatalf("unchanged run = %+v with reloads %v, want no reload", result, reloader.Commands())
+	}
+	if backups := output.Backups(); len(backups) != 0 {
+		t.Fatalf("backups %v of the first version", backups)
+	}
+
+	source.Set(map[string]string{"alice": "md5a2"})
+	if result, err = g.Run(context.Background()); err != nil || !result.Changed {
+		t.Fatalf("changed run = %+v, %v", result, err)
+	}
+	if backups := output.Backups(); len(backups) != 1 {
+		t.Fatalf("backups %v, want the previous version", backups)
+	}
+	if got := len(reloader.Commands()); got != 2 {
+		t.Fatalf("%d reloads, want 2", got)
+	}
+}
+
+func TestGeneratorRetriesFailedReload(t *testing.T) {
+	source := userlisttest.NewSource(map[string]string{"alice": "md5a"})
+	output := userlisttest.NewOutput(t)
+	reloader := &userlisttest.Reloader{}
+	g := userlisttest.NewGenerator(source, output, reloader)
+
+	reloader.Fail(errors.New("pgbouncer is down"))
+	if _, err := g.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "reload") {
+		t.Fatalf("Run() = %v, want reload error", err)
+	}
+	reloader.Fail(nil)
+	result, err := g.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Changed {
+		t.Fatal("the file has changed again")
+	}
+	if got := len(reloader.Commands()); got != 2 {
+		t.Fatalf("%d reloads, want the failed one retried", got)
+	}
+}
+
+func TestGeneratorKeepsFileWhenSourceFails(t *testing.T) {
+	source := userlisttest.NewSource(map[string]string{"alice": "md5a"})
+	output := userlisttest.NewOutput(t)
+	reloader := &userlisttest.Reloader{}
+	g := userlisttest.NewGenerator(source, output, reloader)
+	if _, err := g.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	before := output.Content()
+
+	source.Fail(errors.New("connection refused"))
+	if _, err := g.Run(context.Background()); err == nil {
+		t.Fatal("Run() succeeded with failing source")
+	}
+	if got := output.Content(); string(got) != string(before) {
+		t.Fatalf("userlist = %q, want %q kept", got, before)
+	}
+	if got := len(reloader.Commands()); got != 1 {
+		t.Fatalf("%d reloads, want none after the failure", got)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	source.Fail(nil)
+	if _, err := g.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Run() with canceled context = %v", err)
+	}
+}
+
+func TestGeneratorsRunConcurrently(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		source := userlisttest.NewSource(map[string]string{"alice": "md5a"})
+		g := userlisttest.NewGenerator(source, userlisttest.NewOutput(t), &userlisttest.Reloader{})
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func(g *userlist.Generator) {
+				defer wg.Done()
+				if _, err := g.Run(context.Background()); err != nil {
+					t.Error(err)
+				}
+			}(g)
+		}
+	}
+	wg.Wait()
+}
+
+func TestGeneratorSteps(t *testing.T) {
+	source := userlisttest.NewSource(map[string]string{"alice": "md5a", "bob": "md5b"})
+	output := userlisttest.NewOutput(t)
+	reloader := &userlisttest.Reloader{}
+	g := userlisttest.NewGenerator(source, output, reloader)
+	g.Filters = []userlist.Filter{userlist.FilterFunc(func(_ context.Context, users map[string]string) (map[string]string, error) {
+		delete(users, "bob")
+		return users, nil
+	})}
+	held := true
+	g.Gate = func(context.Context, map[string]string, []byte) (bool, error) {
+		return !held, nil
+	}
+	var written []map[string]string
+	g.Outputs = []userlist.Output{userlist.OutputFunc(func(_ context.Context, users map[string]string) (bool, error) {
+		written = append(written, users)
+		return true, nil
+	})}
+
+	result, err := g.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, errStat := os.Stat(output.File.Path); !result.Held || result.Changed || !os.IsNotExist(errStat) || len(written) != 0 || len(reloader.Commands()) != 0 {
+		t.Fatalf("held run = %+v wrote the userlist or outputs %v", result, written)
+	}
+
+	held = false
+	if result, err = g.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(output.Content()), "\"alice\" \"md5a\"\n"; got != want {
+		t.Fatalf("userlist = %q, want %q", got, want)
+	}
+	if !result.Changed || !result.OutputsChanged || len(written) != 1 || len(written[0]) != 1 {
+		t.Fatalf("run = %+v with outputs %v, want filtered users written", result, written)
+	}
+
+	g.Reload = func(context.Context, userlist.Result) error {
+		return errors.New("canary failed")
+	}
+	source.Set(map[string]string{"alice": "md5a2"})
+	if _, err := g.Run(context.Background()); err == nil || !strings.Contains(err.Error(), "canary failed") {
+		t.Fatalf("Run() = %v, want the reload error", err)
+	}
+	if len(written) != 1 {
+		t.Fatalf("outputs %v written after the failed reload", written)
+	}
+}
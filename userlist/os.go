@@ -0,0 +1,101 @@
+package userlist
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// FS is the subset of file system operations used by the generator.
+type FS interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+	Stat(name string) (os.FileInfo, error)
+}
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// Runner executes shell commands, the env is appended to the environment of
+// the current process. Zero timeout waits for the command forever.
+type Runner interface {
+	Run(command string, timeout time.Duration, env []string) error
+}
+
+// Defaults of File and Generator fields, they are stateless and shared by all
+// instances, set the fields instead of replacing them.
+var (
+	// OSFS is FS of the operating system.
+	OSFS FS = osFS{}
+	// SystemClock is the wall clock.
+	SystemClock Clock = systemClock{}
+	// ShellRunner runs commands with bash.
+	ShellRunner Runner = shellRunner{}
+)
+
+type osFS struct{}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(filepath.Clean(name))
+}
+
+func (osFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type shellRunner struct{}
+
+// Run runs command with bash in its own process group and kills the whole
+// group on timeout, so children like systemctl waiting for polkit can't
+// outlive it. Platforms without process groups kill bash only.
+func (shellRunner) Run(command string, timeout time.Duration, env []string) error {
+	// nolint:gosec
+	cmd := exec.Command("/bin/bash", "-ec", command)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	if timeout <= 0 {
+		return <-done
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		// nolint:errcheck
+		killProcessGroup(cmd)
+		<-done
+		return fmt.Errorf("%q timed out after %s", command, timeout)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package userlist
+
+import "os/exec"
+
+func setProcessGroup(*exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
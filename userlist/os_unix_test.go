@@ -0,0 +1,77 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package userlist_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+func TestShellRunnerKillsProcessGroupOnTimeout(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "sleep.pid")
+	start := time.Now()
+	err := userlist.ShellRunner.Run(`sleep 30 & echo $! > "$PID_FILE"; wait`, 500*time.Millisecond, []string{"PID_FILE=" + pidFile})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("run returned after %s, waited for the grandchild", elapsed)
+	}
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("read pid of the grandchild: %s", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatalf("parse pid %q: %s", data, err)
+	}
+	// the killed grandchild is reparented and reaped asynchronously.
+	deadline := time.Now().Add(5 * time.Second)
+	for running(pid) {
+		if time.Now().After(deadline) {
+			// nolint:errcheck
+			syscall.Kill(pid, syscall.SIGKILL)
+			t.Fatalf("grandchild %d is still running after the timeout", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShellRunnerPassesEnv(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	if err := userlist.ShellRunner.Run(`echo "$GREETING" > "$OUT"`, time.Second, []string{"GREETING=hello", "OUT=" + out}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello\n" {
+		t.Fatalf("unexpected output %q", data)
+	}
+}
+
+// running reports whether the process exists and isn't a zombie waiting to be reaped.
+func running(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil {
+		return false
+	}
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return !os.IsNotExist(err)
+	}
+	// the state follows the command name in parentheses.
+	if i := bytes.LastIndexByte(stat, ')'); i >= 0 && i+2 < len(stat) {
+		return stat[i+2] != 'Z'
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package userlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Parse reads userlist.txt content into a username to password map,
+// lines which don't start with a quote are ignored.
+func Parse(r io.Reader) (map[string]string, error) {
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, `"`) {
+			continue
+		}
+		username, rest, ok := parseQuoted(line)
+		if !ok {
+			return nil, fmt.Errorf("line %d: malformed username", n)
+		}
+		password, _, ok := parseQuoted(strings.TrimSpace(rest))
+		if !ok {
+			return nil, fmt.Errorf("line %d: malformed password", n)
+		}
+		users[username] = password
+	}
+	return users, scanner.Err()
+}
+
+// parseQuoted reads a double-quoted token where "" stands for a literal quote.
+func parseQuoted(s string) (token, rest string, ok bool) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", s, false
+	}
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != '"' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '"' {
+			b.WriteByte('"')
+			i++
+			continue
+		}
+		return b.String(), s[i+1:], true
+	}
+	return "", s, false
+}
+
+// Diff returns sorted names of users added to, removed from and with passwords updated in current compared to previous.
+func Diff(previous, current map[string]string) (added, removed, updated []string) {
+	for username, password := range current {
+		old, ok := previous[username]
+		switch {
+		case !ok:
+			added = append(added, username)
+		case old != password:
+			updated = append(updated, username)
+		}
+	}
+	for username := range previous {
+		if _, ok := current[username]; !ok {
+			removed = append(removed, username)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(updated)
+	return added, removed, updated
+}
@@ -0,0 +1,50 @@
+package userlist
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Phases of a generation run.
+const (
+	PhaseConnect = "connect"
+	PhaseQuery   = "query"
+	PhaseScan    = "scan"
+	PhaseWrite   = "write"
+	PhaseCompare = "compare"
+	PhaseReload  = "reload"
+)
+
+// phases lists run phases in the order of execution.
+var phases = []string{PhaseConnect, PhaseQuery, PhaseScan, PhaseWrite, PhaseCompare, PhaseReload}
+
+// Timings accumulates durations of run phases, nil map discards them.
+type Timings map[string]time.Duration
+
+// Add accounts time elapsed since start to the phase.
+func (t Timings) Add(phase string, start time.Time) {
+	if t != nil {
+		t[phase] += time.Since(start)
+	}
+}
+
+// String formats timings of executed phases for logs.
+func (t Timings) String() string {
+	parts := make([]string, 0, len(phases))
+	for _, phase := range phases {
+		if d, ok := t[phase]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%s", phase, d.Round(time.Microsecond)))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Seconds converts timings to fractional seconds for JSON reports.
+func (t Timings) Seconds() map[string]float64 {
+	result := make(map[string]float64, len(t))
+	for phase, d := range t {
+		result[phase] = d.Seconds()
+	}
+	return result
+}
@@ -0,0 +1,151 @@
+// Package userlisttest provides fakes for exercising the userlist package
+// hermetically: an in-memory Source, an output in a temporary directory and
+// a reloader recording its commands.
+package userlisttest
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github/vadv/pgbouncer-userlist-generator/userlist"
+)
+
+// Source is an in-memory userlist.Source, safe for concurrent use.
+type Source struct {
+	mu    sync.Mutex
+	users map[string]string
+	err   error
+}
+
+// NewSource returns source with copy of users.
+func NewSource(users map[string]string) *Source {
+	s := &Source{}
+	s.Set(users)
+	return s
+}
+
+// Set replaces users returned by the source.
+func (s *Source) Set(users map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = copyUsers(users)
+}
+
+// Fail makes Users return err, nil err restores users.
+func (s *Source) Fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// Users implements userlist.Source.
+func (s *Source) Users(ctx context.Context) (map[string]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	return copyUsers(s.users), nil
+}
+
+func copyUsers(users map[string]string) map[string]string {
+	result := make(map[string]string, len(users))
+	for username, password := range users {
+		result[username] = password
+	}
+	return result
+}
+
+// Output is a userlist file with its trigger file in a temporary directory
+// removed when the test completes.
+type Output struct {
+	t    testing.TB
+	Dir  string
+	File *userlist.File
+}
+
+// NewOutput returns output in t.TempDir().
+func NewOutput(t testing.TB) *Output {
+	dir := t.TempDir()
+	return &Output{
+		t:   t,
+		Dir: dir,
+		File: &userlist.File{
+			Path:        filepath.Join(dir, "userlist.txt"),
+			TriggerFile: filepath.Join(dir, "userlist.trigger"),
+		},
+	}
+}
+
+// Content returns content of the userlist file, failing the test if it can't be read.
+func (o *Output) Content() []byte {
+	o.t.Helper()
+	data, err := userlist.OSFS.ReadFile(o.File.Path)
+	if err != nil {
+		o.t.Fatalf("read %s: %s", o.File.Path, err)
+	}
+	return data
+}
+
+// Backups returns paths of backups of the userlist file.
+func (o *Output) Backups() []string {
+	o.t.Helper()
+	backups, err := filepath.Glob(o.File.Path + ".backup-*")
+	if err != nil {
+		o.t.Fatalf("list backups: %s", err)
+	}
+	files := backups[:0]
+	for _, backup := range backups {
+		if !strings.HasSuffix(backup, ".json") {
+			files = append(files, backup)
+		}
+	}
+	return files
+}
+
+// Reloader is a userlist.Runner recording commands instead of executing them.
+type Reloader struct {
+	mu       sync.Mutex
+	commands []string
+	err      error
+}
+
+// Fail makes Run return err, nil err makes reloads succeed again.
+func (r *Reloader) Fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.err = err
+}
+
+// Run implements userlist.Runner, the command is recorded even if it fails.
+func (r *Reloader) Run(command string, _ time.Duration, _ []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commands = append(r.commands, command)
+	return r.err
+}
+
+// Commands returns executed commands.
+func (r *Reloader) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.commands...)
+}
+
+// NewGenerator returns generator wiring the source, output and reloader together,
+// the reload command is "reload".
+func NewGenerator(source *Source, output *Output, reloader *Reloader) *userlist.Generator {
+	return &userlist.Generator{
+		Source:        source,
+		File:          output.File,
+		Runner:        reloader,
+		ReloadCommand: "reload",
+	}
+}